@@ -4,10 +4,11 @@ go 1.14
 
 require (
 	github.com/godbus/dbus v4.1.0+incompatible
-	github.com/rakyll/portmidi v0.0.0-20201020180702-d436ceaa537a // indirect
+	github.com/rakyll/portmidi v0.0.0-20201020180702-d436ceaa537a
 	github.com/rs/zerolog v1.19.0
 	github.com/spf13/viper v1.7.0
 	github.com/sqp/pulseaudio v0.0.0-20180916175200-29ac6bfa231c
 	gitlab.com/gomidi/midi v1.17.0
 	gitlab.com/gomidi/portmididrv v0.6.0
+	gopkg.in/yaml.v3 v3.0.1
 )
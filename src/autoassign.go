@@ -0,0 +1,215 @@
+package pamidicontrol
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// AssignOrder is the order applications are given the automatically assigned
+// strips in.
+type AssignOrder string
+
+const (
+	// Oldest gives the strips to the applications that started playing
+	// first.
+	Oldest AssignOrder = ""
+	// Newest gives the strips to the applications that started playing
+	// most recently.
+	Newest AssignOrder = "Newest"
+)
+
+// Valid reports whether o is a known assignment order.
+func (o AssignOrder) Valid() bool {
+	switch o {
+	case Oldest, Newest:
+		return true
+	}
+	return false
+}
+
+// AutoAssign hands a pool of strips to the applications that are playing, so
+// that new applications get a fader without being configured.
+type AutoAssign struct {
+	// VolumeControls and MuteControls are the preset controls of each strip
+	// in the pool, such as fader1 and mute1. Mackie Control surfaces use
+	// the strips that aren't listed in Strips instead.
+	VolumeControls []string
+	MuteControls   []string
+
+	// Pinned applications get the first strips whenever they are playing,
+	// in the order they are listed.
+	Pinned []string
+
+	Order  AssignOrder
+	Pickup PickupMode
+
+	// pool holds the controls of each strip, resolved from the preset.
+	pool []autoStrip
+}
+
+// autoStrip is a strip of the pool. Its actions are mapped to the controls,
+// with the target filled in when the strip is assigned.
+type autoStrip struct {
+	volume MidiAction
+	mute   *MidiAction
+
+	// feedback lights the mute button while the strip holds an
+	// application.
+	feedback *PresetFeedback
+}
+
+// resolve looks up the pool controls in the preset.
+func (a *AutoAssign) resolve(preset *ControllerPreset) error {
+	a.pool = nil
+	for i, name := range a.VolumeControls {
+		control, ok := preset.Control(name)
+		if !ok {
+			return unknownControl(preset, name)
+		}
+		strip := autoStrip{volume: control.MidiAction(PulseAudioAction{ActionType: VolumeChange})}
+		strip.volume.Control = control.Name
+		strip.volume.Pickup = a.Pickup
+
+		if i < len(a.MuteControls) {
+			control, ok := preset.Control(a.MuteControls[i])
+			if !ok {
+				return unknownControl(preset, a.MuteControls[i])
+			}
+			mute := control.MidiAction(PulseAudioAction{ActionType: Mute})
+			mute.Control = control.Name
+			strip.mute = &mute
+			strip.feedback = control.Feedback
+		}
+		a.pool = append(a.pool, strip)
+	}
+	return nil
+}
+
+func unknownControl(preset *ControllerPreset, name string) error {
+	msg := fmt.Sprintf("the %s has no control named %q", preset.Name, name)
+	if suggestions := closestNames(name, preset.ControlNames(), 3); len(suggestions) > 0 {
+		msg += fmt.Sprintf(", did you mean %q?", suggestions[0])
+	}
+	return errors.New(msg)
+}
+
+// assign picks the applications for count strips from the names of the
+// playback streams, oldest first. Strips without an application are left
+// empty.
+func (a *AutoAssign) assign(names []string, count int) []string {
+	playing := make(map[string]bool, len(names))
+	for _, name := range names {
+		playing[name] = true
+	}
+
+	ordered := make([]string, 0, len(names))
+	for _, name := range a.Pinned {
+		if playing[name] && !containsString(ordered, name) {
+			ordered = append(ordered, name)
+		}
+	}
+
+	rest := make([]string, 0, len(names))
+	for _, name := range names {
+		if !containsString(a.Pinned, name) {
+			rest = append(rest, name)
+		}
+	}
+	if a.Order == Newest {
+		for i, j := 0, len(rest)-1; i < j; i, j = i+1, j-1 {
+			rest[i], rest[j] = rest[j], rest[i]
+		}
+	}
+	ordered = append(ordered, rest...)
+
+	assigned := make([]string, count)
+	copy(assigned, ordered)
+	return assigned
+}
+
+// startAutoAssign assigns the strips now and again every time playback
+// streams come and go.
+func (c *MidiClient) startAutoAssign(out *midiOutput) {
+	c.reassign(out)
+	c.PAClient.AddListener(func(path dbus.ObjectPath) {
+		if path == "" {
+			c.reassign(out)
+		}
+	})
+}
+
+// reassign gives the strips of the pool to the applications that are playing.
+func (c *MidiClient) reassign(out *midiOutput) {
+	names := c.PAClient.PlaybackStreamNames()
+
+	if c.surface != nil {
+		strips := append([]Strip{}, c.Strips...)
+		for _, name := range c.AutoAssign.assign(names, mcuStrips-len(c.Strips)) {
+			if name != "" {
+				strips = append(strips, Strip{TargetType: PlaybackStream, TargetName: name})
+			}
+		}
+		if c.surface.SetStrips(strips) {
+			for i := len(c.Strips); i < len(strips); i++ {
+				log.Info().Msgf("Assigned strip %d to %s", i+1, strips[i].TargetName)
+			}
+		}
+		return
+	}
+
+	assigned := c.AutoAssign.assign(names, len(c.AutoAssign.pool))
+	c.mu.Lock()
+	unchanged := c.assignment != nil && equalStrings(c.assignment, assigned)
+	c.assignment = assigned
+	c.mu.Unlock()
+	if unchanged {
+		return
+	}
+
+	actions := make([]MidiAction, 0, len(assigned)*2)
+	for i, name := range assigned {
+		strip := c.AutoAssign.pool[i]
+		target := PulseAudioAction{TargetType: PlaybackStream, TargetName: name}
+
+		if name != "" {
+			volume := strip.volume
+			volume.Action = target
+			volume.Action.ActionType = VolumeChange
+			actions = append(actions, volume)
+
+			if strip.mute != nil {
+				mute := *strip.mute
+				mute.Action = target
+				mute.Action.ActionType = Mute
+				actions = append(actions, mute)
+			}
+			log.Info().Msgf("Assigned %s to %s", strip.volume, name)
+		}
+
+		if strip.feedback != nil && out != nil {
+			if err := out.Feedback(*strip.feedback, name != ""); err != nil {
+				log.Warn().Err(err).Msgf("Could not light %s", strip.mute)
+			}
+		}
+	}
+
+	c.mu.Lock()
+	c.assigned = actions
+	c.assignedDispatch = newDispatchTable(actions)
+	c.mu.Unlock()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
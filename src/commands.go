@@ -0,0 +1,429 @@
+package pamidicontrol
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func runCheck(args []string) {
+	fs := newFlagSet("check")
+	configPath := configFlag(fs)
+	fs.Parse(args)
+
+	c := mustLoadConfig(*configPath)
+	_, paclient := connectPulseAudio()
+
+	scenes, err := LoadScenes(c.ScenesPath())
+	if err != nil {
+		panic(err)
+	}
+
+	problems := 0
+	// missing reports a target that doesn't exist, along with the names
+	// closest to it. what describes where the target is configured.
+	missing := func(what string, targetType PulseAudioTargetType, name string) {
+		names := paclient.TargetNames(targetType)
+		if containsString(names, name) {
+			return
+		}
+
+		problems++
+		msg := fmt.Sprintf("%s: no %s named [%s] exists", what, targetTypeName(targetType), name)
+		if suggestions := closestNames(name, names, 3); len(suggestions) > 0 {
+			msg += fmt.Sprintf(", did you mean [%s]?", strings.Join(suggestions, "], ["))
+		}
+		fmt.Println(msg)
+	}
+
+	actions := c.AllMidiActions()
+	for _, action := range actions {
+		if action.Action.ActionType == RecallScene {
+			if _, ok := scenes[action.Action.Scene]; !ok {
+				problems++
+				fmt.Printf("%s: no scene named [%s] has been saved in %s\n", action, action.Action.Scene, c.ScenesPath())
+			}
+			continue
+		}
+
+		for _, target := range action.Action.targets() {
+			missing(action.String(), target.TargetType, target.TargetName)
+		}
+		if action.Action.ActionType == Move {
+			missing(action.String(), moveDeviceType(action.Action.TargetType), action.Action.DeviceName)
+		}
+	}
+
+	devices := c.AllDevices()
+	for d, device := range devices {
+		prefix := ""
+		if len(devices) > 1 {
+			prefix = fmt.Sprintf("Device %d, ", d+1)
+		}
+
+		for i, strip := range device.Strips {
+			missing(fmt.Sprintf("%sStrip %d", prefix, i+1), strip.TargetType, strip.TargetName)
+		}
+		if device.Matrix != nil {
+			for i, row := range device.Matrix.Rows {
+				missing(fmt.Sprintf("%sMatrix row %d", prefix, i+1), device.Matrix.Streams, row)
+			}
+			for i, column := range device.Matrix.Columns {
+				missing(fmt.Sprintf("%sMatrix column %d", prefix, i+1), device.Matrix.deviceType(), column)
+			}
+		}
+		for i, meter := range device.Meters {
+			missing(fmt.Sprintf("%sMeter %d", prefix, i+1), meter.TargetType, meter.TargetName)
+		}
+	}
+
+	if len(c.Ducking) > 0 {
+		problems += checkDucking(c.Ducking, paclient)
+	}
+	if c.Safety != nil {
+		for i, sink := range c.Safety.Sinks {
+			missing(fmt.Sprintf("Safety sink %d", i+1), Sink, sink.Sink)
+		}
+	}
+
+	if problems > 0 {
+		fmt.Printf("%d target(s) or scene(s) could not be found. Streams only exist while their application is playing or recording.\n", problems)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s is valid and all %d target(s) exist\n", ConfigFileUsed(), len(actions))
+}
+
+// moveDeviceType returns the type of the devices a stream of the given type
+// can be moved to.
+func moveDeviceType(streamType PulseAudioTargetType) PulseAudioTargetType {
+	if streamType == RecordStream {
+		return Source
+	}
+	return Sink
+}
+
+// checkDucking prints the stream matches of the ducking rules that no playback
+// stream has the application name or role of, and returns how many there are.
+func checkDucking(rules []DuckingRule, paclient *PAClient) int {
+	targets, err := paclient.ListTargets()
+	if err != nil {
+		panic(err)
+	}
+	applications := make([]string, 0)
+	roles := make([]string, 0)
+	for _, target := range targets {
+		if target.TargetType != PlaybackStream {
+			continue
+		}
+		if name, ok := target.Properties["application.name"]; ok && !containsString(applications, name) {
+			applications = append(applications, name)
+		}
+		if role, ok := target.Properties["media.role"]; ok && !containsString(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	problems := 0
+	check := func(what string, property string, value string, values []string) {
+		if value == "" || containsString(values, value) {
+			return
+		}
+
+		problems++
+		msg := fmt.Sprintf("%s: no playback stream has the %s [%s]", what, property, value)
+		if suggestions := closestNames(value, values, 3); len(suggestions) > 0 {
+			msg += fmt.Sprintf(", did you mean [%s]?", strings.Join(suggestions, "], ["))
+		}
+		fmt.Println(msg)
+	}
+
+	for i, rule := range rules {
+		for _, list := range []struct {
+			key     string
+			matches []StreamMatch
+		}{{"While", rule.While}, {"Duck", rule.Duck}} {
+			for j, match := range list.matches {
+				what := fmt.Sprintf("Ducking rule %d, %s %d", i+1, list.key, j+1)
+				check(what, "Application", match.Application, applications)
+				check(what, "Role", match.Role, roles)
+			}
+		}
+	}
+	return problems
+}
+
+func runListTargets(args []string) {
+	fs := newFlagSet("list-targets")
+	asJSON := fs.Bool("json", false, "print the targets as JSON")
+	targetType := fs.String("type", "", "only list targets of this type (Sink, Source, PlaybackStream or RecordStream)")
+	fs.Parse(args)
+
+	_, paclient := connectPulseAudio()
+
+	targets, err := paclient.ListTargets()
+	if err != nil {
+		panic(err)
+	}
+
+	if *targetType != "" {
+		filtered := make([]Target, 0)
+		for _, target := range targets {
+			if string(target.TargetType) == *targetType {
+				filtered = append(filtered, target)
+			}
+		}
+		targets = filtered
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(targets); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TargetType\tTargetName\tVolume\tMute\tProperties")
+	for _, target := range targets {
+		props := make([]string, 0, len(targetProperties))
+		for _, key := range targetProperties {
+			if value, ok := target.Properties[key]; ok {
+				props = append(props, fmt.Sprintf("%s=%q", key, value))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.0f%%\t%t\t%s\n", target.TargetType, target.TargetName, target.Volume*100, target.Mute, strings.Join(props, " "))
+	}
+	w.Flush()
+}
+
+// targetFlags adds the flags used to select the target of a one-shot command.
+func targetFlags(fs *flag.FlagSet, defaultType PulseAudioTargetType) (*string, *string) {
+	targetType := fs.String("type", string(defaultType), "type of the target (Sink, Source, PlaybackStream or RecordStream)")
+	targetName := fs.String("name", "", "name of the target, as shown by list-targets")
+	return targetType, targetName
+}
+
+// targetAction builds the action a one-shot command applies, exiting if the
+// target flags aren't valid.
+func targetAction(fs *flag.FlagSet, targetType, targetName string, actionType PulseAudioActionType) PulseAudioAction {
+	action := PulseAudioAction{
+		TargetType: PulseAudioTargetType(targetType),
+		TargetName: targetName,
+		ActionType: actionType,
+	}
+
+	if !action.TargetType.Valid() {
+		fmt.Fprintf(os.Stderr, "Invalid target type %q\n", targetType)
+		os.Exit(2)
+	}
+
+	if action.TargetName == "" {
+		fmt.Fprintln(os.Stderr, "A target name must be given with -name")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return action
+}
+
+func runSetVolume(args []string) {
+	fs := newFlagSet("set-volume")
+	targetType, targetName := targetFlags(fs, Sink)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pamidicontrol set-volume -type <type> -name <name> <percent>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	action := targetAction(fs, *targetType, *targetName, VolumeChange)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(fs.Arg(0), "%"), 32)
+	if err != nil || percent < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid volume %q\n", fs.Arg(0))
+		os.Exit(2)
+	}
+
+	_, paclient := connectPulseAudio()
+	if err := paclient.ProcessVolumeAction(action, float32(percent/100)); err != nil {
+		panic(err)
+	}
+}
+
+func runMute(args []string) {
+	fs := newFlagSet("mute")
+	targetType, targetName := targetFlags(fs, Sink)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pamidicontrol mute -type <type> -name <name> [on|off|toggle]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	action := targetAction(fs, *targetType, *targetName, Mute)
+
+	state := "on"
+	if fs.NArg() > 0 {
+		state = fs.Arg(0)
+	}
+
+	_, paclient := connectPulseAudio()
+
+	var err error
+	switch state {
+	case "on":
+		err = paclient.ProcessMuteAction(action, true)
+	case "off":
+		err = paclient.ProcessMuteAction(action, false)
+	case "toggle":
+		_, err = paclient.ToggleMuteAction(action)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func runMove(args []string) {
+	fs := newFlagSet("move")
+	targetType, targetName := targetFlags(fs, PlaybackStream)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pamidicontrol move -type <type> -name <name> <sink or source name>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	action := targetAction(fs, *targetType, *targetName, Move)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	action.DeviceName = fs.Arg(0)
+
+	_, paclient := connectPulseAudio()
+	if err := paclient.ProcessMoveAction(action); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func runPresets(args []string) {
+	fs := newFlagSet("presets")
+	fs.Parse(args)
+
+	for _, preset := range Presets {
+		fmt.Printf("%s (ports named like %q)\n", preset.Name, strings.Join(preset.PortNames, `", "`))
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, control := range preset.Controls {
+			led := ""
+			if control.Feedback != nil {
+				led = "LED"
+			}
+			fmt.Fprintf(w, "  %s\t%s\tChannel %d\tController %d\t%s\n", control.Name, control.ActionType, control.Channel, control.Controller, led)
+		}
+		w.Flush()
+		fmt.Println()
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func runScene(args []string) {
+	fs := newFlagSet("scene")
+	configPath := configFlag(fs)
+	fade := fs.Duration("fade", 0, "how long the volumes take to fade to a recalled scene")
+	curve := fs.String("curve", "", "the shape of the fade, Linear or Smooth (default Linear)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: pamidicontrol scene [flags] save|recall|delete <name>")
+		fmt.Fprintln(fs.Output(), "       pamidicontrol scene [flags] list")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || (fs.Arg(0) != "list" && fs.NArg() < 2) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := mustLoadConfig(*configPath)
+	path := c.ScenesPath()
+	scenes, err := LoadScenes(path)
+	if err != nil {
+		panic(err)
+	}
+	name := fs.Arg(1)
+
+	switch fs.Arg(0) {
+	case "list":
+		for _, name := range SceneNames(scenes) {
+			fmt.Printf("%s\t%d target(s)\n", name, len(scenes[name].Targets))
+		}
+
+	case "save":
+		_, paclient := connectPulseAudio()
+		scene, err := paclient.CaptureScene()
+		if err != nil {
+			panic(err)
+		}
+		scenes[name] = scene
+		if err := SaveScenes(path, scenes); err != nil {
+			panic(err)
+		}
+		fmt.Printf("Saved scene %s with %d target(s) to %s\n", name, len(scene.Targets), path)
+
+	case "recall":
+		scene, ok := scenes[name]
+		if !ok {
+			msg := fmt.Sprintf("There is no scene named [%s]", name)
+			if suggestions := closestNames(name, SceneNames(scenes), 3); len(suggestions) > 0 {
+				msg += fmt.Sprintf(", did you mean [%s]?", strings.Join(suggestions, "], ["))
+			}
+			fmt.Fprintln(os.Stderr, msg)
+			os.Exit(1)
+		}
+		if !RampCurve(*curve).Valid() {
+			fmt.Fprintf(os.Stderr, "Invalid curve [%s], must be Linear or Smooth\n", *curve)
+			os.Exit(2)
+		}
+		_, paclient := connectPulseAudio()
+		if err := paclient.RecallScene(scene, *fade, RampCurve(*curve)); err != nil {
+			panic(err)
+		}
+
+	case "delete":
+		if _, ok := scenes[name]; !ok {
+			fmt.Fprintf(os.Stderr, "There is no scene named [%s]\n", name)
+			os.Exit(1)
+		}
+		delete(scenes, name)
+		if err := SaveScenes(path, scenes); err != nil {
+			panic(err)
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
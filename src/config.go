@@ -0,0 +1,1299 @@
+package pamidicontrol
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError describes a single problem found while validating the
+// configuration file.
+type ConfigError struct {
+	Line    int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// ConfigErrors is the list of problems found in a configuration file.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// unique drops the errors that are repeated, such as those of every mapping
+// expanded from the same template.
+func (e ConfigErrors) unique() ConfigErrors {
+	seen := make(map[ConfigError]bool, 0)
+	errs := make(ConfigErrors, 0, len(e))
+	for _, err := range e {
+		if !seen[err] {
+			seen[err] = true
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// LoadConfig reads, validates and decodes the configuration file. If path is
+// empty the file is looked up in $HOME/.config/pamidicontrol.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+
+	if path != "" {
+		viper.SetConfigFile(path)
+	} else {
+		viper.SetConfigName("config")
+		viper.SetConfigType("yaml")
+		viper.AddConfigPath("$HOME/.config/pamidicontrol")
+	}
+
+	if err := viper.ReadInConfig(); err != nil {
+		return c, err
+	}
+
+	data, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return c, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return c, err
+	}
+
+	if errs := checkKeys(&root, reflect.TypeOf(c)); len(errs) > 0 {
+		return c, errs
+	}
+
+	if err := viper.Unmarshal(&c); err != nil {
+		return c, err
+	}
+
+	if errs := resolveControls(&root, &c); len(errs) > 0 {
+		return c, errs.unique()
+	}
+
+	if errs := validateConfig(&root, c); len(errs) > 0 {
+		return c, errs.unique()
+	}
+
+	return c, nil
+}
+
+// DefaultConfigPath returns where the configuration file is looked up when no
+// path is given.
+func DefaultConfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".config", "pamidicontrol", "config.yaml")
+}
+
+// ConfigFileUsed returns the path of the configuration file that was last
+// loaded.
+func ConfigFileUsed() string {
+	return viper.ConfigFileUsed()
+}
+
+// mappingValue returns the value node stored under key in a mapping node.
+// Keys are compared case insensitively, the same way viper does.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// lineOf returns the line of the value stored under key, falling back to the
+// line of the node itself when the key isn't set.
+func lineOf(node *yaml.Node, key string) int {
+	if value := mappingValue(node, key); value != nil {
+		return value.Line
+	}
+	return node.Line
+}
+
+// checkKeys walks the yaml document alongside the Go type it will be decoded
+// into, reporting keys that don't belong to the type and scalars of the wrong
+// kind.
+func checkKeys(node *yaml.Node, t reflect.Type) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	if node.Kind == yaml.DocumentNode {
+		for _, child := range node.Content {
+			errs = append(errs, checkKeys(child, t)...)
+		}
+		return errs
+	}
+
+	if node.Kind == yaml.AliasNode {
+		return checkKeys(node.Alias, t)
+	}
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return append(errs, ConfigError{node.Line, fmt.Sprintf("expected a mapping for %s", t.Name())})
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			field, ok := fieldByKey(t, key.Value)
+			if !ok {
+				errs = append(errs, ConfigError{key.Line, fmt.Sprintf("unknown key %q in %s", key.Value, t.Name())})
+				continue
+			}
+			errs = append(errs, checkKeys(value, field.Type)...)
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return append(errs, ConfigError{node.Line, "expected a list"})
+		}
+
+		for _, child := range node.Content {
+			errs = append(errs, checkKeys(child, t.Elem())...)
+		}
+
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return append(errs, ConfigError{node.Line, "expected a mapping"})
+		}
+
+		for i := 1; i < len(node.Content); i += 2 {
+			errs = append(errs, checkKeys(node.Content[i], t.Elem())...)
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if node.Kind != yaml.ScalarNode {
+			return append(errs, ConfigError{node.Line, "expected a number"})
+		}
+		if _, err := strconv.ParseUint(node.Value, 0, t.Bits()); err != nil {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%q is not a valid unsigned number", node.Value)})
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if node.Kind != yaml.ScalarNode {
+			return append(errs, ConfigError{node.Line, "expected a number"})
+		}
+		if t.PkgPath() == "time" && t.Name() == "Duration" {
+			break
+		}
+		if _, err := strconv.ParseInt(node.Value, 0, t.Bits()); err != nil {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%q is not a valid number", node.Value)})
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if node.Kind != yaml.ScalarNode {
+			return append(errs, ConfigError{node.Line, "expected a number"})
+		}
+		if _, err := strconv.ParseFloat(node.Value, t.Bits()); err != nil {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%q is not a valid number", node.Value)})
+		}
+
+	case reflect.Bool:
+		if node.Kind != yaml.ScalarNode {
+			return append(errs, ConfigError{node.Line, "expected true or false"})
+		}
+		if _, err := strconv.ParseBool(node.Value); err != nil {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%q is not true or false", node.Value)})
+		}
+
+	case reflect.String:
+		if node.Kind != yaml.ScalarNode {
+			errs = append(errs, ConfigError{node.Line, "expected a string"})
+		}
+	}
+
+	return errs
+}
+
+// fieldByKey finds the struct field a configuration key decodes into.
+func fieldByKey(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			// Embedded structs are squashed into their parent.
+			if embedded, ok := fieldByKey(field.Type, key); ok {
+				return embedded, true
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := field.Name
+		if tag := strings.Split(field.Tag.Get("mapstructure"), ",")[0]; tag != "" {
+			name = tag
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// documentNode returns the top level mapping of a yaml document.
+func documentNode(root *yaml.Node) *yaml.Node {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		return root.Content[0]
+	}
+	return root
+}
+
+// listItemNode returns the node of the i'th item of a list, falling back to
+// parent if it can't be found.
+func listItemNode(list *yaml.Node, i int, parent *yaml.Node) *yaml.Node {
+	if list != nil && list.Kind == yaml.SequenceNode && i < len(list.Content) {
+		return list.Content[i]
+	}
+	return parent
+}
+
+// resolveControls fills in the midi settings of every action that names a
+// control of the controller preset, on every device.
+func resolveControls(root *yaml.Node, c *Config) ConfigErrors {
+	doc := documentNode(root)
+	errs := resolveDevice(doc, &c.Device)
+
+	devicesNode := mappingValue(doc, "Devices")
+	for i := range c.Devices {
+		errs = append(errs, resolveDevice(listItemNode(devicesNode, i, doc), &c.Devices[i])...)
+	}
+	return errs
+}
+
+// resolveDevice fills in the midi settings of the actions of a device that
+// name a control of its preset.
+func resolveDevice(doc *yaml.Node, c *Device) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	preset, ok := c.ControllerPreset()
+	if c.Preset != "" && !ok {
+		msg := fmt.Sprintf("unknown Preset %q", c.Preset)
+		if suggestions := closestNames(c.Preset, PresetNames(), 3); len(suggestions) > 0 {
+			msg += fmt.Sprintf(", did you mean %q?", suggestions[0])
+		}
+		return append(errs, ConfigError{lineOf(doc, "Preset"), msg})
+	}
+	noPreset := c.noPresetReason()
+
+	errs = append(errs, resolveMidiActions(mappingValue(doc, "MidiActions"), doc, c.MidiActions, preset, noPreset)...)
+	expanded, expandErrs := expandTemplates(mappingValue(doc, "Templates"), doc, c.Templates, preset, noPreset)
+	c.MidiActions = append(c.MidiActions, expanded...)
+	errs = append(errs, expandErrs...)
+
+	layersNode := mappingValue(doc, "Layers")
+	for i := range c.Layers {
+		layer := &c.Layers[i]
+		node := listItemNode(layersNode, i, doc)
+		errs = append(errs, resolveMidiActions(mappingValue(node, "MidiActions"), node, layer.MidiActions, preset, noPreset)...)
+		expanded, expandErrs := expandTemplates(mappingValue(node, "Templates"), node, layer.Templates, preset, noPreset)
+		layer.MidiActions = append(layer.MidiActions, expanded...)
+		errs = append(errs, expandErrs...)
+		errs = append(errs, resolveButton(mappingValue(node, "Button"), node, layer.Button, preset, noPreset)...)
+	}
+	errs = append(errs, resolveButton(mappingValue(doc, "BankLeft"), doc, c.BankLeft, preset, noPreset)...)
+	errs = append(errs, resolveButton(mappingValue(doc, "BankRight"), doc, c.BankRight, preset, noPreset)...)
+
+	if c.Setup != nil {
+		node := mappingValue(doc, "Setup")
+		switch {
+		case preset == nil:
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf(
+				"Setup can only be used with a Preset, and %s",
+				noPreset,
+			)})
+		case preset.setup == nil:
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("the %s preset can't set up the controller", preset.Name)})
+		default:
+			for _, name := range c.Setup.Toggle {
+				if _, ok := preset.Control(name); !ok {
+					errs = append(errs, ConfigError{lineOf(node, "Toggle"), unknownControl(preset, name).Error()})
+				}
+			}
+		}
+	}
+
+	if c.Matrix != nil && c.Matrix.Grid == nil {
+		node := mappingValue(doc, "Matrix")
+		switch {
+		case preset == nil:
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf(
+				"a Matrix needs a Grid, and %s",
+				noPreset,
+			)})
+		case preset.Grid == nil:
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("a Matrix needs a Grid, and the %s preset has none", preset.Name)})
+		default:
+			c.Matrix.Grid = preset.Grid
+		}
+	}
+
+	if c.Privacy != nil {
+		node := mappingValue(doc, "Privacy")
+		errs = append(errs, resolveButton(mappingValue(node, "Button"), node, c.Privacy.Button, preset, noPreset)...)
+
+		if c.Privacy.Indicator != nil {
+			errs = append(errs, resolveIndicator(mappingValue(node, "Indicator"), "Indicator", c.Privacy.Indicator, preset, noPreset)...)
+		}
+	}
+	if c.DoseIndicator != nil {
+		errs = append(errs, resolveIndicator(mappingValue(doc, "DoseIndicator"), "DoseIndicator", c.DoseIndicator, preset, noPreset)...)
+	}
+
+	metersNode := mappingValue(doc, "Meters")
+	for i := range c.Meters {
+		meter := &c.Meters[i]
+		if meter.Control == "" {
+			continue
+		}
+		node := listItemNode(metersNode, i, doc)
+
+		if preset == nil {
+			errs = append(errs, ConfigError{lineOf(node, "Control"), fmt.Sprintf(
+				"Control %q can only be used with a Preset, and %s",
+				meter.Control, noPreset,
+			)})
+			continue
+		}
+		control, ok := preset.Control(meter.Control)
+		if !ok {
+			errs = append(errs, ConfigError{lineOf(node, "Control"), unknownControl(preset, meter.Control).Error()})
+			continue
+		}
+		if control.Feedback == nil {
+			errs = append(errs, ConfigError{lineOf(node, "Control"), fmt.Sprintf("%s has no LEDs to show a meter on", control.Name)})
+			continue
+		}
+		meter.ActionType = control.Feedback.ActionType
+		meter.Channel = control.Feedback.Channel
+		meter.Controller = control.Feedback.Controller
+	}
+
+	if c.AutoAssign != nil && len(c.AutoAssign.VolumeControls) > 0 {
+		node := mappingValue(doc, "AutoAssign")
+		if preset == nil {
+			errs = append(errs, ConfigError{lineOf(node, "VolumeControls"), fmt.Sprintf(
+				"AutoAssign controls can only be used with a Preset, and %s",
+				noPreset,
+			)})
+		} else if err := c.AutoAssign.resolve(preset); err != nil {
+			errs = append(errs, ConfigError{lineOf(node, "VolumeControls"), err.Error()})
+		}
+	}
+
+	return errs
+}
+
+// resolveMidiActions fills in the midi settings of the actions in a list that
+// name a control of the preset.
+func resolveMidiActions(actionsNode *yaml.Node, fallback *yaml.Node, actions []MidiAction, preset *ControllerPreset, noPreset string) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	for i := range actions {
+		action := &actions[i]
+		if action.Control == "" {
+			continue
+		}
+		node := listItemNode(actionsNode, i, fallback)
+
+		if preset == nil {
+			errs = append(errs, ConfigError{lineOf(node, "Control"), fmt.Sprintf(
+				"Control %q can only be used with a Preset, and %s",
+				action.Control, noPreset,
+			)})
+			continue
+		}
+
+		control, ok := preset.Control(action.Control)
+		if !ok {
+			errs = append(errs, ConfigError{lineOf(node, "Control"), unknownControl(preset, action.Control).Error()})
+			continue
+		}
+
+		for _, key := range []string{"ActionType", "Channel", "Controller", "Relative"} {
+			if mappingValue(node, key) != nil {
+				errs = append(errs, ConfigError{lineOf(node, key), fmt.Sprintf("%s can't be set along with Control", key)})
+			}
+		}
+
+		action.ActionType = control.ActionType
+		action.Channel = control.Channel
+		action.Controller = control.Controller
+		action.Relative = control.Relative
+		if action.MaxInputValue == 0 {
+			action.MaxInputValue = control.MaxInputValue
+		}
+	}
+
+	return errs
+}
+
+// resolveButton fills in the midi settings of a button that names a control
+// of the preset.
+func resolveButton(node *yaml.Node, fallback *yaml.Node, button *Button, preset *ControllerPreset, noPreset string) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	if button == nil || button.Control == "" {
+		return errs
+	}
+	if node == nil {
+		node = fallback
+	}
+
+	if preset == nil {
+		return append(errs, ConfigError{lineOf(node, "Control"), fmt.Sprintf(
+			"Control %q can only be used with a Preset, and %s",
+			button.Control, noPreset,
+		)})
+	}
+
+	control, ok := preset.Control(button.Control)
+	if !ok {
+		return append(errs, ConfigError{lineOf(node, "Control"), unknownControl(preset, button.Control).Error()})
+	}
+
+	for _, key := range []string{"ActionType", "Channel", "Controller"} {
+		if mappingValue(node, key) != nil {
+			errs = append(errs, ConfigError{lineOf(node, key), fmt.Sprintf("%s can't be set along with Control", key)})
+		}
+	}
+
+	button.ActionType = control.ActionType
+	button.Channel = control.Channel
+	button.Controller = control.Controller
+	return errs
+}
+
+// resolveIndicator resolves a control that only lights an LED, read from node
+// under key, and checks that the preset can light it.
+func resolveIndicator(node *yaml.Node, key string, indicator *Button, preset *ControllerPreset, noPreset string) ConfigErrors {
+	errs := resolveButton(node, node, indicator, preset, noPreset)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	if preset == nil {
+		return append(errs, ConfigError{node.Line, fmt.Sprintf(
+			"the %s needs a Preset to light its LED, and %s",
+			key, noPreset,
+		)})
+	}
+	control, ok := preset.ControlAt(MidiAction{ActionType: indicator.ActionType, Channel: indicator.Channel, Controller: indicator.Controller})
+	if !ok || control.Feedback == nil {
+		errs = append(errs, ConfigError{node.Line, fmt.Sprintf("the %s has no LED on %s", preset.Name, indicator)})
+	}
+	return errs
+}
+
+// validateConfig checks the values of a decoded configuration, using the
+// yaml document to report the line each problem was found on.
+func validateConfig(root *yaml.Node, c Config) ConfigErrors {
+	doc := documentNode(root)
+	errs := make(ConfigErrors, 0)
+
+	type deviceNode struct {
+		node   *yaml.Node
+		device Device
+	}
+	devices := make([]deviceNode, 0, len(c.Devices)+1)
+	if c.Device.configured() || len(c.Devices) == 0 {
+		devices = append(devices, deviceNode{doc, c.Device})
+	}
+	devicesNode := mappingValue(doc, "Devices")
+	for i, device := range c.Devices {
+		devices = append(devices, deviceNode{listItemNode(devicesNode, i, doc), device})
+	}
+
+	// Two devices can't read from the same midi input.
+	inputs := make(map[string]int, 0)
+	for _, d := range devices {
+		errs = append(errs, validateDevice(d.node, d.device)...)
+
+		// Only exact names can be compared, patterns can overlap on
+		// purpose and be told apart by their Index.
+		if d.device.InputMidiName == "" || d.device.InputPort != nil {
+			continue
+		}
+		if line, ok := inputs[d.device.InputMidiName]; ok {
+			errs = append(errs, ConfigError{lineOf(d.node, "InputMidiName"), fmt.Sprintf(
+				"InputMidiName [%s] is already used by the device on line %d", d.device.InputMidiName, line,
+			)})
+		} else {
+			inputs[d.device.InputMidiName] = lineOf(d.node, "InputMidiName")
+		}
+	}
+
+	errs = append(errs, validateDucking(doc, c.Ducking)...)
+
+	if c.Safety != nil {
+		errs = append(errs, validateSafety(mappingValue(doc, "Safety"), *c.Safety)...)
+	}
+	if c.Safety == nil || !c.Safety.tracksExposure() {
+		for _, d := range devices {
+			if d.device.DoseIndicator != nil {
+				errs = append(errs, ConfigError{lineOf(d.node, "DoseIndicator"), "the DoseIndicator needs a Safety sink with a FullScaleLevel"})
+			}
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+	return errs
+}
+
+// validateSafety checks the safety settings.
+func validateSafety(node *yaml.Node, safety Safety) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	if len(safety.Sinks) == 0 {
+		errs = append(errs, ConfigError{lineOf(node, "Sinks"), "Sinks must list at least one sink"})
+	}
+
+	seen := make(map[string]int, 0)
+	sinksNode := mappingValue(node, "Sinks")
+	for i, sink := range safety.Sinks {
+		sinkNode := listItemNode(sinksNode, i, node)
+
+		if sink.Sink == "" {
+			errs = append(errs, ConfigError{lineOf(sinkNode, "Sink"), "Sink must be set"})
+		} else if line, ok := seen[sink.Sink]; ok {
+			errs = append(errs, ConfigError{lineOf(sinkNode, "Sink"), fmt.Sprintf("Sink [%s] already has safety settings on line %d", sink.Sink, line)})
+		} else {
+			seen[sink.Sink] = lineOf(sinkNode, "Sink")
+		}
+
+		if sink.MaxVolume != nil && (*sink.MaxVolume < 0 || *sink.MaxVolume > 1) {
+			errs = append(errs, ConfigError{lineOf(sinkNode, "MaxVolume"), fmt.Sprintf("MaxVolume %g is out of range, must be between 0 and 1", *sink.MaxVolume)})
+		}
+		if sink.MaxRise < 0 {
+			errs = append(errs, ConfigError{lineOf(sinkNode, "MaxRise"), "MaxRise can't be negative"})
+		}
+		if sink.FullScaleLevel < 0 {
+			errs = append(errs, ConfigError{lineOf(sinkNode, "FullScaleLevel"), "FullScaleLevel can't be negative"})
+		}
+	}
+
+	if safety.DailyDose < 0 {
+		errs = append(errs, ConfigError{lineOf(node, "DailyDose"), "DailyDose can't be negative"})
+	}
+	if safety.ReduceTo != nil && (*safety.ReduceTo < 0 || *safety.ReduceTo > 1) {
+		errs = append(errs, ConfigError{lineOf(node, "ReduceTo"), fmt.Sprintf("ReduceTo %g is out of range, must be between 0 and 1", *safety.ReduceTo)})
+	}
+	if safety.ReduceOver < 0 {
+		errs = append(errs, ConfigError{lineOf(node, "ReduceOver"), "ReduceOver can't be negative"})
+	}
+
+	if !safety.tracksExposure() {
+		for _, key := range []string{"DailyDose", "Notify", "ReduceTo", "ReduceOver"} {
+			if mappingValue(node, key) != nil {
+				errs = append(errs, ConfigError{lineOf(node, key), fmt.Sprintf("%s needs a sink with a FullScaleLevel to count the listening exposure", key)})
+			}
+		}
+	}
+	return errs
+}
+
+// validateDucking checks the ducking rules.
+func validateDucking(doc *yaml.Node, rules []DuckingRule) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	rulesNode := mappingValue(doc, "Ducking")
+	for i, rule := range rules {
+		node := listItemNode(rulesNode, i, doc)
+
+		for _, list := range []struct {
+			key     string
+			matches []StreamMatch
+		}{{"While", rule.While}, {"Duck", rule.Duck}} {
+			if len(list.matches) == 0 {
+				errs = append(errs, ConfigError{lineOf(node, list.key), fmt.Sprintf("%s must list at least one stream", list.key)})
+			}
+			for _, m := range list.matches {
+				if m.Application == "" && m.Role == "" {
+					errs = append(errs, ConfigError{lineOf(node, list.key), fmt.Sprintf("every stream in %s needs an Application or a Role", list.key)})
+				}
+			}
+		}
+
+		switch {
+		case rule.Level != nil && rule.Amount != 0:
+			errs = append(errs, ConfigError{lineOf(node, "Level"), "Level can't be set along with Amount"})
+		case rule.Level != nil && (*rule.Level < 0 || *rule.Level > 1):
+			errs = append(errs, ConfigError{lineOf(node, "Level"), fmt.Sprintf("Level %g is out of range, must be between 0 and 1", *rule.Level)})
+		case rule.Level == nil && (rule.Amount <= 0 || rule.Amount > 1):
+			errs = append(errs, ConfigError{lineOf(node, "Amount"), "Amount must be set to more than 0 and at most 1, or Level to a volume"})
+		}
+
+		if rule.Fade < 0 {
+			errs = append(errs, ConfigError{lineOf(node, "Fade"), "Fade can't be negative"})
+		}
+	}
+	return errs
+}
+
+// validateDevice checks the settings and mappings of a single device.
+func validateDevice(doc *yaml.Node, c Device) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	errs = append(errs, validatePortMatch(doc, "InputPort", "InputMidiName", c.InputPort)...)
+	errs = append(errs, validatePortMatch(doc, "OutputPort", "OutputMidiName", c.OutputPort)...)
+
+	if !c.Protocol.Valid() {
+		errs = append(errs, ConfigError{lineOf(doc, "Protocol"), fmt.Sprintf("invalid Protocol %q", c.Protocol)})
+	}
+
+	stripsNode := mappingValue(doc, "Strips")
+	if len(c.Strips) > 0 && c.Protocol == NoProtocol {
+		errs = append(errs, ConfigError{lineOf(doc, "Strips"), "Strips can only be used with a Protocol"})
+	}
+	if c.Protocol == MackieControl && len(c.Strips) > mcuStrips {
+		errs = append(errs, ConfigError{lineOf(doc, "Strips"), fmt.Sprintf("a Mackie Control surface only has %d strips", mcuStrips)})
+	}
+	for i, strip := range c.Strips {
+		node := listItemNode(stripsNode, i, doc)
+		if !strip.TargetType.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "TargetType"), fmt.Sprintf("invalid TargetType %q", strip.TargetType)})
+		}
+		if strip.TargetName == "" {
+			errs = append(errs, ConfigError{lineOf(node, "TargetName"), "TargetName must be set"})
+		}
+	}
+
+	// reserved holds the controls that are taken by the strips, described
+	// for the error if a MidiAction uses one as well.
+	reserved := make(map[bindingKey]string, 0)
+	if c.Protocol == MackieControl {
+		strips := len(c.Strips)
+		if c.AutoAssign != nil {
+			strips = mcuStrips
+		}
+		for key, control := range mcuBindings(strips) {
+			reserved[key] = fmt.Sprintf("%s of the %s strips", control, c.Protocol)
+		}
+	}
+
+	if c.Matrix != nil {
+		node := mappingValue(doc, "Matrix")
+
+		if c.Matrix.Streams != PlaybackStream && c.Matrix.Streams != RecordStream {
+			errs = append(errs, ConfigError{lineOf(node, "Streams"), fmt.Sprintf("Streams must be PlaybackStream or RecordStream, not %q", c.Matrix.Streams)})
+		}
+
+		if grid := c.Matrix.Grid; grid != nil {
+			gridNode := mappingValue(node, "Grid")
+			if gridNode == nil {
+				gridNode = node
+			}
+
+			if grid.ActionType != Note && grid.ActionType != ControlChange {
+				errs = append(errs, ConfigError{lineOf(gridNode, "ActionType"), fmt.Sprintf("the pads of a Grid must send a Note or ControlChange, not %q", grid.ActionType)})
+			}
+			if grid.Channel > 15 {
+				errs = append(errs, ConfigError{lineOf(gridNode, "Channel"), fmt.Sprintf("Channel %d is out of range, must be between 0 and 15", grid.Channel)})
+			}
+			if len(grid.Pads) == 0 {
+				errs = append(errs, ConfigError{lineOf(gridNode, "Pads"), "Pads must be set"})
+			}
+			if len(c.Matrix.Rows) > len(grid.Pads) {
+				errs = append(errs, ConfigError{lineOf(node, "Rows"), fmt.Sprintf("there are %d Rows for %d rows of pads", len(c.Matrix.Rows), len(grid.Pads))})
+			}
+			if len(c.Matrix.Columns) > grid.columns() {
+				errs = append(errs, ConfigError{lineOf(node, "Columns"), fmt.Sprintf("there are %d Columns for %d columns of pads", len(c.Matrix.Columns), grid.columns())})
+			}
+
+			for key, pad := range matrixBindings(*grid) {
+				reserved[key] = fmt.Sprintf("%s of the Matrix", pad)
+			}
+		}
+	}
+
+	metersNode := mappingValue(doc, "Meters")
+	for i, meter := range c.Meters {
+		node := listItemNode(metersNode, i, doc)
+
+		if !meter.TargetType.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "TargetType"), fmt.Sprintf("invalid TargetType %q", meter.TargetType)})
+		}
+		if meter.TargetName == "" {
+			errs = append(errs, ConfigError{lineOf(node, "TargetName"), "TargetName must be set"})
+		}
+
+		if meter.Strip > 0 {
+			if c.Protocol != MackieControl {
+				errs = append(errs, ConfigError{lineOf(node, "Strip"), "a Strip meter needs a Mackie Control surface"})
+			}
+			if meter.Strip > mcuStrips {
+				errs = append(errs, ConfigError{lineOf(node, "Strip"), fmt.Sprintf("Strip %d is out of range, must be between 1 and %d", meter.Strip, mcuStrips)})
+			}
+			if len(meter.Pads) > 0 {
+				errs = append(errs, ConfigError{lineOf(node, "Pads"), "Pads can't be set along with Strip"})
+			}
+		} else {
+			if meter.ActionType != Note && meter.ActionType != ControlChange {
+				errs = append(errs, ConfigError{lineOf(node, "ActionType"), fmt.Sprintf("a meter must send a Note or ControlChange, not %q", meter.ActionType)})
+			}
+			if meter.Channel > 15 {
+				errs = append(errs, ConfigError{lineOf(node, "Channel"), fmt.Sprintf("Channel %d is out of range, must be between 0 and 15", meter.Channel)})
+			}
+		}
+
+		if meter.Range < 0 {
+			errs = append(errs, ConfigError{lineOf(node, "Range"), "Range can't be negative"})
+		}
+		if meter.Decay < 0 {
+			errs = append(errs, ConfigError{lineOf(node, "Decay"), "Decay can't be negative"})
+		}
+		if meter.Rate > maxMeterRate {
+			errs = append(errs, ConfigError{lineOf(node, "Rate"), fmt.Sprintf("Rate can be at most %d updates a second", maxMeterRate)})
+		}
+	}
+
+	if c.AutoAssign != nil {
+		node := mappingValue(doc, "AutoAssign")
+
+		if c.Protocol == NoProtocol && len(c.AutoAssign.VolumeControls) == 0 {
+			errs = append(errs, ConfigError{lineOf(node, "VolumeControls"), "VolumeControls must be set"})
+		}
+		if c.Protocol == MackieControl && len(c.AutoAssign.VolumeControls)+len(c.AutoAssign.MuteControls) > 0 {
+			errs = append(errs, ConfigError{lineOf(node, "VolumeControls"), "a Mackie Control surface assigns its own strips, without VolumeControls or MuteControls"})
+		}
+		if len(c.AutoAssign.MuteControls) > len(c.AutoAssign.VolumeControls) {
+			errs = append(errs, ConfigError{lineOf(node, "MuteControls"), "there are more MuteControls than VolumeControls"})
+		}
+		if !c.AutoAssign.Order.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "Order"), fmt.Sprintf("invalid Order %q", c.AutoAssign.Order)})
+		}
+		if !c.AutoAssign.Pickup.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "Pickup"), fmt.Sprintf("invalid Pickup mode %q", c.AutoAssign.Pickup)})
+		}
+
+		for _, strip := range c.AutoAssign.pool {
+			if c.AutoAssign.Pickup != NoPickup && strip.volume.Relative != Absolute {
+				errs = append(errs, ConfigError{lineOf(node, "Pickup"), fmt.Sprintf("Pickup can't be used with the relative %s", strip.volume)})
+			}
+			reserved[strip.volume.bindingKey()] = fmt.Sprintf("the AutoAssign strips as %s", strip.volume)
+			if strip.mute != nil {
+				reserved[strip.mute.bindingKey()] = fmt.Sprintf("the AutoAssign strips as %s", strip.mute)
+			}
+		}
+	}
+
+	layersNode := mappingValue(doc, "Layers")
+	layerNames := make(map[string]int, 0)
+	for i, layer := range c.Layers {
+		node := listItemNode(layersNode, i, doc)
+
+		if layer.Name == "" {
+			errs = append(errs, ConfigError{lineOf(node, "Name"), "Name must be set"})
+		} else if line, ok := layerNames[strings.ToLower(layer.Name)]; ok {
+			errs = append(errs, ConfigError{lineOf(node, "Name"), fmt.Sprintf("there is already a layer named %q on line %d", layer.Name, line)})
+		} else {
+			layerNames[strings.ToLower(layer.Name)] = lineOf(node, "Name")
+		}
+
+		if layer.Shift && layer.Button == nil {
+			errs = append(errs, ConfigError{lineOf(node, "Shift"), "a Shift layer needs a Button to hold"})
+		}
+	}
+
+	// The layer buttons take their controls away from the MidiActions.
+	type namedButton struct {
+		name   string
+		node   *yaml.Node
+		button *Button
+	}
+	buttons := make([]namedButton, 0)
+	for i, layer := range c.Layers {
+		node := listItemNode(layersNode, i, doc)
+		buttons = append(buttons, namedButton{fmt.Sprintf("the Button of layer %s", layer.Name), mappingValue(node, "Button"), layer.Button})
+	}
+	buttons = append(buttons,
+		namedButton{"BankLeft", mappingValue(doc, "BankLeft"), c.BankLeft},
+		namedButton{"BankRight", mappingValue(doc, "BankRight"), c.BankRight},
+	)
+	if c.Privacy != nil {
+		node := mappingValue(doc, "Privacy")
+		buttons = append(buttons, namedButton{"the privacy Button", mappingValue(node, "Button"), c.Privacy.Button})
+
+		if c.Privacy.Indicator != nil {
+			indicatorNode := mappingValue(node, "Indicator")
+			errs = append(errs, validateButton(indicatorNode, *c.Privacy.Indicator)...)
+		}
+	}
+	if c.DoseIndicator != nil {
+		errs = append(errs, validateButton(mappingValue(doc, "DoseIndicator"), *c.DoseIndicator)...)
+	}
+
+	if (c.BankLeft != nil || c.BankRight != nil) && len(c.Layers) == 0 {
+		errs = append(errs, ConfigError{lineOf(doc, "BankLeft"), "BankLeft and BankRight need Layers to switch between"})
+	}
+
+	for _, b := range buttons {
+		if b.button == nil {
+			continue
+		}
+		errs = append(errs, validateButton(b.node, *b.button)...)
+
+		key := b.button.bindingKey()
+		if control, ok := reserved[key]; ok {
+			errs = append(errs, ConfigError{b.node.Line, fmt.Sprintf("%s is used by %s", b.button, control)})
+		} else {
+			reserved[key] = b.name
+		}
+	}
+
+	errs = append(errs, validateMidiActions(mappingNodes(doc, c.MidiActions, c.Templates), c.MidiActions, reserved)...)
+
+	// A layer can map controls that are already mapped at the top level, and
+	// its mappings are used instead while the layer is active.
+	for i, layer := range c.Layers {
+		node := listItemNode(layersNode, i, doc)
+		errs = append(errs, validateMidiActions(mappingNodes(node, layer.MidiActions, layer.Templates), layer.MidiActions, reserved)...)
+	}
+
+	return errs
+}
+
+// validateMidiActions checks a list of actions, read from nodes. reserved
+// holds the controls that can't be mapped, described for the error.
+func validateMidiActions(nodes []*yaml.Node, actions []MidiAction, reserved map[bindingKey]string) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	// bindings holds the line of each mapping of a control by its action.
+	bindings := make(map[bindingKey]map[PulseAudioAction]int, 0)
+
+	for i, action := range actions {
+		node := nodes[i]
+
+		if !action.ActionType.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "ActionType"), fmt.Sprintf("invalid ActionType %q", action.ActionType)})
+		}
+
+		if action.Channel > 15 {
+			errs = append(errs, ConfigError{lineOf(node, "Channel"), fmt.Sprintf("Channel %d is out of range, must be between 0 and 15", action.Channel)})
+		}
+
+		if action.MaxInputValue == 0 && action.ActionType != ProgramChange {
+			errs = append(errs, ConfigError{lineOf(node, "MaxInputValue"), "MaxInputValue must be greater than zero"})
+		} else if action.Relative == Absolute && action.ActionType.Valid() && action.MaxInputValue > action.ActionType.MaxValue() {
+			errs = append(errs, ConfigError{lineOf(node, "MaxInputValue"), fmt.Sprintf(
+				"MaxInputValue %d is larger than a %s can send (%d)",
+				action.MaxInputValue, action.ActionType, action.ActionType.MaxValue(),
+			)})
+		}
+
+		if !action.Relative.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "Relative"), fmt.Sprintf("invalid Relative encoding %q", action.Relative)})
+		} else if action.Relative != Absolute && action.ActionType != ControlChange {
+			errs = append(errs, ConfigError{lineOf(node, "Relative"), "only ControlChange controls can be relative"})
+		}
+
+		actionNode := mappingValue(node, "Action")
+		if actionNode == nil {
+			actionNode = node
+		}
+
+		if !action.Action.ActionType.Valid() {
+			errs = append(errs, ConfigError{lineOf(actionNode, "ActionType"), fmt.Sprintf("invalid ActionType %q", action.Action.ActionType)})
+		}
+
+		if action.Action.ActionType == RecallScene {
+			if action.Action.Scene == "" {
+				errs = append(errs, ConfigError{lineOf(actionNode, "Scene"), "Scene must be set for a RecallScene action"})
+			}
+			if action.Action.Fade < 0 {
+				errs = append(errs, ConfigError{lineOf(actionNode, "Fade"), "Fade can't be negative"})
+			}
+		} else if action.Action.ActionType == Crossfade {
+			errs = append(errs, validateCrossfade(actionNode, action)...)
+		} else {
+			if !action.Action.TargetType.Valid() {
+				errs = append(errs, ConfigError{lineOf(actionNode, "TargetType"), fmt.Sprintf("invalid TargetType %q", action.Action.TargetType)})
+			}
+			if action.Action.TargetName == "" {
+				errs = append(errs, ConfigError{lineOf(actionNode, "TargetName"), "TargetName must be set"})
+			}
+		}
+
+		if action.Action.ActionType == Move {
+			if action.Action.TargetType != PlaybackStream && action.Action.TargetType != RecordStream {
+				errs = append(errs, ConfigError{lineOf(actionNode, "TargetType"), "only PlaybackStream and RecordStream targets can be moved"})
+			}
+			if action.Action.DeviceName == "" {
+				errs = append(errs, ConfigError{lineOf(actionNode, "DeviceName"), "DeviceName must be set for a Move action"})
+			}
+		}
+
+		if action.ActionType == ProgramChange && (action.Action.ActionType == VolumeChange || action.Action.ActionType == Crossfade) {
+			// A program change has no position to set a volume from.
+			errs = append(errs, ConfigError{lineOf(actionNode, "ActionType"), fmt.Sprintf("a ProgramChange can't be used for a %s action", action.Action.ActionType)})
+		}
+
+		if action.Action.Ramp < 0 {
+			errs = append(errs, ConfigError{lineOf(actionNode, "Ramp"), "Ramp can't be negative"})
+		} else if action.Action.Ramp > 0 && action.Action.ActionType != VolumeChange && action.Action.ActionType != Mute && action.Action.ActionType != Crossfade {
+			errs = append(errs, ConfigError{lineOf(actionNode, "Ramp"), "Ramp can only be used with a VolumeChange, Mute or Crossfade action"})
+		}
+		if !action.Action.Curve.Valid() {
+			errs = append(errs, ConfigError{lineOf(actionNode, "Curve"), fmt.Sprintf("invalid Curve %q", action.Action.Curve)})
+		}
+		if action.Action.SlewRate < 0 {
+			errs = append(errs, ConfigError{lineOf(actionNode, "SlewRate"), "SlewRate can't be negative"})
+		} else if action.Action.SlewRate > 0 && action.Action.ActionType != VolumeChange && action.Action.ActionType != Crossfade {
+			errs = append(errs, ConfigError{lineOf(actionNode, "SlewRate"), "SlewRate can only be used with a VolumeChange or Crossfade action"})
+		}
+
+		if !action.Pickup.Valid() {
+			errs = append(errs, ConfigError{lineOf(node, "Pickup"), fmt.Sprintf("invalid Pickup mode %q", action.Pickup)})
+		} else if action.Pickup != NoPickup && (action.Relative != Absolute || action.Action.ActionType != VolumeChange) {
+			errs = append(errs, ConfigError{lineOf(node, "Pickup"), "Pickup can only be used for absolute controls with a VolumeChange action"})
+		}
+
+		if action.Controller > 127 {
+			errs = append(errs, ConfigError{lineOf(node, "Controller"), fmt.Sprintf("Controller %d is out of range, must be between 0 and 127", action.Controller)})
+		}
+
+		key := action.bindingKey()
+		if control, ok := reserved[key]; ok {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%s is used by %s", action, control)})
+		} else if line, ok := bindings[key][action.Action]; ok {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf(
+				"%s on Channel %d, Controller %d already has the same action on line %d",
+				action.ActionType, action.Channel, action.Controller, line,
+			)})
+		} else {
+			if bindings[key] == nil {
+				bindings[key] = make(map[PulseAudioAction]int, 0)
+			}
+			bindings[key][action.Action] = node.Line
+		}
+	}
+
+	return errs
+}
+
+// validatePortMatch checks the port match stored under key, which replaces the
+// port name stored under nameKey.
+func validatePortMatch(doc *yaml.Node, key string, nameKey string, match *PortMatch) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+	if match == nil {
+		return errs
+	}
+	node := mappingValue(doc, key)
+
+	if mappingValue(doc, nameKey) != nil {
+		errs = append(errs, ConfigError{lineOf(doc, nameKey), fmt.Sprintf("%s can't be set along with %s", nameKey, key)})
+	}
+	if match.Contains == "" && match.Pattern == "" && !match.usesUSB() {
+		errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%s needs Contains, Pattern or a USB id to match", key)})
+	}
+	if _, err := regexp.Compile(match.Pattern); err != nil {
+		errs = append(errs, ConfigError{lineOf(node, "Pattern"), fmt.Sprintf("invalid Pattern: %v", err)})
+	}
+	ids := map[string]string{"USBVendor": match.USBVendor, "USBProduct": match.USBProduct}
+	for idKey, id := range ids {
+		if _, ok := parseHexID(id); id != "" && !ok {
+			errs = append(errs, ConfigError{lineOf(node, idKey), fmt.Sprintf("%s %q is not a hexadecimal USB id, such as 0944", idKey, id)})
+		}
+	}
+	return errs
+}
+
+// validateCrossfade checks the sides and law of a Crossfade action, read from
+// node.
+func validateCrossfade(node *yaml.Node, action MidiAction) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	if action.Relative != Absolute {
+		errs = append(errs, ConfigError{lineOf(node, "ActionType"), "a Crossfade needs a fader or knob that sends its position, not a relative encoder"})
+	}
+	if !action.Action.Law.Valid() {
+		errs = append(errs, ConfigError{lineOf(node, "Law"), fmt.Sprintf("invalid Law %q", action.Action.Law)})
+	}
+
+	for _, side := range []struct {
+		key  string
+		side CrossfadeSide
+	}{{"A", action.Action.A}, {"B", action.Action.B}} {
+		sideNode := mappingValue(node, side.key)
+		if sideNode == nil {
+			errs = append(errs, ConfigError{node.Line, fmt.Sprintf("%s must be set for a Crossfade action", side.key)})
+			continue
+		}
+
+		if !side.side.TargetType.Valid() {
+			errs = append(errs, ConfigError{lineOf(sideNode, "TargetType"), fmt.Sprintf("invalid TargetType %q", side.side.TargetType)})
+		}
+		if side.side.TargetName == "" {
+			errs = append(errs, ConfigError{lineOf(sideNode, "TargetName"), "TargetName must be set"})
+		}
+		if mappingValue(sideNode, "MaxVolume") != nil && (side.side.MaxVolume <= 0 || side.side.MaxVolume > 1) {
+			errs = append(errs, ConfigError{lineOf(sideNode, "MaxVolume"), fmt.Sprintf("MaxVolume %g is out of range, must be more than 0 and at most 1", side.side.MaxVolume)})
+		}
+	}
+
+	if action.Action.A.TargetType == action.Action.B.TargetType && action.Action.A.TargetName == action.Action.B.TargetName && action.Action.A.TargetName != "" {
+		errs = append(errs, ConfigError{lineOf(node, "B"), "A and B of a Crossfade must be different targets"})
+	}
+	return errs
+}
+
+// validateButton checks the message of a button.
+func validateButton(node *yaml.Node, button Button) ConfigErrors {
+	errs := make(ConfigErrors, 0)
+
+	if button.ActionType != ControlChange && button.ActionType != Note {
+		errs = append(errs, ConfigError{lineOf(node, "ActionType"), fmt.Sprintf("invalid ActionType %q, a button must send a ControlChange or a Note", button.ActionType)})
+	}
+	if button.Channel > 15 {
+		errs = append(errs, ConfigError{lineOf(node, "Channel"), fmt.Sprintf("Channel %d is out of range, must be between 0 and 15", button.Channel)})
+	}
+	if button.Controller > 127 {
+		errs = append(errs, ConfigError{lineOf(node, "Controller"), fmt.Sprintf("Controller %d is out of range, must be between 0 and 127", button.Controller)})
+	}
+	return errs
+}
+
+// UpdateConfigFile loads the yaml document at path, lets update change it and
+// writes it back. The file is created if it doesn't exist yet. If the updated
+// file is no longer a valid configuration, the original is put back and the
+// validation errors are returned.
+func UpdateConfigFile(path string, update func(doc *yaml.Node) error) error {
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+
+	var root yaml.Node
+	if len(bytes.TrimSpace(original)) > 0 {
+		if err := yaml.Unmarshal(original, &root); err != nil {
+			return err
+		}
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	if err := update(root.Content[0]); err != nil {
+		return err
+	}
+	return writeConfigDocument(path, &root, original, exists)
+}
+
+// WriteConfigFile replaces the configuration file at path with doc, without
+// reading what was there before, so a file that no longer parses can be
+// replaced too. If doc isn't a valid configuration, the original is put back
+// and the validation errors are returned.
+func WriteConfigFile(path string, doc *yaml.Node) error {
+	original, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	root := yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{doc}}
+	return writeConfigDocument(path, &root, original, err == nil)
+}
+
+// writeConfigDocument writes root to path and checks that it loads, putting
+// back original, or removing the file if it didn't exist, when it doesn't.
+func writeConfigDocument(path string, root *yaml.Node, original []byte, exists bool) error {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if _, err := LoadConfig(path); err != nil {
+		if exists {
+			ioutil.WriteFile(path, original, 0644)
+		} else {
+			os.Remove(path)
+		}
+		return err
+	}
+	return nil
+}
+
+// AppendMidiActions adds actions to the end of the MidiActions list of a
+// device in the configuration file at path. device is the index of the device
+// in Devices, or -1 for the top level device.
+func AppendMidiActions(path string, device int, actions ...MidiAction) error {
+	return UpdateConfigFile(path, func(doc *yaml.Node) error {
+		if device >= 0 {
+			devicesNode := mappingValue(doc, "Devices")
+			if devicesNode == nil || devicesNode.Kind != yaml.SequenceNode || device >= len(devicesNode.Content) {
+				return fmt.Errorf("there is no device %d in Devices", device)
+			}
+			doc = devicesNode.Content[device]
+		}
+
+		list := mappingValue(doc, "MidiActions")
+		if list == nil || list.Kind != yaml.SequenceNode {
+			list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			setMappingValue(doc, "MidiActions", list)
+		}
+
+		// An empty list is usually written as [], switch it to the block
+		// style so the appended actions are readable.
+		list.Style = 0
+		for _, action := range actions {
+			list.Content = append(list.Content, encodeConfigValue(reflect.ValueOf(action)))
+		}
+		return nil
+	})
+}
+
+// setMappingValue stores value under key in a mapping node, replacing any
+// existing value for the key.
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if strings.EqualFold(node.Content[i].Value, key) {
+			node.Content[i+1] = value
+			return
+		}
+	}
+
+	node.Content = append(node.Content, stringNode(key), value)
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// alwaysWritten are the fields written out even when they hold their zero
+// value, because zero is a meaningful setting for them.
+var alwaysWritten = map[string]bool{
+	"Channel":    true,
+	"Controller": true,
+}
+
+// encodeConfigValue converts a configuration value into a yaml node, using the
+// Go field names as keys the same way the example configuration does. Fields
+// holding their zero value are left out.
+func encodeConfigValue(v reflect.Value) *yaml.Node {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		}
+		v = v.Elem()
+	}
+
+	if d, ok := v.Interface().(time.Duration); ok {
+		return stringNode(d.String())
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			value := v.Field(i)
+			if field.Anonymous && value.Kind() == reflect.Struct {
+				node.Content = append(node.Content, encodeConfigValue(value).Content...)
+				continue
+			}
+			if isZeroValue(value) && !writeZeroValue(v, field.Name) {
+				continue
+			}
+
+			node.Content = append(node.Content,
+				stringNode(field.Name),
+				encodeConfigValue(value),
+			)
+		}
+		return node
+
+	case reflect.Slice, reflect.Array:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for i := 0; i < v.Len(); i++ {
+			node.Content = append(node.Content, encodeConfigValue(v.Index(i)))
+		}
+		return node
+
+	case reflect.Map:
+		node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			node.Content = append(node.Content,
+				stringNode(fmt.Sprint(key.Interface())),
+				encodeConfigValue(v.MapIndex(key)),
+			)
+		}
+		return node
+	}
+
+	node := &yaml.Node{}
+	if err := node.Encode(v.Interface()); err != nil {
+		panic(err)
+	}
+	return node
+}
+
+// writeZeroValue reports whether a field should be written out even when it
+// holds its zero value.
+func writeZeroValue(v reflect.Value, field string) bool {
+	// The settings of a named control come from its preset.
+	if action, ok := v.Interface().(MidiAction); ok && action.Control != "" {
+		return false
+	}
+	return alwaysWritten[field]
+}
+
+func isZeroValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" && !isZeroValue(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return v.IsZero()
+}
@@ -0,0 +1,245 @@
+package pamidicontrol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadConfigString loads a configuration from its yaml text.
+func loadConfigString(t *testing.T, config string) (Config, error) {
+	dir, err := ioutil.TempDir("", "pamidicontrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadConfig(path)
+}
+
+const configHeader = `InputMidiName: "Generic MIDI"
+OutputMidiName: "Generic MIDI"
+MidiActions:
+`
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions string
+		// want is part of the error expected, or empty for a valid
+		// configuration.
+		want string
+	}{
+		{
+			name: "valid",
+			actions: `- ActionType: ControlChange
+  Channel: 0
+  Controller: 7
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: VolumeChange
+`,
+		},
+		{
+			name: "channel out of range",
+			actions: `- ActionType: ControlChange
+  Channel: 16
+  Controller: 7
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: VolumeChange
+`,
+			want: "line 5: Channel 16 is out of range, must be between 0 and 15",
+		},
+		{
+			name: "controller out of range",
+			actions: `- ActionType: ControlChange
+  Channel: 0
+  Controller: 128
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: VolumeChange
+`,
+			want: "line 6: Controller 128 is out of range, must be between 0 and 127",
+		},
+		{
+			name: "no MaxInputValue",
+			actions: `- ActionType: ControlChange
+  Channel: 0
+  Controller: 7
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: VolumeChange
+`,
+			want: "MaxInputValue must be greater than zero",
+		},
+		{
+			name: "invalid action type",
+			actions: `- ActionType: ControlChange
+  Channel: 0
+  Controller: 7
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: Volume
+`,
+			want: `line 11: invalid ActionType "Volume"`,
+		},
+		{
+			name: "missing target name",
+			actions: `- ActionType: ControlChange
+  Channel: 0
+  Controller: 7
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    ActionType: VolumeChange
+`,
+			want: "TargetName must be set",
+		},
+		{
+			name: "volume on a program change",
+			actions: `- ActionType: ProgramChange
+  Channel: 0
+  Controller: 3
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: VolumeChange
+`,
+			want: "a ProgramChange can't be used for a VolumeChange action",
+		},
+		{
+			name: "mute on a program change",
+			actions: `- ActionType: ProgramChange
+  Channel: 0
+  Controller: 3
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: Mute
+`,
+		},
+		{
+			name: "same action twice",
+			actions: `- ActionType: Note
+  Channel: 0
+  Controller: 32
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: Mute
+- ActionType: Note
+  Channel: 0
+  Controller: 32
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: Mute
+`,
+			want: "already has the same action on line 4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigString(t, configHeader+tt.actions)
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("LoadConfig() returned %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("LoadConfig() returned %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrorsSorted(t *testing.T) {
+	_, err := loadConfigString(t, configHeader+`- ActionType: ControlChange
+  Channel: 16
+  Controller: 128
+  MaxInputValue: 127
+  Action:
+    TargetType: Sink
+    TargetName: Speakers
+    ActionType: Volume
+`)
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("LoadConfig() returned %v, want ConfigErrors", err)
+	}
+	for i := 1; i < len(errs); i++ {
+		if errs[i].Line < errs[i-1].Line {
+			t.Errorf("errors aren't sorted by line: %v", errs)
+		}
+	}
+}
+
+func TestAppendMidiActionsToDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pamidicontrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	config := `Devices:
+- InputMidiName: "First"
+  OutputMidiName: "First"
+  MidiActions: []
+- InputMidiName: "Second"
+  OutputMidiName: "Second"
+  MidiActions: []
+`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	action := MidiAction{
+		ActionType:    ControlChange,
+		Controller:    7,
+		MaxInputValue: 127,
+		Action:        PulseAudioAction{TargetType: Sink, TargetName: "Speakers", ActionType: VolumeChange},
+	}
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, ok := learnDevice(c.AllDevices(), []string{"First", "Second"}, "Second")
+	if !ok || index != 1 {
+		t.Fatalf("learnDevice() = %d, %v, want 1, true", index, ok)
+	}
+	if err := AppendMidiActions(path, c.devicesIndex(index), action); err != nil {
+		t.Fatalf("AppendMidiActions() returned %v", err)
+	}
+
+	c, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.InputMidiName != "" || len(c.MidiActions) != 0 {
+		t.Errorf("the top level device was changed: %+v", c.Device)
+	}
+	if len(c.Devices[0].MidiActions) != 0 || len(c.Devices[1].MidiActions) != 1 {
+		t.Errorf("the action wasn't added to the second device: %+v", c.Devices)
+	}
+}
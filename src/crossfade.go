@@ -0,0 +1,90 @@
+package pamidicontrol
+
+import (
+	"math"
+)
+
+// CrossfadeLaw is how a crossfade shares the volume between its two sides as
+// it moves from one to the other.
+type CrossfadeLaw string
+
+const (
+	// EqualPowerLaw keeps the loudness the same all the way across, so
+	// the middle doesn't dip. It is the default.
+	EqualPowerLaw CrossfadeLaw = "EqualPower"
+	// LinearLaw keeps the sum of the two amplitudes the same, so the
+	// middle is quieter than either end.
+	LinearLaw CrossfadeLaw = "Linear"
+)
+
+// Valid reports whether l is a known crossfade law. An empty law is equal
+// power.
+func (l CrossfadeLaw) Valid() bool {
+	switch l {
+	case "", EqualPowerLaw, LinearLaw:
+		return true
+	}
+	return false
+}
+
+// gains returns the amplitudes of the two sides at a position between 0, only
+// A, and 1, only B.
+func (l CrossfadeLaw) gains(position float64) (float64, float64) {
+	if l == LinearLaw {
+		return 1 - position, position
+	}
+	return math.Cos(position * math.Pi / 2), math.Sin(position * math.Pi / 2)
+}
+
+// CrossfadeSide is one of the targets a Crossfade action blends between.
+type CrossfadeSide struct {
+	TargetType PulseAudioTargetType
+	TargetName string
+
+	// MaxVolume is the volume of the side when the crossfade is all the way
+	// over to it, up to 1, which it is by default.
+	MaxVolume float32
+}
+
+func (s CrossfadeSide) maxVolume() float32 {
+	if s.MaxVolume > 0 {
+		return s.MaxVolume
+	}
+	return 1
+}
+
+// volume returns the pulseaudio volume of the side for an amplitude. The laws
+// work on amplitudes, and pulseaudio volumes are cubic.
+func (s CrossfadeSide) volume(gain float64) float32 {
+	return s.maxVolume() * float32(math.Cbrt(math.Max(0, gain)))
+}
+
+// targets returns the objects an action changes, which are the two sides of a
+// Crossfade and the target of any other action.
+func (a PulseAudioAction) targets() []PulseAudioAction {
+	if a.ActionType != Crossfade {
+		return []PulseAudioAction{a}
+	}
+	return []PulseAudioAction{a.A.target(a), a.B.target(a)}
+}
+
+// target returns the volume action for a side of a crossfade, ramping the way
+// the crossfade does.
+func (s CrossfadeSide) target(crossfade PulseAudioAction) PulseAudioAction {
+	return PulseAudioAction{
+		TargetType: s.TargetType,
+		TargetName: s.TargetName,
+		ActionType: VolumeChange,
+		Ramp:       crossfade.Ramp,
+		Curve:      crossfade.Curve,
+		SlewRate:   crossfade.SlewRate,
+	}
+}
+
+// crossfadeVolumes returns the volumes of side A and side B of a Crossfade
+// action at a position between 0 and 1. Positions outside of it are taken as
+// the nearest end.
+func crossfadeVolumes(action PulseAudioAction, position float32) (float32, float32) {
+	a, b := action.Law.gains(float64(clamp01(position)))
+	return action.A.volume(a), action.B.volume(b)
+}
@@ -0,0 +1,59 @@
+package pamidicontrol
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCrossfadeVolumes(t *testing.T) {
+	equalPower := PulseAudioAction{ActionType: Crossfade}
+	linear := PulseAudioAction{ActionType: Crossfade, Law: LinearLaw}
+	limited := PulseAudioAction{ActionType: Crossfade, A: CrossfadeSide{MaxVolume: 0.5}}
+
+	half := float32(math.Cbrt(math.Sqrt(0.5)))
+
+	tests := []struct {
+		name     string
+		action   PulseAudioAction
+		position float32
+		wantA    float32
+		wantB    float32
+	}{
+		{"equal power at A", equalPower, 0, 1, 0},
+		{"equal power at B", equalPower, 1, 0, 1},
+		{"equal power in the middle", equalPower, 0.5, half, half},
+		{"linear in the middle", linear, 0.5, float32(math.Cbrt(0.5)), float32(math.Cbrt(0.5))},
+		{"linear a quarter of the way", linear, 0.25, float32(math.Cbrt(0.75)), float32(math.Cbrt(0.25))},
+		{"max volume", limited, 0, 0.5, 0},
+		{"max volume in the middle", limited, 0.5, 0.5 * half, half},
+		{"before A", equalPower, -0.5, 1, 0},
+		{"past B", equalPower, 1.5, 0, 1},
+	}
+
+	for _, tt := range tests {
+		a, b := crossfadeVolumes(tt.action, tt.position)
+		if abs32(a-tt.wantA) > 1e-4 || abs32(b-tt.wantB) > 1e-4 {
+			t.Errorf("%s: crossfadeVolumes(%v) = %v, %v, want %v, %v", tt.name, tt.position, a, b, tt.wantA, tt.wantB)
+		}
+	}
+}
+
+func TestCrossfadeTargets(t *testing.T) {
+	action := PulseAudioAction{
+		ActionType: Crossfade,
+		A:          CrossfadeSide{TargetType: Sink, TargetName: "Speakers"},
+		B:          CrossfadeSide{TargetType: PlaybackStream, TargetName: "Music"},
+		SlewRate:   2,
+	}
+
+	targets := action.targets()
+	if len(targets) != 2 {
+		t.Fatalf("targets() returned %d targets, want 2", len(targets))
+	}
+	for i, want := range []CrossfadeSide{action.A, action.B} {
+		got := targets[i]
+		if got.TargetType != want.TargetType || got.TargetName != want.TargetName || got.ActionType != VolumeChange || got.SlewRate != 2 {
+			t.Errorf("target %d = %+v, want a VolumeChange of %s [%s] with SlewRate 2", i, got, want.TargetType, want.TargetName)
+		}
+	}
+}
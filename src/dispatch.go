@@ -0,0 +1,47 @@
+package pamidicontrol
+
+// dispatchTable finds the mappings of a control without going through every
+// mapping. A control can have several mappings, which run in the order they
+// are listed in the configuration.
+type dispatchTable map[bindingKey][]MidiAction
+
+// newDispatchTable compiles actions into a table.
+func newDispatchTable(actions []MidiAction) dispatchTable {
+	table := make(dispatchTable, len(actions))
+	for _, action := range actions {
+		key := action.bindingKey()
+		table[key] = append(table[key], action)
+	}
+	return table
+}
+
+// lookup returns the mappings of the control an input came from.
+func (t dispatchTable) lookup(input midiInput) []MidiAction {
+	return t[input.bindingKey()]
+}
+
+// compileDispatch builds the table of every layer, with the top level
+// mappings of the controls each layer doesn't map. The top level mappings
+// alone are used when no layer is active.
+func (c *MidiClient) compileDispatch() {
+	c.dispatch = make([]dispatchTable, len(c.Layers)+1)
+	c.dispatch[0] = newDispatchTable(c.MidiActions)
+	for i := range c.Layers {
+		c.dispatch[i+1] = newDispatchTable(layerActions(c.Layers[i], c.MidiActions))
+	}
+}
+
+// dispatchActions returns the mappings of the control an input came from:
+// those of the active layer, followed by the ones assigned automatically.
+func (c *MidiClient) dispatchActions(input midiInput) []MidiAction {
+	actions := c.dispatch[c.activeLayer()+1].lookup(input)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	assigned := c.assignedDispatch.lookup(input)
+	if len(assigned) == 0 {
+		return actions
+	}
+	return append(append([]MidiAction{}, actions...), assigned...)
+}
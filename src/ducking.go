@@ -0,0 +1,361 @@
+package pamidicontrol
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// StreamMatch picks playback streams by their application name, or by their
+// media role such as phone. When both are set, both have to match.
+type StreamMatch struct {
+	Application string
+	Role        string
+}
+
+// matches returns whether a stream with the given properties is picked.
+func (m StreamMatch) matches(props map[string]string) bool {
+	if m.Application == "" && m.Role == "" {
+		return false
+	}
+	if m.Application != "" && props["application.name"] != m.Application {
+		return false
+	}
+	if m.Role != "" && props["media.role"] != m.Role {
+		return false
+	}
+	return true
+}
+
+func matchesAny(matches []StreamMatch, props map[string]string) bool {
+	for _, m := range matches {
+		if m.matches(props) {
+			return true
+		}
+	}
+	return false
+}
+
+// DuckingRule turns some playback streams down while others are playing, such
+// as music during a call.
+type DuckingRule struct {
+	// While lists the streams that duck the others for as long as they
+	// exist.
+	While []StreamMatch
+	// Duck lists the streams that are turned down.
+	Duck []StreamMatch
+
+	// Playing only counts the streams in While while they are playing,
+	// rather than paused (corked), so an application that keeps its
+	// stream open between calls doesn't duck the others all the time.
+	Playing bool
+
+	// Amount turns the ducked streams down by a fraction of their volume,
+	// so 0.7 makes them 70% quieter. Level turns them down to a volume
+	// between 0 and 1 instead, unless they are already quieter.
+	Amount float32
+	Level  *float32
+
+	// Fade is how long the streams take to go down, and to come back up
+	// once the streams that ducked them have gone.
+	Fade time.Duration
+}
+
+// duck returns how far a stream at the given volume is turned down, as a
+// fraction of its volume.
+func (r DuckingRule) duck(volume float32) float32 {
+	if r.Level == nil {
+		return r.Amount
+	}
+	if volume <= *r.Level {
+		return 0
+	}
+	return 1 - *r.Level/volume
+}
+
+// duckStep is how often the volumes of fading streams are changed.
+const duckStep = 20 * time.Millisecond
+
+// corkedInterval is how often the streams are checked for being paused, for
+// the rules that only count playing streams. Pulseaudio doesn't signal it.
+const corkedInterval = time.Second
+
+// duckFade is how far a stream is turned down, and how far it is fading to.
+type duckFade struct {
+	current float32
+	target  float32
+	fade    time.Duration
+}
+
+// ducker applies the ducking rules as streams come and go. The streams are
+// turned down through their ducking in PAClient, so moving their faders
+// changes the volume they come back to.
+type ducker struct {
+	client *PAClient
+	rules  []DuckingRule
+
+	// mu guards ducks, the ducking of each stream, fading, which is set
+	// while a goroutine is fading them, and corked, the streams that are
+	// paused.
+	mu     sync.Mutex
+	ducks  map[dbus.ObjectPath]*duckFade
+	fading bool
+	corked map[dbus.ObjectPath]bool
+}
+
+func newDucker(client *PAClient, rules []DuckingRule) *ducker {
+	d := &ducker{
+		client: client,
+		rules:  rules,
+		ducks:  make(map[dbus.ObjectPath]*duckFade, 0),
+		corked: make(map[dbus.ObjectPath]bool, 0),
+	}
+	client.AddListener(func(path dbus.ObjectPath) {
+		d.evaluate()
+	})
+	for _, rule := range rules {
+		if rule.Playing {
+			go d.watchCorked()
+			break
+		}
+	}
+	d.evaluate()
+	return d
+}
+
+// evaluate works out how far each stream should be turned down by the rules
+// that apply at the moment, and starts fading the streams that aren't there
+// yet.
+func (d *ducker) evaluate() {
+	streams := d.client.PlaybackStreamProperties()
+
+	d.mu.Lock()
+	corked := d.corked
+	d.mu.Unlock()
+
+	targets := duckTargets(d.rules, streams, corked, func(path dbus.ObjectPath) (float32, bool) {
+		tracked, ok, err := d.client.pathVolume(PlaybackStream, path)
+		if err != nil || !ok {
+			return 0, false
+		}
+		return tracked.Volume, true
+	})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for path, target := range targets {
+		f, ok := d.ducks[path]
+		if !ok {
+			f = &duckFade{}
+			d.ducks[path] = f
+		}
+		f.target, f.fade = target.target, target.fade
+	}
+
+	moving := false
+	for path, f := range d.ducks {
+		if _, ok := targets[path]; !ok {
+			if _, exists := streams[path]; !exists {
+				delete(d.ducks, path)
+				continue
+			}
+			// The stream comes back up at the pace of the rule that
+			// ducked it.
+			f.target = 0
+		}
+		moving = moving || f.current != f.target
+	}
+
+	if moving && !d.fading {
+		d.fading = true
+		go d.fade()
+	}
+}
+
+// duckTargets works out how far each of the playback streams, given by their
+// properties, is turned down by the rules. corked holds the streams that are
+// paused, and volume returns the volume of a stream. A stream ducked by
+// several rules is turned down by the most.
+func duckTargets(rules []DuckingRule, streams map[dbus.ObjectPath]map[string]string, corked map[dbus.ObjectPath]bool, volume func(dbus.ObjectPath) (float32, bool)) map[dbus.ObjectPath]duckFade {
+	targets := make(map[dbus.ObjectPath]duckFade, 0)
+	for _, rule := range rules {
+		active := false
+		for path, props := range streams {
+			if matchesAny(rule.While, props) && !(rule.Playing && corked[path]) {
+				active = true
+				break
+			}
+		}
+		if !active {
+			continue
+		}
+
+		for path, props := range streams {
+			if !matchesAny(rule.Duck, props) || matchesAny(rule.While, props) {
+				continue
+			}
+			current, ok := volume(path)
+			if !ok {
+				continue
+			}
+			duck := rule.duck(current)
+			if target, ok := targets[path]; !ok || duck > target.target {
+				targets[path] = duckFade{target: duck, fade: rule.Fade}
+			}
+		}
+	}
+	return targets
+}
+
+// watchCorked keeps track of which playback streams are paused, evaluating
+// the rules again when that changes. Pulseaudio's D-Bus interface doesn't
+// tell, so pactl is asked every corkedInterval.
+func (d *ducker) watchCorked() {
+	indexes := make(map[dbus.ObjectPath]uint32, 0)
+	for {
+		paused, err := corkedStreams()
+		if errors.Is(err, exec.ErrNotFound) {
+			log.Error().Err(err).Msg("Ducking only while streams are playing needs pactl, which comes with the pulseaudio utilities")
+			return
+		}
+		if err != nil {
+			log.Debug().Err(err).Msg("Could not find out which streams are paused")
+		}
+
+		corked := make(map[dbus.ObjectPath]bool, 0)
+		for path := range d.client.PlaybackStreamProperties() {
+			index, ok := indexes[path]
+			if !ok {
+				if index, err = d.client.Stream(path).Uint32("Index"); err != nil {
+					continue
+				}
+				indexes[path] = index
+			}
+			if paused[index] {
+				corked[path] = true
+			}
+		}
+
+		d.mu.Lock()
+		changed := !sameCorked(d.corked, corked)
+		d.corked = corked
+		d.mu.Unlock()
+		if changed {
+			d.evaluate()
+		}
+
+		time.Sleep(corkedInterval)
+	}
+}
+
+func sameCorked(a, b map[dbus.ObjectPath]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path := range a {
+		if !b[path] {
+			return false
+		}
+	}
+	return true
+}
+
+// corkedStreams returns the indexes of the playback streams that are paused,
+// as listed by pactl.
+func corkedStreams() (map[uint32]bool, error) {
+	cmd := exec.Command("pactl", "list", "sink-inputs")
+	// The output is translated otherwise.
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseCorked(string(output)), nil
+}
+
+// parseCorked reads the indexes of the paused streams from the output of
+// pactl list sink-inputs.
+func parseCorked(output string) map[uint32]bool {
+	corked := make(map[uint32]bool, 0)
+	index, known := uint32(0), false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "Sink Input #") {
+			n, err := strconv.ParseUint(strings.TrimPrefix(line, "Sink Input #"), 10, 32)
+			index, known = uint32(n), err == nil
+			continue
+		}
+		if known && line == "Corked: yes" {
+			corked[index] = true
+		}
+	}
+	return corked
+}
+
+// fade moves the ducking of every stream towards its target, until they have
+// all got there.
+func (d *ducker) fade() {
+	last := time.Now()
+	for {
+		time.Sleep(duckStep)
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+
+		d.mu.Lock()
+		changed := make(map[dbus.ObjectPath]float32, 0)
+		for path, f := range d.ducks {
+			if f.current == f.target {
+				continue
+			}
+
+			step := float32(1)
+			if f.fade > 0 {
+				step = float32(elapsed) / float32(f.fade)
+			}
+			if f.current < f.target {
+				f.current = min32(f.target, f.current+step)
+			} else {
+				f.current = max32(f.target, f.current-step)
+			}
+			changed[path] = f.current
+		}
+		if len(changed) == 0 {
+			d.fading = false
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		for path, duck := range changed {
+			if err := d.client.SetDuck(PlaybackStream, path, duck); err != nil {
+				log.Debug().Err(err).Msgf("Could not duck %s", path)
+			}
+		}
+	}
+}
+
+func min32(a, b float32) float32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max32(a, b float32) float32 {
+	if a > b {
+		return a
+	}
+	return b
+}
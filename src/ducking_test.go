@@ -0,0 +1,83 @@
+package pamidicontrol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus"
+)
+
+func TestParseCorked(t *testing.T) {
+	output := `Sink Input #12
+	Driver: protocol-native.c
+	Sink: 1
+	Corked: yes
+	Mute: no
+
+Sink Input #15
+	Driver: protocol-native.c
+	Sink: 1
+	Corked: no
+	Mute: no
+`
+	want := map[uint32]bool{12: true}
+	if got := parseCorked(output); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCorked() = %v, want %v", got, want)
+	}
+}
+
+func TestDuckTargets(t *testing.T) {
+	const (
+		call  = dbus.ObjectPath("/call")
+		music = dbus.ObjectPath("/music")
+	)
+	streams := map[dbus.ObjectPath]map[string]string{
+		call:  {"application.name": "Discord"},
+		music: {"application.name": "Spotify"},
+	}
+	volume := func(dbus.ObjectPath) (float32, bool) {
+		return 1, true
+	}
+
+	tests := []struct {
+		name    string
+		playing bool
+		corked  map[dbus.ObjectPath]bool
+		want    map[dbus.ObjectPath]duckFade
+	}{
+		{
+			name: "call exists",
+			want: map[dbus.ObjectPath]duckFade{music: {target: 0.5}},
+		},
+		{
+			name:   "corked call still ducks without Playing",
+			corked: map[dbus.ObjectPath]bool{call: true},
+			want:   map[dbus.ObjectPath]duckFade{music: {target: 0.5}},
+		},
+		{
+			name:    "call playing",
+			playing: true,
+			want:    map[dbus.ObjectPath]duckFade{music: {target: 0.5}},
+		},
+		{
+			name:    "call corked",
+			playing: true,
+			corked:  map[dbus.ObjectPath]bool{call: true},
+			want:    map[dbus.ObjectPath]duckFade{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := []DuckingRule{{
+				While:   []StreamMatch{{Application: "Discord"}},
+				Duck:    []StreamMatch{{Application: "Spotify"}},
+				Amount:  0.5,
+				Playing: tt.playing,
+			}}
+			if got := duckTargets(rules, streams, tt.corked, volume); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("duckTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package pamidicontrol
+
+import (
+	"math"
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/channel"
+)
+
+// midiOutput sends feedback to a controller. It is safe to use from the
+// pulseaudio signal handlers and the midi reader at the same time.
+type midiOutput struct {
+	mu  sync.Mutex
+	out midi.Out
+}
+
+func newMidiOutput(out midi.Out) *midiOutput {
+	return &midiOutput{out: out}
+}
+
+func (o *midiOutput) write(msg midi.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	_, err := o.out.Write(msg.Raw())
+	return err
+}
+
+func (o *midiOutput) ControlChange(ch uint8, controller uint8, value uint8) error {
+	return o.write(channel.Channel(ch).ControlChange(controller, value))
+}
+
+func (o *midiOutput) NoteOn(ch uint8, key uint8, velocity uint8) error {
+	return o.write(channel.Channel(ch).NoteOn(key, velocity))
+}
+
+// ChannelPressure sends an aftertouch message for the whole channel.
+func (o *midiOutput) ChannelPressure(ch uint8, pressure uint8) error {
+	return o.write(channel.Channel(ch).Aftertouch(pressure))
+}
+
+// PitchBend sends an absolute pitch bend value between 0 and 16383.
+func (o *midiOutput) PitchBend(ch uint8, value uint16) error {
+	return o.write(channel.Channel(ch).Pitchbend(int16(value) - 8192))
+}
+
+// Feedback turns the LED of a control on or off.
+func (o *midiOutput) Feedback(feedback PresetFeedback, on bool) error {
+	value := feedback.OffValue
+	if on {
+		value = feedback.OnValue
+	}
+
+	if feedback.ActionType == Note {
+		return o.NoteOn(feedback.Channel, feedback.Controller, value)
+	}
+	return o.ControlChange(feedback.Channel, feedback.Controller, value)
+}
+
+// SysEx sends a system exclusive message, including its F0 and F7 bytes. The
+// driver only writes short messages, so it goes straight to the portmidi
+// stream.
+func (o *midiOutput) SysEx(msg []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return sendSysEx(o.out, msg)
+}
+
+// startFeedback lights the LEDs of the mapped controls and keeps them up to
+// date as their targets change.
+func (c *MidiClient) startFeedback() {
+	c.syncFeedback()
+	c.PAClient.AddListener(func(path dbus.ObjectPath) {
+		c.syncFeedback()
+	})
+}
+
+// syncFeedback shows the state of the targets of the mappings in use on the
+// LEDs of their controls. Mute buttons light up while their target is muted,
+// LED rings follow the volume and the button of the active layer is lit.
+// Controls that are no longer mapped are turned off, and the LEDs of meters
+// are left alone. Only the LEDs whose value changed since the last sync are
+// sent to the controller.
+func (c *MidiClient) syncFeedback() {
+	if c.Preset == nil || c.output == nil {
+		return
+	}
+
+	c.feedbackMu.Lock()
+	defer c.feedbackMu.Unlock()
+
+	// shown holds the value of each LED set by this sync.
+	shown := make(map[bindingKey]uint8, 0)
+	write := func(key bindingKey, on bool, ring uint8) {
+		control, ok := c.Preset.ControlAt(MidiAction{ActionType: key.actionType, Channel: key.channel, Controller: key.controller})
+		if !ok || control.Feedback == nil {
+			return
+		}
+		// The LEDs a meter shows its level on are left to the meter.
+		for _, meter := range c.Meters {
+			if meter.drivesLED(*control.Feedback) {
+				return
+			}
+		}
+
+		value := ring
+		if control.Feedback.OnValue != 0 || control.Feedback.OffValue != 0 {
+			value = control.Feedback.OffValue
+			if on {
+				value = control.Feedback.OnValue
+			}
+		}
+		shown[key] = value
+		if last, ok := c.fed[key]; ok && last == value {
+			return
+		}
+
+		var err error
+		if control.Feedback.OnValue == 0 && control.Feedback.OffValue == 0 {
+			err = c.output.ControlChange(control.Feedback.Channel, control.Feedback.Controller, value)
+		} else {
+			err = c.output.Feedback(*control.Feedback, on)
+		}
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not update the LED of %s", control.Name)
+		}
+	}
+
+	active := c.activeLayer()
+	for i, layer := range c.Layers {
+		if layer.Button != nil {
+			write(layer.Button.bindingKey(), i == active, 0)
+		}
+	}
+
+	if c.Privacy != nil && c.Privacy.Indicator != nil {
+		write(c.Privacy.Indicator.bindingKey(), len(c.PAClient.Capturing()) > 0, 0)
+	}
+	if c.Privacy != nil && c.Privacy.Button != nil && c.privacy != nil {
+		write(c.Privacy.Button.bindingKey(), c.privacy.On(), 0)
+	}
+	if c.DoseIndicator != nil {
+		write(c.DoseIndicator.bindingKey(), c.doseIndicatorOn(), 0)
+	}
+
+	for _, action := range c.configuredActions() {
+		// A control with several mappings shows the state of the first.
+		if _, ok := shown[action.bindingKey()]; ok {
+			continue
+		}
+
+		switch action.Action.ActionType {
+		case Mute, VolumeChange:
+			tracked, ok, err := c.PAClient.TrackedVolume(action.Action)
+			if err != nil || !ok {
+				continue
+			}
+			ring := uint8(math.Round(float64(tracked.Volume) * 127))
+			if ring > 127 {
+				ring = 127
+			}
+			write(action.bindingKey(), action.Action.ActionType == Mute && tracked.Muted, ring)
+		}
+	}
+
+	// The controls that were lit before but aren't mapped any more are
+	// turned off. They stay in fed, so they are only turned off once.
+	for key := range c.fed {
+		if _, ok := shown[key]; !ok {
+			write(key, false, 0)
+		}
+	}
+	c.fed = shown
+}
@@ -0,0 +1,356 @@
+package pamidicontrol
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/rakyll/portmidi"
+	"github.com/rs/zerolog/log"
+	"gitlab.com/gomidi/midi"
+	"gitlab.com/gomidi/midi/midimessage/sysex"
+	driver "gitlab.com/gomidi/portmididrv"
+)
+
+// identityRequest is the Universal Device Inquiry, which every device on the
+// port answers with its identity.
+var identityRequest = sysex.SysEx{0x7E, 0x7F, 0x06, 0x01}.Raw()
+
+// sysExTimeout is how long the reply to a system exclusive request is waited
+// for.
+const sysExTimeout = 500 * time.Millisecond
+
+// DeviceIdentity is what a device answers to the Universal Device Inquiry.
+type DeviceIdentity struct {
+	// Manufacturer is the one byte manufacturer id, or three bytes
+	// starting with zero.
+	Manufacturer []byte
+	Family       uint16
+	Model        uint16
+
+	// Device is the device id the reply came from, which many controllers
+	// set to their global channel.
+	Device uint8
+}
+
+// String describes the identity the way it is usually written down.
+func (id DeviceIdentity) String() string {
+	return fmt.Sprintf("manufacturer % X, family %04X, model %04X", id.Manufacturer, id.Family, id.Model)
+}
+
+// matches returns whether a device identifies as id. A Model of zero matches
+// every model of the family.
+func (id DeviceIdentity) matches(device DeviceIdentity) bool {
+	return bytes.Equal(id.Manufacturer, device.Manufacturer) &&
+		id.Family == device.Family &&
+		(id.Model == 0 || id.Model == device.Model)
+}
+
+// parseIdentityReply reads the identity out of a reply to the Universal Device
+// Inquiry: F0 7E <device> 06 02 <manufacturer> <family> <model> <version> F7,
+// with the family and model least significant byte first. They are combined
+// a byte at a time, so they read the way manuals write them.
+func parseIdentityReply(msg []byte) (DeviceIdentity, bool) {
+	var id DeviceIdentity
+
+	data, ok := sysExData(msg)
+	if !ok || len(data) < 5 || data[0] != 0x7E || data[2] != 0x06 || data[3] != 0x02 {
+		return id, false
+	}
+
+	rest := data[4:]
+	manufacturer := 1
+	if len(rest) > 0 && rest[0] == 0x00 {
+		manufacturer = 3
+	}
+	if len(rest) < manufacturer+4 {
+		return id, false
+	}
+
+	id.Device = data[1]
+	id.Manufacturer = append([]byte{}, rest[:manufacturer]...)
+	rest = rest[manufacturer:]
+	id.Family = uint16(rest[0]) | uint16(rest[1])<<8
+	id.Model = uint16(rest[2]) | uint16(rest[3])<<8
+	return id, true
+}
+
+// sysExData returns the data of a system exclusive message, without its F0
+// and F7 bytes.
+func sysExData(msg []byte) (sysex.SysEx, bool) {
+	if len(msg) < 2 || msg[0] != 0xF0 || msg[len(msg)-1] != 0xF7 {
+		return nil, false
+	}
+	return sysex.SysEx(msg[1 : len(msg)-1]), true
+}
+
+// FindPresetByIdentity returns the preset for the controller that identifies
+// as id, if there is one.
+func FindPresetByIdentity(id DeviceIdentity) (*ControllerPreset, bool) {
+	for _, preset := range Presets {
+		if preset.Identity != nil && preset.Identity.matches(id) {
+			return preset, true
+		}
+	}
+	return nil, false
+}
+
+// requestSysEx sends a system exclusive message through out and returns the
+// first reply on in that accept takes, waiting up to sysExTimeout. Any other
+// messages that arrive in the meantime are dropped, so it must be called
+// before the input is listened to.
+func requestSysEx(in midi.In, out midi.Out, msg []byte, accept func([]byte) bool) ([]byte, error) {
+	if err := sendSysEx(out, msg); err != nil {
+		return nil, err
+	}
+
+	_, reply, err := waitForSysEx([]midi.In{in}, accept)
+	return reply, err
+}
+
+// sendSysEx sends a system exclusive message, including its F0 and F7 bytes,
+// straight to the portmidi stream of out.
+func sendSysEx(out midi.Out, msg []byte) error {
+	stream, ok := out.Underlying().(*portmidi.Stream)
+	if !ok || stream == nil {
+		return fmt.Errorf("midi output %s can't send system exclusive messages", out)
+	}
+	return stream.WriteSysExBytes(portmidi.Time(), msg)
+}
+
+// waitForSysEx waits up to sysExTimeout for a system exclusive message that
+// accept takes on any of ins, and returns the input it arrived on.
+func waitForSysEx(ins []midi.In, accept func([]byte) bool) (midi.In, []byte, error) {
+	deadline := time.Now().Add(sysExTimeout)
+	for time.Now().Before(deadline) {
+		for _, in := range ins {
+			stream, ok := in.Underlying().(*portmidi.Stream)
+			if !ok || stream == nil {
+				continue
+			}
+			if msg, ok := readSysEx(stream, accept); ok {
+				return in, msg, nil
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil, nil, fmt.Errorf("no reply within %s", sysExTimeout)
+}
+
+// readSysEx returns the first system exclusive message waiting on in that
+// accept takes.
+func readSysEx(in *portmidi.Stream, accept func([]byte) bool) ([]byte, bool) {
+	if has, err := in.Poll(); err != nil || !has {
+		return nil, false
+	}
+
+	events, err := in.Read(1024)
+	if err != nil {
+		return nil, false
+	}
+	for _, event := range events {
+		if event.SysEx != nil && accept(event.SysEx) {
+			return event.SysEx, true
+		}
+	}
+	return nil, false
+}
+
+// isIdentityReply accepts replies to the Universal Device Inquiry.
+func isIdentityReply(msg []byte) bool {
+	_, ok := parseIdentityReply(msg)
+	return ok
+}
+
+// identify asks the device on a pair of open ports for its identity.
+func identify(in midi.In, out midi.Out) (DeviceIdentity, error) {
+	reply, err := requestSysEx(in, out, identityRequest, isIdentityReply)
+	if err != nil {
+		return DeviceIdentity{}, err
+	}
+
+	id, _ := parseIdentityReply(reply)
+	return id, nil
+}
+
+// mcuDeviceQuery asks a Mackie Control surface for its serial number, which
+// it answers with a host connection query: F0 00 00 66 14 01 <serial>
+// <challenge> F7. Surfaces in Mackie Control mode often answer the Universal
+// Device Inquiry with the identity of the hardware, or not at all.
+var mcuDeviceQuery = append(append([]byte{}, mcuSysExHeader...), 0x00, 0xF7)
+
+// isMCUConnectionQuery accepts the answer of a Mackie Control surface to the
+// device query.
+func isMCUConnectionQuery(msg []byte) bool {
+	return len(msg) > len(mcuSysExHeader)+1 &&
+		bytes.Equal(msg[:len(mcuSysExHeader)], mcuSysExHeader) &&
+		msg[len(mcuSysExHeader)] == 0x01
+}
+
+// detectController picks the preset of the controller on the open ports by
+// asking it for its identity. A controller without a preset that answers as a
+// Mackie Control surface is driven with that protocol, with its strips
+// following the applications that are playing unless they are configured.
+func (c *MidiClient) detectController(in midi.In, out midi.Out) {
+	id, err := identify(in, out)
+	if err != nil {
+		log.Debug().Err(err).Msgf("%s didn't answer the identity request", out)
+	} else if preset, ok := FindPresetByIdentity(id); ok {
+		log.Info().Msgf("%s identified as a %s", in, preset.Name)
+		c.Preset = preset
+		return
+	}
+
+	if _, err := requestSysEx(in, out, mcuDeviceQuery, isMCUConnectionQuery); err != nil {
+		if id.Manufacturer != nil {
+			log.Info().Msgf("%s identified as %s, which has no preset", in, id)
+		}
+		return
+	}
+
+	log.Info().Msgf("%s answered as a Mackie Control surface", in)
+	c.Protocol = MackieControl
+	if len(c.Strips) == 0 && c.AutoAssign == nil {
+		c.AutoAssign = &AutoAssign{}
+	}
+}
+
+// foundController is a controller found by discoverControllers.
+type foundController struct {
+	In, Out string
+	// InPort and OutPort pick the ports of the controller when another
+	// device has ports of the same name, and are nil otherwise.
+	InPort, OutPort *PortMatch
+	Preset          *ControllerPreset
+}
+
+// discoverControllers sends the Universal Device Inquiry through every midi
+// output in turn, and returns the inputs and outputs of every device that
+// identifies as a controller pamidicontrol has a preset for.
+func discoverControllers() ([]foundController, error) {
+	drv, err := driver.New()
+	if err != nil {
+		return nil, err
+	}
+	defer drv.Close()
+
+	ins, err := drv.Ins()
+	if err != nil {
+		return nil, err
+	}
+	outs, err := drv.Outs()
+	if err != nil {
+		return nil, err
+	}
+
+	inNames := make([]string, 0, len(ins))
+	open := make([]midi.In, 0, len(ins))
+	for _, in := range ins {
+		inNames = append(inNames, in.String())
+		if err := in.Open(); err != nil {
+			log.Debug().Err(err).Msgf("Could not open %s to discover controllers", in)
+			continue
+		}
+		open = append(open, in)
+	}
+	outNames := make([]string, 0, len(outs))
+	for _, out := range outs {
+		outNames = append(outNames, out.String())
+	}
+
+	found := make([]foundController, 0)
+	answered := make(map[midi.In]bool)
+	for o, out := range outs {
+		if err := out.Open(); err != nil {
+			log.Debug().Err(err).Msgf("Could not open %s to discover controllers", out)
+			continue
+		}
+		if err := sendSysEx(out, identityRequest); err != nil {
+			log.Debug().Err(err).Msgf("Could not send an identity request to %s", out)
+			continue
+		}
+
+		in, reply, err := waitForSysEx(open, isIdentityReply)
+		if err != nil || answered[in] {
+			continue
+		}
+		answered[in] = true
+		id, _ := parseIdentityReply(reply)
+		log.Info().Msgf("%s identified as %s", in, id)
+
+		preset, ok := FindPresetByIdentity(id)
+		if !ok {
+			continue
+		}
+		for i, port := range ins {
+			if port == in {
+				found = append(found, foundController{
+					In:      inNames[i],
+					Out:     outNames[o],
+					InPort:  samePortName(inNames, i),
+					OutPort: samePortName(outNames, o),
+					Preset:  preset,
+				})
+				break
+			}
+		}
+	}
+
+	if len(found) == 0 {
+		return nil, fmt.Errorf("no midi device identified as a known controller")
+	}
+	return found, nil
+}
+
+// samePortName returns a match for the i'th port of names when other ports
+// have the same name, as identical controllers do, or nil if its name is
+// enough to pick it.
+func samePortName(names []string, i int) *PortMatch {
+	before, total := 0, 0
+	for j, name := range names {
+		if name != names[i] {
+			continue
+		}
+		if j < i {
+			before++
+		}
+		total++
+	}
+	if total == 1 {
+		return nil
+	}
+	return &PortMatch{Pattern: "^" + regexp.QuoteMeta(names[i]) + "$", Index: uint(before)}
+}
+
+// assignControllers gives the controllers found by discoverControllers to the
+// devices that don't configure their ports, returning them by the index of
+// the device. A device that names its Preset only gets a controller of that
+// preset, and the others get the rest in the order they were found.
+func assignControllers(devices []Device, found []foundController) map[int]foundController {
+	assigned := make(map[int]foundController)
+	taken := make([]bool, len(found))
+	take := func(i int, preset *ControllerPreset) {
+		for j, controller := range found {
+			if !taken[j] && (preset == nil || controller.Preset == preset) {
+				taken[j] = true
+				assigned[i] = controller
+				return
+			}
+		}
+	}
+
+	for i, device := range devices {
+		if device.unnamed() && device.Preset != "" {
+			if preset, ok := PresetByName(device.Preset); ok {
+				take(i, preset)
+			}
+		}
+	}
+	for i, device := range devices {
+		if device.unnamed() && device.Preset == "" {
+			take(i, nil)
+		}
+	}
+	return assigned
+}
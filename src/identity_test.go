@@ -0,0 +1,123 @@
+package pamidicontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseIdentityReply(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    []byte
+		want   DeviceIdentity
+		wantOK bool
+	}{
+		{
+			name:   "one byte manufacturer",
+			msg:    []byte{0xF0, 0x7E, 0x00, 0x06, 0x02, 0x42, 0x13, 0x01, 0x00, 0x00, 0x03, 0x00, 0x01, 0x00, 0xF7},
+			want:   DeviceIdentity{Manufacturer: []byte{0x42}, Family: 0x0113, Model: 0x0000, Device: 0x00},
+			wantOK: true,
+		},
+		{
+			name:   "three byte manufacturer",
+			msg:    []byte{0xF0, 0x7E, 0x05, 0x06, 0x02, 0x00, 0x20, 0x29, 0x13, 0x01, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0xF7},
+			want:   DeviceIdentity{Manufacturer: []byte{0x00, 0x20, 0x29}, Family: 0x0113, Model: 0x0002, Device: 0x05},
+			wantOK: true,
+		},
+		{
+			name: "identity request",
+			msg:  []byte{0xF0, 0x7E, 0x7F, 0x06, 0x01, 0xF7},
+		},
+		{
+			name: "other sysex",
+			msg:  []byte{0xF0, 0x42, 0x40, 0x00, 0x01, 0x13, 0x00, 0x1F, 0x12, 0x00, 0xF7},
+		},
+		{
+			name: "too short",
+			msg:  []byte{0xF0, 0x7E, 0x00, 0x06, 0x02, 0x42, 0x13, 0x01, 0xF7},
+		},
+		{
+			name: "three byte manufacturer too short",
+			msg:  []byte{0xF0, 0x7E, 0x00, 0x06, 0x02, 0x00, 0x20, 0x29, 0x13, 0x01, 0xF7},
+		},
+		{
+			name: "not sysex",
+			msg:  []byte{0xB0, 0x07, 0x7F},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseIdentityReply(tt.msg)
+			if ok != tt.wantOK {
+				t.Fatalf("parseIdentityReply(% X) ok = %v, want %v", tt.msg, ok, tt.wantOK)
+			}
+			if ok && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseIdentityReply(% X) = %+v, want %+v", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceIdentityMatches(t *testing.T) {
+	korg := DeviceIdentity{Manufacturer: []byte{0x42}, Family: 0x0113}
+
+	tests := []struct {
+		device DeviceIdentity
+		want   bool
+	}{
+		{DeviceIdentity{Manufacturer: []byte{0x42}, Family: 0x0113, Model: 0x0004}, true},
+		{DeviceIdentity{Manufacturer: []byte{0x42}, Family: 0x0114}, false},
+		{DeviceIdentity{Manufacturer: []byte{0x00, 0x20, 0x29}, Family: 0x0113}, false},
+	}
+
+	for _, tt := range tests {
+		if got := korg.matches(tt.device); got != tt.want {
+			t.Errorf("matches(%s) = %v, want %v", tt.device, got, tt.want)
+		}
+	}
+}
+
+func TestSamePortName(t *testing.T) {
+	names := []string{"nanoKONTROL2 MIDI 1", "Launch Control XL MIDI 1", "nanoKONTROL2 MIDI 1"}
+
+	if got := samePortName(names, 1); got != nil {
+		t.Errorf("samePortName(1) = %v, want nil", got)
+	}
+	for i, want := range map[int]uint{0: 0, 2: 1} {
+		got := samePortName(names, i)
+		if got == nil {
+			t.Fatalf("samePortName(%d) = nil, want a match", i)
+		}
+		index, err := findPort("input", names, "", got)
+		if err != nil || index != i || got.Index != want {
+			t.Errorf("samePortName(%d) = %v, which picks port %d (%v)", i, got, index, err)
+		}
+	}
+}
+
+func TestAssignControllers(t *testing.T) {
+	nano, _ := PresetByName("KORG nanoKONTROL2")
+	xl, _ := PresetByName("Novation Launch Control XL")
+	found := []foundController{
+		{In: "nano in", Out: "nano out", Preset: nano},
+		{In: "xl in", Out: "xl out", Preset: xl},
+	}
+
+	devices := []Device{
+		{},
+		{InputMidiName: "named", OutputMidiName: "named"},
+		{Preset: xl.Name},
+	}
+	got := assignControllers(devices, found)
+
+	want := map[int]string{0: "nano in", 2: "xl in"}
+	if len(got) != len(want) {
+		t.Fatalf("assignControllers() = %v, want %v", got, want)
+	}
+	for i, in := range want {
+		if got[i].In != in {
+			t.Errorf("device %d was given %q, want %q", i, got[i].In, in)
+		}
+	}
+}
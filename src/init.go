@@ -0,0 +1,152 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+func runInit(args []string) {
+	fs := newFlagSet("init")
+	configPath := configFlag(fs)
+	inputName := fs.String("in", "", "name of the midi input to use (default the first recognised controller)")
+	outputName := fs.String("out", "", "name of the midi output to use (default the output named like the input)")
+	force := fs.Bool("force", false, "overwrite an existing configuration file")
+	fs.Parse(args)
+
+	path := *configPath
+	if path == "" {
+		path = DefaultConfigPath()
+	}
+
+	if _, err := os.Stat(path); err == nil && !*force {
+		fmt.Fprintf(os.Stderr, "%s already exists, pass -force to replace it\n", path)
+		os.Exit(1)
+	}
+
+	ins, outs, err := (&MidiClient{}).ListDevices()
+	if err != nil {
+		panic(err)
+	}
+
+	// detected is the preset of a controller found by its identity, for
+	// controllers whose port names aren't recognised.
+	var detected *ControllerPreset
+
+	in := *inputName
+	if in == "" {
+		in = chooseInitPort(ins)
+	}
+	if in == "" && *outputName == "" {
+		if found, err := discoverControllers(); err == nil {
+			in, *outputName, detected = found[0].In, found[0].Out, found[0].Preset
+		}
+	}
+	if in == "" || !containsString(ins, in) {
+		fmt.Fprintf(os.Stderr, "Choose a midi input with -in. Possible values are:\n\n%s\n", strings.Join(ins, "\n"))
+		os.Exit(1)
+	}
+
+	out := *outputName
+	if out == "" && containsString(outs, in) {
+		out = in
+	}
+	if out == "" {
+		if _, ok := FindPreset(in); ok {
+			out = chooseInitPort(outs)
+		}
+	}
+	if out == "" || !containsString(outs, out) {
+		fmt.Fprintf(os.Stderr, "Choose a midi output with -out. Possible values are:\n\n%s\n", strings.Join(outs, "\n"))
+		os.Exit(1)
+	}
+
+	_, paclient := connectPulseAudio()
+
+	c := Config{
+		Device: Device{
+			InputMidiName:  in,
+			OutputMidiName: out,
+			MidiActions:    make([]MidiAction, 0),
+		},
+	}
+
+	preset, ok := FindPreset(in)
+	if !ok && detected != nil {
+		// The preset has to be named, as the port name doesn't give it.
+		preset, ok = detected, true
+		c.Preset = detected.Name
+	}
+	if ok {
+		c.MidiActions = initMidiActions(preset, paclient)
+		fmt.Printf("Recognised a %s, mapped %d control(s)\n", preset.Name, len(c.MidiActions))
+	} else {
+		fmt.Printf("%s isn't a controller pamidicontrol knows the layout of. Run 'pamidicontrol learn' to map its controls.\n", in)
+	}
+
+	// The file is written fresh rather than updated, so -force can replace
+	// a configuration that no longer parses.
+	if err := WriteConfigFile(path, encodeConfigValue(reflect.ValueOf(c))); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not write the configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Wrote %s\n", path)
+}
+
+// chooseInitPort returns the first port belonging to a recognised controller.
+func chooseInitPort(ports []string) string {
+	for _, port := range ports {
+		if _, ok := FindPreset(port); ok {
+			return port
+		}
+	}
+	return ""
+}
+
+// initMidiActions assigns the channel strips of a controller to the current
+// sinks, then sources, then playback streams, leaving out monitor sources.
+// Each fader controls the volume of its target and the strip's mute button
+// mutes it.
+func initMidiActions(preset *ControllerPreset, paclient *PAClient) []MidiAction {
+	all, err := paclient.ListTargets()
+	if err != nil {
+		panic(err)
+	}
+
+	targets := make([]PulseAudioAction, 0)
+	for _, target := range all {
+		// Monitor sources mirror a sink, so they aren't worth a fader.
+		if target.TargetType == RecordStream || target.Properties["device.class"] == "monitor" {
+			continue
+		}
+
+		action := PulseAudioAction{TargetType: target.TargetType, TargetName: target.TargetName}
+		if len(targets) > 0 && targets[len(targets)-1] == action {
+			continue
+		}
+		targets = append(targets, action)
+	}
+
+	faders, mutes := preset.Strips()
+	if len(targets) > len(faders) {
+		fmt.Printf("There are more targets than the %d faders, only the first %d are mapped\n", len(faders), len(faders))
+	}
+
+	actions := make([]MidiAction, 0)
+	for i, target := range targets {
+		if i >= len(faders) {
+			break
+		}
+
+		target.ActionType = VolumeChange
+		actions = append(actions, MidiAction{Control: faders[i].Name, Action: target})
+
+		if i < len(mutes) {
+			target.ActionType = Mute
+			actions = append(actions, MidiAction{Control: mutes[i].Name, Action: target})
+		}
+	}
+	return actions
+}
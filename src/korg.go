@@ -0,0 +1,180 @@
+package pamidicontrol
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"gitlab.com/gomidi/midi"
+)
+
+// The layout of a nanoKONTROL2 scene, from the KORG nanoKONTROL2 parameter
+// guide. Offsets are into the scene once it has been decoded from 7 bit
+// bytes.
+const (
+	nk2SceneSize = 339
+
+	// nk2LEDMode is 0 when the controller lights its own LEDs, and 1 when
+	// the host lights them.
+	nk2LEDMode     = 2
+	nk2LEDExternal = 1
+
+	// Each of the 8 groups holds its channel, then the slider, knob, solo,
+	// mute and rec button settings, 6 bytes each.
+	nk2Groups    = 3
+	nk2GroupSize = 31
+
+	// The transport buttons share a channel, followed by the 6 bytes of
+	// each button.
+	nk2Transport = nk2Groups + 8*nk2GroupSize
+
+	nk2ControlSize = 6
+)
+
+// nk2TransportButtons are the preset names of the transport buttons, in the
+// order of the scene.
+var nk2TransportButtons = []string{
+	"trackPrevious", "trackNext", "cycle", "markerSet", "markerPrevious", "markerNext",
+	"rewind", "forward", "stop", "play", "record",
+}
+
+// The functions of the KORG native system exclusive messages.
+var (
+	nk2SceneDumpRequest  = []byte{0x1F, 0x10, 0x00}
+	nk2SceneWriteRequest = []byte{0x1F, 0x11, 0x00}
+	nk2SceneDump         = []byte{0x7F, 0x7F, 0x02, 0x03, 0x05, 0x40}
+	nk2LoadCompleted     = []byte{0x5F, 0x23, 0x00}
+	nk2LoadError         = []byte{0x5F, 0x24, 0x00}
+	nk2WriteCompleted    = []byte{0x5F, 0x21, 0x00}
+	nk2WriteError        = []byte{0x5F, 0x22, 0x00}
+)
+
+// nanoKontrol2 sets up a KORG nanoKONTROL2: the LEDs are handed to the host,
+// and every control is set to send the messages of the preset.
+type nanoKontrol2 struct{}
+
+func (nanoKontrol2) setup(in midi.In, out midi.Out, preset *ControllerPreset, options ControllerSetup) error {
+	// The controller answers on its global channel, which is part of
+	// every message.
+	id, err := identify(in, out)
+	if err != nil {
+		return err
+	}
+	header := []byte{0xF0, 0x42, 0x40 | id.Device&0x0F, 0x00, 0x01, 0x13, 0x00}
+
+	reply, err := requestSysEx(in, out, nk2Message(header, nk2SceneDumpRequest), func(msg []byte) bool {
+		return bytes.HasPrefix(msg, append(append([]byte{}, header...), nk2SceneDump...))
+	})
+	if err != nil {
+		return fmt.Errorf("could not read the scene: %v", err)
+	}
+
+	scene := decode7Bit(reply[len(header)+len(nk2SceneDump) : len(reply)-1])
+	if len(scene) < nk2SceneSize {
+		return fmt.Errorf("the scene is %d bytes rather than %d", len(scene), nk2SceneSize)
+	}
+	log.Debug().Msgf("Read the nanoKONTROL2 scene: % X", scene[:nk2SceneSize])
+
+	scene[nk2LEDMode] = nk2LEDExternal
+	controls := []string{"fader", "knob", "solo", "mute", "rec"}
+	for group := 0; group < 8; group++ {
+		offset := nk2Groups + group*nk2GroupSize
+		for i, prefix := range controls {
+			name := fmt.Sprintf("%s%d", prefix, group+1)
+			control, ok := preset.Control(name)
+			if !ok {
+				continue
+			}
+			scene[offset] = control.Channel
+			nk2SetControl(scene[offset+1+i*nk2ControlSize:], control, prefix != "fader" && prefix != "knob", options.toggles(name))
+		}
+	}
+	for i, name := range nk2TransportButtons {
+		control, ok := preset.Control(name)
+		if !ok {
+			continue
+		}
+		scene[nk2Transport] = control.Channel
+		nk2SetControl(scene[nk2Transport+1+i*nk2ControlSize:], control, true, options.toggles(name))
+	}
+
+	dump := append(append([]byte{}, header...), nk2SceneDump...)
+	dump = append(append(dump, encode7Bit(scene[:nk2SceneSize])...), 0xF7)
+	if err := nk2Request(in, out, header, dump, nk2LoadCompleted, nk2LoadError); err != nil {
+		return fmt.Errorf("could not load the scene: %v", err)
+	}
+
+	if options.Save {
+		if err := nk2Request(in, out, header, nk2Message(header, nk2SceneWriteRequest), nk2WriteCompleted, nk2WriteError); err != nil {
+			return fmt.Errorf("could not save the scene: %v", err)
+		}
+	}
+	return nil
+}
+
+// nk2SetControl writes the settings of a control into its 6 bytes of the
+// scene. Sliders and knobs have an assign type, a reserved byte, the
+// controller number and the range. Buttons have an assign type, the
+// behaviour, the controller number and the off and on values.
+func nk2SetControl(settings []byte, control PresetControl, button bool, toggle bool) {
+	settings[0] = 1 // Control change
+	settings[2] = control.Controller
+	settings[3] = 0
+	settings[4] = 127
+
+	if button {
+		settings[1] = 0 // Momentary
+		if toggle {
+			settings[1] = 1
+		}
+	}
+}
+
+// nk2Message builds a KORG native message with a function and no data.
+func nk2Message(header []byte, function []byte) []byte {
+	msg := append(append([]byte{}, header...), function...)
+	return append(msg, 0xF7)
+}
+
+// nk2Request sends a message and waits for the reply saying whether it worked.
+func nk2Request(in midi.In, out midi.Out, header []byte, msg []byte, completed []byte, failed []byte) error {
+	reply, err := requestSysEx(in, out, msg, func(reply []byte) bool {
+		return bytes.HasPrefix(reply, header) &&
+			(bytes.HasPrefix(reply[len(header):], completed) || bytes.HasPrefix(reply[len(header):], failed))
+	})
+	if err != nil {
+		return err
+	}
+	if bytes.HasPrefix(reply[len(header):], failed) {
+		return fmt.Errorf("the controller refused it")
+	}
+	return nil
+}
+
+// decode7Bit unpacks data sent as 7 bit bytes. Every 7 bytes are preceded by a
+// byte holding their top bits, the first byte's in the lowest bit.
+func decode7Bit(data []byte) []byte {
+	decoded := make([]byte, 0, len(data)*7/8)
+	for i := 0; i < len(data); i += 8 {
+		msbs := data[i]
+		for j := 1; j < 8 && i+j < len(data); j++ {
+			decoded = append(decoded, data[i+j]|(msbs>>uint(j-1)&1)<<7)
+		}
+	}
+	return decoded
+}
+
+// encode7Bit packs data into 7 bit bytes, the reverse of decode7Bit.
+func encode7Bit(data []byte) []byte {
+	encoded := make([]byte, 0, len(data)*8/7+1)
+	for i := 0; i < len(data); i += 7 {
+		var msbs byte
+		chunk := make([]byte, 0, 7)
+		for j := 0; j < 7 && i+j < len(data); j++ {
+			msbs |= (data[i+j] >> 7) << uint(j)
+			chunk = append(chunk, data[i+j]&0x7F)
+		}
+		encoded = append(append(encoded, msbs), chunk...)
+	}
+	return encoded
+}
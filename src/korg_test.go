@@ -0,0 +1,47 @@
+package pamidicontrol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode7Bit(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want []byte
+	}{
+		{[]byte{}, []byte{}},
+		{[]byte{0x01, 0x02}, []byte{0x00, 0x01, 0x02}},
+		{[]byte{0x80, 0x7F, 0xFF}, []byte{0x05, 0x00, 0x7F, 0x7F}},
+		{
+			[]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x87, 0x88},
+			[]byte{0x40, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x01, 0x08},
+		},
+	}
+
+	for _, tt := range tests {
+		if got := encode7Bit(tt.data); !bytes.Equal(got, tt.want) {
+			t.Errorf("encode7Bit(% X) = % X, want % X", tt.data, got, tt.want)
+		}
+		if got := decode7Bit(tt.want); !bytes.Equal(got, tt.data) {
+			t.Errorf("decode7Bit(% X) = % X, want % X", tt.want, got, tt.data)
+		}
+	}
+}
+
+func TestDecode7BitRoundTrip(t *testing.T) {
+	data := make([]byte, 339)
+	for i := range data {
+		data[i] = byte(i * 37)
+	}
+
+	encoded := encode7Bit(data)
+	for _, b := range encoded {
+		if b > 0x7F {
+			t.Fatalf("encode7Bit() returned % X, which isn't 7 bit", encoded)
+		}
+	}
+	if got := decode7Bit(encoded); !bytes.Equal(got, data) {
+		t.Errorf("decode7Bit(encode7Bit(data)) = % X, want % X", got, data)
+	}
+}
@@ -0,0 +1,139 @@
+package pamidicontrol
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Button is a control that switches between layers. Like a mapping, it can
+// name a control of the preset instead of giving the message it sends.
+type Button struct {
+	Control string
+
+	ActionType MidiActionType
+	Channel    uint8
+	Controller uint8
+}
+
+// String describes the button.
+func (b Button) String() string {
+	if b.Control != "" {
+		return b.Control
+	}
+	return fmt.Sprintf("%s on Channel %d, Controller %d", b.ActionType, b.Channel, b.Controller)
+}
+
+func (b Button) bindingKey() bindingKey {
+	return bindingKey{b.ActionType, b.Channel, b.Controller}
+}
+
+// Layer is a set of mappings that is only used while the layer is active. Its
+// mappings replace the top level mappings of the same controls.
+type Layer struct {
+	Name string
+
+	// Button switches to the layer when pressed. For a Shift layer, the
+	// layer is only active while the button is held down.
+	Button *Button
+	Shift  bool
+
+	MidiActions []MidiAction
+	Templates   []MidiTemplate
+}
+
+// noLayer is the layer index used when no layer is active.
+const noLayer = -1
+
+// handleLayerButton switches layers if an input comes from one of the layer
+// buttons. It returns false for any other input.
+func (c *MidiClient) handleLayerButton(input midiInput) bool {
+	key := input.bindingKey()
+	pressed := input.Value > 0
+
+	if c.BankLeft != nil && c.BankLeft.bindingKey() == key {
+		if pressed {
+			c.switchBank(-1)
+		}
+		return true
+	}
+	if c.BankRight != nil && c.BankRight.bindingKey() == key {
+		if pressed {
+			c.switchBank(1)
+		}
+		return true
+	}
+
+	for i, layer := range c.Layers {
+		if layer.Button == nil || layer.Button.bindingKey() != key {
+			continue
+		}
+
+		switch {
+		case layer.Shift && pressed:
+			c.setLayer(c.layer, i)
+		case layer.Shift && c.shift == i:
+			// Letting go of a shift button only ends its own layer,
+			// not one held with another button since.
+			c.setLayer(c.layer, noLayer)
+		case pressed && !layer.Shift:
+			c.setLayer(i, c.shift)
+		}
+		return true
+	}
+	return false
+}
+
+// switchBank moves to the next or previous layer that isn't a shift layer,
+// wrapping around at the ends.
+func (c *MidiClient) switchBank(step int) {
+	for i := 1; i <= len(c.Layers); i++ {
+		next := ((c.layer+step*i)%len(c.Layers) + len(c.Layers)) % len(c.Layers)
+		if !c.Layers[next].Shift {
+			c.setLayer(next, c.shift)
+			return
+		}
+	}
+}
+
+// setLayer changes the active layer and shift layer. The controls now map to
+// different targets, so soft takeover starts over and the LEDs are updated.
+func (c *MidiClient) setLayer(layer int, shift int) {
+	c.mu.Lock()
+	changed := c.layer != layer || c.shift != shift
+	c.layer = layer
+	c.shift = shift
+	c.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	if active := c.activeLayer(); active != noLayer {
+		log.Info().Msgf("Switched to layer %s", c.Layers[active].Name)
+	}
+	c.pickups = nil
+	c.syncFeedback()
+}
+
+// activeLayer returns the index of the layer whose mappings are in use.
+func (c *MidiClient) activeLayer() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.shift != noLayer {
+		return c.shift
+	}
+	return c.layer
+}
+
+// firstLayer returns the layer that is active at startup, the first one that
+// isn't a shift layer.
+func firstLayer(layers []Layer) int {
+	for i, layer := range layers {
+		if !layer.Shift {
+			return i
+		}
+	}
+	return noLayer
+}
@@ -0,0 +1,457 @@
+package pamidicontrol
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// learnQuietTime is how long a control has to stop moving before learning it
+// finishes.
+const learnQuietTime = 2 * time.Second
+
+// learnedControl describes a control that was moved while learning.
+type learnedControl struct {
+	ActionType MidiActionType
+	Channel    uint8
+	Controller uint8
+
+	Min    uint16
+	Max    uint16
+	Inputs int
+
+	Relative RelativeEncoding
+	Button   bool
+}
+
+func (l learnedControl) String() string {
+	kind := "fader or knob"
+	switch {
+	case l.Button:
+		kind = "button"
+	case l.Relative != Absolute:
+		kind = fmt.Sprintf("relative encoder (%s)", l.Relative)
+	case l.ActionType == PitchBend:
+		kind = "pitch bend fader"
+	}
+
+	if l.ActionType == PitchBend {
+		return fmt.Sprintf("%s on Channel %d, values %d to %d", kind, l.Channel, l.Min, l.Max)
+	}
+	return fmt.Sprintf("%s (%s) on Channel %d, Controller %d, values %d to %d", kind, l.ActionType, l.Channel, l.Controller, l.Min, l.Max)
+}
+
+// MidiAction returns a mapping for the control that runs action.
+func (l learnedControl) MidiAction(action PulseAudioAction) MidiAction {
+	maxInputValue := uint(l.Max)
+	if l.Relative != Absolute {
+		// Step through the whole range in 100 clicks.
+		maxInputValue = 100
+	} else if maxInputValue == 0 {
+		maxInputValue = l.ActionType.MaxValue()
+	}
+
+	return MidiAction{
+		ActionType:    l.ActionType,
+		Channel:       l.Channel,
+		Controller:    l.Controller,
+		MaxInputValue: maxInputValue,
+		Relative:      l.Relative,
+		Action:        action,
+	}
+}
+
+// detectControl works out what kind of control sent inputs, which must all
+// come from the same control.
+func detectControl(inputs []midiInput) learnedControl {
+	first := inputs[0]
+	l := learnedControl{
+		ActionType: first.ActionType,
+		Channel:    first.Channel,
+		Controller: first.Controller,
+		Min:        first.Value,
+		Max:        first.Value,
+		Inputs:     len(inputs),
+	}
+
+	distinct := make(map[uint16]bool, 0)
+	for _, input := range inputs {
+		distinct[input.Value] = true
+		if input.Value < l.Min {
+			l.Min = input.Value
+		}
+		if input.Value > l.Max {
+			l.Max = input.Value
+		}
+	}
+
+	if l.ActionType == Note {
+		l.Button = true
+		return l
+	}
+
+	if l.ActionType == PitchBend {
+		return l
+	}
+
+	// Buttons only ever send off and a single on value. An encoder turned
+	// one way also repeats a single value, but never sends off, so a lone
+	// value only makes a button if it was sent once.
+	if l.Max >= 64 && ((len(distinct) == 2 && l.Min == 0) || len(inputs) == 1) {
+		l.Button = true
+		return l
+	}
+
+	// Encoders repeat a handful of small step values while faders sweep
+	// through many distinct positions.
+	if len(distinct) <= 4 && len(inputs) >= 2*len(distinct) {
+		l.Relative = detectRelativeEncoding(distinct)
+	}
+
+	return l
+}
+
+// detectRelativeEncoding works out the encoding of an encoder from the step
+// values it sent while being turned both ways.
+func detectRelativeEncoding(values map[uint16]bool) RelativeEncoding {
+	within := func(ranges ...[2]uint16) bool {
+		for value := range values {
+			ok := false
+			for _, r := range ranges {
+				if value >= r[0] && value <= r[1] {
+					ok = true
+				}
+			}
+			if !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	small := [2]uint16{1, 15}
+	switch {
+	case within(small, [2]uint16{113, 127}):
+		return TwosComplement
+	case within(small, [2]uint16{65, 79}) && !within([2]uint16{65, 79}):
+		return SignMagnitude
+	case within([2]uint16{49, 63}, [2]uint16{65, 79}):
+		return BinaryOffset
+	}
+	return Absolute
+}
+
+func runLearn(args []string) {
+	fs := newFlagSet("learn")
+	configPath := configFlag(fs)
+	inputName := fs.String("in", "", "name of the midi input to learn from (default InputMidiName from the configuration)")
+	fs.Parse(args)
+
+	path := *configPath
+	if path == "" {
+		path = DefaultConfigPath()
+	}
+
+	var c Config
+	if _, err := os.Stat(path); err == nil {
+		c = mustLoadConfig(path)
+	}
+
+	midiClient := &MidiClient{}
+	ins, outs, err := midiClient.ListDevices()
+	if err != nil {
+		panic(err)
+	}
+
+	devices := c.AllDevices()
+	name := *inputName
+	if name == "" {
+		if i, err := findPort("input", ins, devices[0].InputMidiName, devices[0].InputPort); err == nil {
+			name = ins[i]
+		}
+	}
+
+	if name == "" || !containsString(ins, name) {
+		fmt.Fprintf(os.Stderr, "A midi input must be given with -in. Possible values are:\n\n%s\n", strings.Join(ins, "\n"))
+		os.Exit(1)
+	}
+
+	index, ok := learnDevice(devices, ins, name)
+	if !ok {
+		index = addLearnDevice(path, &c, name, containsString(outs, name))
+	}
+	device := c.AllDevices()[index]
+
+	_, paclient := connectPulseAudio()
+
+	inputs := make(chan midiInput, 256)
+	closeInput, err := listenToInput(name, inputs)
+	if err != nil {
+		panic(err)
+	}
+	defer closeInput()
+
+	prompt := bufio.NewScanner(os.Stdin)
+	bound := boundControls(device)
+
+	for {
+		fmt.Printf("\nMove a control on %s through its whole range, turn an encoder both ways, or press a button.\n", name)
+		learned := learnControl(inputs)
+		fmt.Printf("Detected a %s\n", learned)
+
+		if bound[learned.MidiAction(PulseAudioAction{}).bindingKey()] {
+			fmt.Println("That control is already mapped in the configuration, skipping it.")
+		} else if action, ok := chooseAction(prompt, paclient, learned); ok {
+			midiAction := learned.MidiAction(action)
+
+			// Refer to the control by name when the controller has a
+			// preset, so the configuration is easier to read.
+			if preset, ok := device.ControllerPreset(); ok {
+				if control, ok := preset.ControlAt(midiAction); ok && control.Relative == midiAction.Relative {
+					midiAction = MidiAction{Control: control.Name, Action: action}
+				}
+			}
+			if err := AppendMidiActions(path, c.devicesIndex(index), midiAction); err != nil {
+				fmt.Fprintf(os.Stderr, "Could not add the mapping: %s\n", err)
+			} else {
+				bound[midiAction.bindingKey()] = true
+				fmt.Printf("Added the mapping to %s\n", path)
+			}
+		}
+
+		if !askYesNo(prompt, "Learn another control?") {
+			return
+		}
+	}
+}
+
+// learnDevice returns the index in devices of the device that reads from the
+// midi input name, out of the inputs ins.
+func learnDevice(devices []Device, ins []string, name string) (int, bool) {
+	for i, device := range devices {
+		if device.InputMidiName == "" && device.InputPort == nil {
+			continue
+		}
+		if j, err := findPort("input", ins, device.InputMidiName, device.InputPort); err == nil && ins[j] == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// addLearnDevice adds a device for the midi input name to the configuration
+// file at path and to c, returning its index in c.AllDevices(). The input is
+// given to the top level device when there is no other, or else added to
+// Devices. hasOutput is whether there is a midi output of the same name.
+func addLearnDevice(path string, c *Config, name string, hasOutput bool) int {
+	device := Device{InputMidiName: name}
+	if hasOutput {
+		device.OutputMidiName = name
+	}
+	top := len(c.Devices) == 0 && c.InputMidiName == "" && c.InputPort == nil
+
+	err := UpdateConfigFile(path, func(doc *yaml.Node) error {
+		if top {
+			setMappingValue(doc, "InputMidiName", stringNode(device.InputMidiName))
+			if device.OutputMidiName != "" {
+				setMappingValue(doc, "OutputMidiName", stringNode(device.OutputMidiName))
+			}
+			return nil
+		}
+
+		list := mappingValue(doc, "Devices")
+		if list == nil || list.Kind != yaml.SequenceNode {
+			list = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+			setMappingValue(doc, "Devices", list)
+		}
+		list.Style = 0
+		list.Content = append(list.Content, encodeConfigValue(reflect.ValueOf(device)))
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if top {
+		c.InputMidiName, c.OutputMidiName = device.InputMidiName, device.OutputMidiName
+		return 0
+	}
+	c.Devices = append(c.Devices, device)
+	return len(c.AllDevices()) - 1
+}
+
+// boundControls returns the controls of a device that are already mapped or
+// used to switch layers, which learn leaves alone.
+func boundControls(device Device) map[bindingKey]bool {
+	bound := make(map[bindingKey]bool, 0)
+	for _, action := range device.AllMidiActions() {
+		bound[action.bindingKey()] = true
+	}
+	for _, button := range []*Button{device.BankLeft, device.BankRight} {
+		if button != nil {
+			bound[button.bindingKey()] = true
+		}
+	}
+	for _, layer := range device.Layers {
+		if layer.Button != nil {
+			bound[layer.Button.bindingKey()] = true
+		}
+	}
+	return bound
+}
+
+// learnControl waits for a control to move and collects its inputs until it
+// has been still for learnQuietTime.
+func learnControl(inputs <-chan midiInput) learnedControl {
+	// Throw away anything received while waiting on the user.
+	for len(inputs) > 0 {
+		<-inputs
+	}
+
+	first := <-inputs
+	collected := []midiInput{first}
+
+	quiet := time.NewTimer(learnQuietTime)
+	defer quiet.Stop()
+
+	for {
+		select {
+		case input := <-inputs:
+			if input.bindingKey() != first.bindingKey() {
+				continue
+			}
+			collected = append(collected, input)
+			quiet.Reset(learnQuietTime)
+		case <-quiet.C:
+			return detectControl(collected)
+		}
+	}
+}
+
+// chooseAction asks which action and target a learned control should have.
+func chooseAction(prompt *bufio.Scanner, paclient *PAClient, learned learnedControl) (PulseAudioAction, bool) {
+	var action PulseAudioAction
+
+	actionTypes := []PulseAudioActionType{VolumeChange, Mute, Move}
+	defaultType := VolumeChange
+	if learned.Button {
+		defaultType = Mute
+	}
+
+	for i, actionType := range actionTypes {
+		fmt.Printf("  %d) %s\n", i+1, actionType)
+	}
+	choice, ok := askChoice(prompt, "Action", len(actionTypes), indexOf(actionTypes, defaultType))
+	if !ok {
+		return action, false
+	}
+	action.ActionType = actionTypes[choice]
+
+	if err := paclient.RefreshStreams(); err != nil {
+		panic(err)
+	}
+	targets, err := paclient.ListTargets()
+	if err != nil {
+		panic(err)
+	}
+
+	candidates := make([]Target, 0)
+	for _, target := range targets {
+		if action.ActionType == Move && target.TargetType != PlaybackStream && target.TargetType != RecordStream {
+			continue
+		}
+		if len(candidates) > 0 && candidates[len(candidates)-1].TargetType == target.TargetType && candidates[len(candidates)-1].TargetName == target.TargetName {
+			continue
+		}
+		candidates = append(candidates, target)
+	}
+
+	if len(candidates) == 0 {
+		fmt.Println("There is nothing in PulseAudio this action can be used on.")
+		return action, false
+	}
+
+	for i, target := range candidates {
+		fmt.Printf("  %d) %-15s %s\n", i+1, target.TargetType, target.TargetName)
+	}
+	choice, ok = askChoice(prompt, "Target", len(candidates), -1)
+	if !ok {
+		return action, false
+	}
+	action.TargetType = candidates[choice].TargetType
+	action.TargetName = candidates[choice].TargetName
+
+	if action.ActionType == Move {
+		deviceType := Sink
+		if action.TargetType == RecordStream {
+			deviceType = Source
+		}
+
+		devices := paclient.TargetNames(deviceType)
+		if len(devices) == 0 {
+			fmt.Printf("There is no %s to move to.\n", targetTypeName(deviceType))
+			return action, false
+		}
+
+		for i, device := range devices {
+			fmt.Printf("  %d) %s\n", i+1, device)
+		}
+		choice, ok = askChoice(prompt, "Move to", len(devices), -1)
+		if !ok {
+			return action, false
+		}
+		action.DeviceName = devices[choice]
+	}
+
+	return action, true
+}
+
+// askChoice asks for a number between 1 and count, returning its zero based
+// index. An empty answer picks defaultIndex when it isn't negative.
+func askChoice(prompt *bufio.Scanner, question string, count int, defaultIndex int) (int, bool) {
+	for {
+		if defaultIndex >= 0 {
+			fmt.Printf("%s [%d]: ", question, defaultIndex+1)
+		} else {
+			fmt.Printf("%s: ", question)
+		}
+
+		if !prompt.Scan() {
+			return 0, false
+		}
+
+		answer := strings.TrimSpace(prompt.Text())
+		if answer == "" && defaultIndex >= 0 {
+			return defaultIndex, true
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= count {
+			return n - 1, true
+		}
+		fmt.Printf("Enter a number between 1 and %d\n", count)
+	}
+}
+
+func askYesNo(prompt *bufio.Scanner, question string) bool {
+	fmt.Printf("%s [y/N]: ", question)
+	if !prompt.Scan() {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(prompt.Text()))
+	return answer == "y" || answer == "yes"
+}
+
+func indexOf(actionTypes []PulseAudioActionType, actionType PulseAudioActionType) int {
+	for i, t := range actionTypes {
+		if t == actionType {
+			return i
+		}
+	}
+	return -1
+}
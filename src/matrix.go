@@ -0,0 +1,233 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// GridLayout describes the pads of a grid controller, such as a Launchpad,
+// and the velocities that light them in each colour.
+type GridLayout struct {
+	// ActionType is Note or ControlChange, for both the pads and their
+	// LEDs.
+	ActionType MidiActionType
+	Channel    uint8
+
+	// Pads holds the note or controller of every pad, a row at a time from
+	// the top.
+	Pads [][]uint8
+
+	// RoutedColour lights the pads of the sinks or sources a stream is on,
+	// AvailableColour the others in the rows of running streams, and
+	// EmptyColour the pads without a stream or a device.
+	RoutedColour    uint8
+	AvailableColour uint8
+	EmptyColour     uint8
+}
+
+// columns returns the number of pads in the widest row.
+func (g GridLayout) columns() int {
+	columns := 0
+	for _, row := range g.Pads {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	return columns
+}
+
+// gridPads lays out rows of consecutive note numbers, starting with first at
+// the top left and moving by rowStep from one row to the next.
+func gridPads(first int, rowStep int, rows int, columns int) [][]uint8 {
+	pads := make([][]uint8, 0, rows)
+	for row := 0; row < rows; row++ {
+		notes := make([]uint8, 0, columns)
+		for column := 0; column < columns; column++ {
+			notes = append(notes, uint8(first+row*rowStep+column))
+		}
+		pads = append(pads, notes)
+	}
+	return pads
+}
+
+// Matrix shows which sink each application plays to on the pads of a grid
+// controller, with a row per stream and a column per sink. Pressing a pad
+// moves the stream of its row to the sink of its column.
+type Matrix struct {
+	// Streams is PlaybackStream to route applications to sinks, or
+	// RecordStream to route them from sources.
+	Streams PulseAudioTargetType
+
+	// Rows names the stream on each row, from the top. By default the
+	// running streams are shown, oldest first.
+	Rows []string
+	// Columns names the sink or source on each column, from the left. By
+	// default every one is shown, in alphabetical order.
+	Columns []string
+
+	// Grid describes the pads of the controller. It defaults to the grid of
+	// the preset.
+	Grid *GridLayout
+}
+
+// deviceType returns the type of the objects on the columns.
+func (m Matrix) deviceType() PulseAudioTargetType {
+	if m.Streams == RecordStream {
+		return Source
+	}
+	return Sink
+}
+
+// matrixBindings returns the controls taken by the pads of a grid, so they
+// can't also be mapped to MidiActions.
+func matrixBindings(grid GridLayout) map[bindingKey]string {
+	bindings := make(map[bindingKey]string, 0)
+	for row, pads := range grid.Pads {
+		for column, pad := range pads {
+			bindings[bindingKey{grid.ActionType, grid.Channel, pad}] = fmt.Sprintf("the pad on row %d, column %d", row+1, column+1)
+		}
+	}
+	return bindings
+}
+
+// routingMatrix drives the pads of a Matrix, keeping their colours in step
+// with the routing of the streams.
+type routingMatrix struct {
+	client *PAClient
+	out    *midiOutput
+	matrix Matrix
+
+	// mu guards lit, the colour last sent to each pad, so only the pads
+	// that change are sent again.
+	mu  sync.Mutex
+	lit map[uint8]uint8
+}
+
+func newRoutingMatrix(client *PAClient, out *midiOutput, matrix Matrix) *routingMatrix {
+	m := &routingMatrix{
+		client: client,
+		out:    out,
+		matrix: matrix,
+		lit:    make(map[uint8]uint8, 0),
+	}
+	client.AddListener(func(path dbus.ObjectPath) {
+		m.Sync()
+	})
+	return m
+}
+
+// shown returns the streams and devices on the rows and columns of the grid.
+func (m *routingMatrix) shown() (rows []string, columns []string) {
+	rows = m.matrix.Rows
+	if len(rows) == 0 {
+		if m.matrix.Streams == PlaybackStream {
+			rows = m.client.PlaybackStreamNames()
+		} else {
+			rows = m.client.TargetNames(RecordStream)
+		}
+	}
+	columns = m.matrix.Columns
+	if len(columns) == 0 {
+		columns = m.client.TargetNames(m.matrix.deviceType())
+	}
+
+	if len(rows) > len(m.matrix.Grid.Pads) {
+		rows = rows[:len(m.matrix.Grid.Pads)]
+	}
+	if len(columns) > m.matrix.Grid.columns() {
+		columns = columns[:m.matrix.Grid.columns()]
+	}
+	return rows, columns
+}
+
+// padAt returns the row and column of the pad an input comes from.
+func (m *routingMatrix) padAt(input midiInput) (int, int, bool) {
+	grid := m.matrix.Grid
+	if input.ActionType != grid.ActionType || input.Channel != grid.Channel {
+		return 0, 0, false
+	}
+	for row, pads := range grid.Pads {
+		for column, pad := range pads {
+			if pad == input.Controller {
+				return row, column, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
+// handleInput moves a stream when its pad is pressed. It returns false for
+// inputs that aren't from a pad, which are left to the MidiActions.
+func (m *routingMatrix) handleInput(input midiInput) bool {
+	row, column, ok := m.padAt(input)
+	if !ok {
+		return false
+	}
+	if input.Value == 0 {
+		return true
+	}
+
+	rows, columns := m.shown()
+	if row >= len(rows) || column >= len(columns) {
+		return true
+	}
+
+	action := PulseAudioAction{
+		TargetType: m.matrix.Streams,
+		TargetName: rows[row],
+		ActionType: Move,
+		DeviceName: columns[column],
+	}
+	if err := m.client.ProcessMoveAction(action); err != nil {
+		log.Warn().Err(err).Msgf("Could not move %s to %s", action.TargetName, action.DeviceName)
+	}
+	return true
+}
+
+// Sync lights every pad in the colour of the routing it shows.
+func (m *routingMatrix) Sync() {
+	rows, columns := m.shown()
+	grid := m.matrix.Grid
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for row, pads := range grid.Pads {
+		var routed []string
+		running := false
+		if row < len(rows) {
+			action := PulseAudioAction{TargetType: m.matrix.Streams, TargetName: rows[row]}
+			running = len(m.client.targetPaths(action)) > 0
+			routed = m.client.StreamDevices(action)
+		}
+
+		for column, pad := range pads {
+			colour := grid.EmptyColour
+			if running && column < len(columns) {
+				colour = grid.AvailableColour
+				if containsString(routed, columns[column]) {
+					colour = grid.RoutedColour
+				}
+			}
+
+			if lit, ok := m.lit[pad]; ok && lit == colour {
+				continue
+			}
+
+			var err error
+			if grid.ActionType == Note {
+				err = m.out.NoteOn(grid.Channel, pad, colour)
+			} else {
+				err = m.out.ControlChange(grid.Channel, pad, colour)
+			}
+			if err != nil {
+				log.Warn().Err(err).Msgf("Could not light the pad on row %d, column %d", row+1, column+1)
+				continue
+			}
+			m.lit[pad] = colour
+		}
+	}
+}
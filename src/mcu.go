@@ -0,0 +1,389 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// Protocol is a control surface protocol that pamidicontrol speaks on top of
+// the configured MidiActions.
+type Protocol string
+
+const (
+	// NoProtocol only uses the MidiActions.
+	NoProtocol Protocol = ""
+	// MackieControl drives the channel strips of a Mackie Control Universal
+	// compatible surface, such as a Behringer X-Touch or an Icon Platform M
+	// in MCU mode.
+	MackieControl Protocol = "MackieControl"
+)
+
+// Valid reports whether p is a known protocol.
+func (p Protocol) Valid() bool {
+	switch p {
+	case NoProtocol, MackieControl:
+		return true
+	}
+	return false
+}
+
+// Strip assigns a pulseaudio object to a channel strip of a control surface.
+type Strip struct {
+	TargetType PulseAudioTargetType
+	TargetName string
+
+	// Label is shown on the scribble strip instead of the TargetName.
+	Label string
+}
+
+// The messages of the eight channel strips of a Mackie Control surface. Each
+// strip uses the given note, controller or channel plus its index.
+const (
+	mcuStrips = 8
+
+	// The faders send and receive pitch bend on channels 0 to 7.
+	mcuVPotController = 16  // V-Pot turns, sign magnitude relative
+	mcuVPotRing       = 48  // V-Pot LED rings
+	mcuMuteNote       = 16  // mute buttons and their LEDs
+	mcuVPotPushNote   = 32  // V-Pot pushes
+	mcuTouchNote      = 104 // fader touch sensors
+)
+
+// mcuBalanceStep is how far one click of a V-Pot moves the balance.
+const mcuBalanceStep = 0.05
+
+// mcuLabelWidth is the number of characters in each cell of the scribble
+// strip. The last one is left blank to separate the strips.
+const mcuLabelWidth = 7
+
+// mcuSysExHeader starts every Mackie Control system exclusive message.
+var mcuSysExHeader = []byte{0xF0, 0x00, 0x00, 0x66, 0x14}
+
+// mcuSurface drives the channel strips of a Mackie Control surface, with
+// motor faders, V-Pots for the balance, mute buttons and scribble strips that
+// all follow the state of their pulseaudio objects.
+type mcuSurface struct {
+	client *PAClient
+	worker *volumeWorker
+	out    *midiOutput
+	// privacy keeps the mute buttons from unmuting sources while it is
+	// on. It is nil without a privacy mode.
+	privacy *privacyMode
+
+	// mu guards strips, which change when they are assigned automatically,
+	// and touched.
+	mu     sync.Mutex
+	strips []Strip
+	// touched is set while a finger is on a fader, so the motor doesn't
+	// fight it.
+	touched [mcuStrips]bool
+}
+
+func newMCUSurface(client *PAClient, worker *volumeWorker, out *midiOutput, privacy *privacyMode, strips []Strip) *mcuSurface {
+	s := &mcuSurface{
+		client:  client,
+		worker:  worker,
+		out:     out,
+		privacy: privacy,
+		strips:  strips,
+	}
+	client.AddListener(s.objectChanged)
+	return s
+}
+
+// action returns the action of the given type for the object on a strip. ok
+// is false for strips without an object.
+func (s *mcuSurface) action(strip int, actionType PulseAudioActionType) (PulseAudioAction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strip >= len(s.strips) {
+		return PulseAudioAction{}, false
+	}
+	return PulseAudioAction{
+		TargetType: s.strips[strip].TargetType,
+		TargetName: s.strips[strip].TargetName,
+		ActionType: actionType,
+	}, true
+}
+
+// SetStrips changes the objects on the strips and updates the surface to show
+// them. It returns false if the strips were already the same.
+func (s *mcuSurface) SetStrips(strips []Strip) bool {
+	s.mu.Lock()
+	if len(strips) == len(s.strips) {
+		same := true
+		for i := range strips {
+			same = same && strips[i] == s.strips[i]
+		}
+		if same {
+			s.mu.Unlock()
+			return false
+		}
+	}
+	s.strips = strips
+	s.mu.Unlock()
+
+	s.Sync()
+	return true
+}
+
+// handleInput runs the strip control an input comes from. It returns false
+// for inputs that aren't part of a strip with an object, which are left to the
+// MidiActions.
+func (s *mcuSurface) handleInput(input midiInput) bool {
+	switch input.ActionType {
+	case PitchBend:
+		if input.Channel >= mcuStrips {
+			return false
+		}
+		action, ok := s.action(int(input.Channel), VolumeChange)
+		if !ok {
+			return false
+		}
+		volume := float32(input.Value) / float32(PitchBend.MaxValue())
+		s.worker.Set(action, volume, input.received)
+		return true
+
+	case ControlChange:
+		strip, ok := s.stripOf(input, mcuVPotController)
+		if !ok {
+			return false
+		}
+		action, ok := s.action(strip, VolumeChange)
+		if !ok {
+			return false
+		}
+		tracked, ok, err := s.client.TrackedVolume(action)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not read the volume of strip %d", strip+1)
+			return true
+		}
+		if ok {
+			balance := tracked.Balance + float32(SignMagnitude.Delta(uint8(input.Value)))*mcuBalanceStep
+			if err := s.client.SetBalance(action, clampBalance(balance)); err != nil {
+				log.Warn().Err(err).Msgf("Could not set the balance of strip %d", strip+1)
+			}
+		}
+		return true
+
+	case Note:
+		pressed := input.Value > 0
+
+		if strip, ok := s.stripOf(input, mcuMuteNote); ok {
+			action, ok := s.action(strip, Mute)
+			if !ok {
+				return false
+			}
+			if !pressed {
+				return true
+			}
+			if s.privacy != nil && s.privacy.guards(action.TargetType) {
+				log.Info().Msgf("Leaving %s [%s] muted, as privacy mode is on", targetTypeName(action.TargetType), action.TargetName)
+				return true
+			}
+			if _, err := s.client.ToggleMuteAction(action); err != nil {
+				log.Warn().Err(err).Msgf("Could not mute strip %d", strip+1)
+			}
+			return true
+		}
+
+		if strip, ok := s.stripOf(input, mcuVPotPushNote); ok {
+			action, ok := s.action(strip, VolumeChange)
+			if !ok {
+				return false
+			}
+			if pressed {
+				if err := s.client.SetBalance(action, 0); err != nil {
+					log.Warn().Err(err).Msgf("Could not centre the balance of strip %d", strip+1)
+				}
+			}
+			return true
+		}
+
+		if strip, ok := s.stripOf(input, mcuTouchNote); ok {
+			// The touch is kept track of even without an object, so a
+			// strip that gets one while touched isn't left touched.
+			s.mu.Lock()
+			s.touched[strip] = pressed
+			s.mu.Unlock()
+
+			_, ok := s.action(strip, VolumeChange)
+			// The fader may have been left away from the volume, so
+			// put it back once it's let go.
+			if ok && !pressed {
+				s.updateStrip(strip)
+			}
+			return ok
+		}
+	}
+	return false
+}
+
+// stripOf returns the strip of an input that uses the controller or note
+// numbers starting at first.
+func (s *mcuSurface) stripOf(input midiInput, first uint8) (int, bool) {
+	if input.Channel != 0 || input.Controller < first {
+		return 0, false
+	}
+	strip := int(input.Controller - first)
+	if strip >= mcuStrips {
+		return 0, false
+	}
+	return strip, true
+}
+
+// objectChanged updates the strips showing the object at path, or every strip
+// when the objects have been refreshed.
+func (s *mcuSurface) objectChanged(path dbus.ObjectPath) {
+	for i := 0; i < mcuStrips; i++ {
+		action, ok := s.action(i, VolumeChange)
+		if ok && (path == "" || containsPath(s.client.targetPaths(action), path)) {
+			s.updateStrip(i)
+		}
+	}
+}
+
+// Sync sends the state of every strip to the surface.
+func (s *mcuSurface) Sync() {
+	for i := 0; i < mcuStrips; i++ {
+		s.updateStrip(i)
+	}
+}
+
+// updateStrip moves the fader and sets the LEDs and scribble strip of a strip
+// to the state of its object.
+// Strips without an object are blanked.
+func (s *mcuSurface) updateStrip(strip int) {
+	strip8 := uint8(strip)
+
+	s.mu.Lock()
+	var label string
+	if strip < len(s.strips) {
+		label = s.strips[strip].Label
+		if label == "" {
+			label = s.strips[strip].TargetName
+		}
+	}
+	touched := s.touched[strip]
+	s.mu.Unlock()
+
+	var tracked TrackedVolume
+	status := ""
+	if action, ok := s.action(strip, VolumeChange); ok {
+		var err error
+		tracked, ok, err = s.client.TrackedVolume(action)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not read the volume of strip %d", strip+1)
+			return
+		}
+
+		status = "--"
+		if ok {
+			status = fmt.Sprintf("%.0f%%", tracked.Volume*100)
+			if tracked.Muted {
+				status = "MUTE"
+			}
+		}
+	}
+
+	var errs []error
+	if !touched {
+		value := uint16(math.Round(float64(tracked.Volume) * float64(PitchBend.MaxValue())))
+		if value > uint16(PitchBend.MaxValue()) {
+			value = uint16(PitchBend.MaxValue())
+		}
+		errs = append(errs, s.out.PitchBend(strip8, value))
+	}
+
+	mute := uint8(0)
+	if tracked.Muted {
+		mute = 127
+	}
+	// A value of zero turns the whole ring off.
+	ring := uint8(0)
+	if status != "" {
+		ring = vPotRingValue(tracked.Balance)
+	}
+	errs = append(errs,
+		s.out.NoteOn(0, mcuMuteNote+strip8, mute),
+		s.out.ControlChange(0, mcuVPotRing+strip8, ring),
+		s.out.SysEx(mcuScribble(strip, 0, label)),
+		s.out.SysEx(mcuScribble(strip, 1, status)),
+	)
+
+	for _, err := range errs {
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not update strip %d", strip+1)
+			return
+		}
+	}
+}
+
+// vPotRingValue lights the LED of a V-Pot ring that shows the balance, with
+// the middle of its eleven LEDs for the centre.
+func vPotRingValue(balance float32) uint8 {
+	return 1 + uint8(math.Round(float64(clampBalance(balance)+1)*5))
+}
+
+// mcuScribble returns the message that writes text to the top (line 0) or
+// bottom (line 1) cell of a strip on the scribble strip.
+func mcuScribble(strip int, line int, text string) []byte {
+	cell := make([]byte, mcuLabelWidth)
+	for i := range cell {
+		cell[i] = ' '
+	}
+	for i, r := range []rune(text) {
+		if i == mcuLabelWidth-1 {
+			break
+		}
+		// The display only has the printable ASCII characters.
+		if r < 0x20 || r > 0x7E {
+			r = '?'
+		}
+		cell[i] = byte(r)
+	}
+
+	offset := byte(line*mcuStrips*mcuLabelWidth + strip*mcuLabelWidth)
+	msg := append([]byte{}, mcuSysExHeader...)
+	msg = append(msg, 0x12, offset)
+	msg = append(msg, cell...)
+	return append(msg, 0xF7)
+}
+
+func clampBalance(balance float32) float32 {
+	if balance < -1 {
+		return -1
+	}
+	if balance > 1 {
+		return 1
+	}
+	return balance
+}
+
+func containsPath(paths []dbus.ObjectPath, path dbus.ObjectPath) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// mcuBindings returns the controls taken by the strips of a Mackie Control
+// surface, so they can't also be mapped to MidiActions.
+func mcuBindings(strips int) map[bindingKey]string {
+	bindings := make(map[bindingKey]string, 0)
+	for i := uint8(0); i < uint8(strips); i++ {
+		bindings[bindingKey{PitchBend, i, 0}] = fmt.Sprintf("fader %d", i+1)
+		bindings[bindingKey{ControlChange, 0, mcuVPotController + i}] = fmt.Sprintf("V-Pot %d", i+1)
+		bindings[bindingKey{Note, 0, mcuMuteNote + i}] = fmt.Sprintf("mute button %d", i+1)
+		bindings[bindingKey{Note, 0, mcuVPotPushNote + i}] = fmt.Sprintf("V-Pot push %d", i+1)
+		bindings[bindingKey{Note, 0, mcuTouchNote + i}] = fmt.Sprintf("fader touch %d", i+1)
+	}
+	return bindings
+}
@@ -0,0 +1,341 @@
+package pamidicontrol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Meter shows the level of a sink, source or stream on the LEDs of a
+// controller, as an LED ring, a bar of buttons or pads, or the meter of a
+// Mackie Control channel strip.
+type Meter struct {
+	TargetType PulseAudioTargetType
+	TargetName string
+
+	// Control names a control of the preset whose LED ring shows the level.
+	// Otherwise the level is sent as a value from 0 to 127 to the
+	// Controller or note of ActionType on Channel.
+	Control    string
+	ActionType MidiActionType
+	Channel    uint8
+	Controller uint8
+
+	// Pads light a bar of buttons or pads, from the first one at the
+	// quietest level, with OnValue and OffValue sent as notes or controller
+	// values of ActionType on Channel.
+	Pads     []uint8
+	OnValue  uint8
+	OffValue uint8
+
+	// Strip shows the level on the meter of a channel strip of a Mackie
+	// Control surface, from 1.
+	Strip uint
+
+	// Range is the number of decibels below full scale shown by the
+	// meter, 60 by default.
+	Range float64
+	// Hold keeps a peak on the meter for a while before it decays.
+	Hold time.Duration
+	// Decay is how fast the meter falls after a peak, in decibels a
+	// second. It is 20 by default.
+	Decay float64
+	// Rate is how many times a second the meter is updated, 20 by default.
+	Rate uint
+}
+
+// The defaults of the meter settings.
+const (
+	defaultMeterRange = 60
+	defaultMeterDecay = 20
+	defaultMeterRate  = 20
+
+	// maxMeterRate keeps the meters from flooding the midi output.
+	maxMeterRate = 50
+)
+
+// meterClientName is the application name of the record streams of the
+// meters, so they can be told apart from the applications using a source.
+const meterClientName = "pamidicontrol"
+
+// meterSampleRate is the rate the monitored audio is recorded at. It only
+// needs to be high enough to catch the peaks.
+const meterSampleRate = 1000
+
+// mcuMeterSegments is the number of LEDs of a Mackie Control strip meter.
+const mcuMeterSegments = 12
+
+func (m Meter) rangeDB() float64 {
+	if m.Range > 0 {
+		return m.Range
+	}
+	return defaultMeterRange
+}
+
+func (m Meter) decay() float64 {
+	if m.Decay > 0 {
+		return m.Decay
+	}
+	return defaultMeterDecay
+}
+
+func (m Meter) rate() uint {
+	if m.Rate > 0 {
+		return m.Rate
+	}
+	return defaultMeterRate
+}
+
+// drivesLED reports whether the meter shows its level on the LED that
+// feedback sets.
+func (m Meter) drivesLED(feedback PresetFeedback) bool {
+	if m.Strip > 0 || m.ActionType != feedback.ActionType || m.Channel != feedback.Channel {
+		return false
+	}
+	if len(m.Pads) == 0 {
+		return m.Controller == feedback.Controller
+	}
+	for _, pad := range m.Pads {
+		if pad == feedback.Controller {
+			return true
+		}
+	}
+	return false
+}
+
+// level turns a peak in decibels into the fraction of the meter it lights.
+func (m Meter) level(peak float64) float64 {
+	level := (peak + m.rangeDB()) / m.rangeDB()
+	return math.Max(0, math.Min(1, level))
+}
+
+// errNoMonitor is returned when the target of a meter can't be recorded,
+// usually because it doesn't exist at the moment.
+var errNoMonitor = errors.New("nothing to monitor")
+
+// monitorArgs returns the arguments to parec that record what the target of
+// an action is playing or recording. Sinks are recorded through their monitor
+// source and playback streams on their own, through the monitor of their
+// sink. Record streams show the source they record from.
+func (c *PAClient) monitorArgs(action PulseAudioAction) ([]string, error) {
+	paths := c.targetPaths(action)
+	if len(paths) == 0 {
+		return nil, errNoMonitor
+	}
+	path := paths[0]
+
+	var source string
+	switch action.TargetType {
+	case Sink:
+		monitor, err := c.Device(path).ObjectPath("MonitorSource")
+		if err != nil {
+			return nil, err
+		}
+		if source, err = c.Device(monitor).String("Name"); err != nil {
+			return nil, err
+		}
+
+	case Source:
+		var err error
+		if source, err = c.Device(path).String("Name"); err != nil {
+			return nil, err
+		}
+
+	case PlaybackStream:
+		index, err := c.Stream(path).Uint32("Index")
+		if err != nil {
+			return nil, err
+		}
+		return []string{"--monitor-stream=" + strconv.FormatUint(uint64(index), 10)}, nil
+
+	case RecordStream:
+		c.mu.RLock()
+		device, ok := c.streamDevices[path]
+		c.mu.RUnlock()
+		if !ok {
+			return nil, errNoMonitor
+		}
+		var err error
+		if source, err = c.Device(device).String("Name"); err != nil {
+			return nil, err
+		}
+	}
+
+	return []string{"--device=" + source}, nil
+}
+
+// levelMeter records the target of a Meter and shows its peaks.
+type levelMeter struct {
+	client *PAClient
+	out    *midiOutput
+	meter  Meter
+
+	// peak is the level shown, in decibels, and held the time until which
+	// it is kept before decaying.
+	peak    float64
+	held    time.Time
+	updated time.Time
+
+	// sent is the value last shown, so only changes are sent.
+	sent int
+}
+
+// startMeters records the target of every meter in the background.
+func (c *MidiClient) startMeters() {
+	for _, meter := range c.Meters {
+		m := &levelMeter{
+			client: c.PAClient,
+			out:    c.output,
+			meter:  meter,
+			peak:   math.Inf(-1),
+			sent:   -1,
+		}
+		go m.run()
+	}
+}
+
+// run records the target of the meter whenever it exists, checking again
+// every second when it doesn't.
+func (m *levelMeter) run() {
+	action := PulseAudioAction{TargetType: m.meter.TargetType, TargetName: m.meter.TargetName}
+
+	for {
+		args, err := m.client.monitorArgs(action)
+		if err == nil {
+			err = m.monitor(args)
+			if errors.Is(err, exec.ErrNotFound) {
+				log.Error().Err(err).Msg("Meters need parec, which comes with the pulseaudio utilities")
+				return
+			}
+		}
+		if err != nil && err != errNoMonitor {
+			log.Debug().Err(err).Msgf("Could not monitor %s %s", targetTypeName(action.TargetType), action.TargetName)
+		}
+
+		m.peak = math.Inf(-1)
+		m.show(0)
+		time.Sleep(time.Second)
+	}
+}
+
+// monitor runs parec with the given arguments until it stops, which happens
+// when the recorded object goes away.
+func (m *levelMeter) monitor(args []string) error {
+	args = append([]string{
+		"--raw",
+		"--format=float32le",
+		"--channels=1",
+		fmt.Sprintf("--rate=%d", meterSampleRate),
+		fmt.Sprintf("--latency-msec=%d", 1000/m.meter.rate()),
+		"--client-name=" + meterClientName,
+		"--stream-name=Meter " + m.meter.TargetName,
+	}, args...)
+
+	cmd := exec.Command("parec", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// Each read holds the samples between two updates.
+	samples := make([]byte, 4*(meterSampleRate/int(m.meter.rate())))
+	for {
+		if _, err := io.ReadFull(stdout, samples); err != nil {
+			return err
+		}
+		m.update(peakOf(samples), time.Now())
+	}
+}
+
+// peakOf returns the loudest of a block of float samples, in decibels below
+// full scale.
+func peakOf(samples []byte) float64 {
+	peak := 0.0
+	for i := 0; i+4 <= len(samples); i += 4 {
+		sample := math.Float32frombits(binary.LittleEndian.Uint32(samples[i:]))
+		peak = math.Max(peak, math.Abs(float64(sample)))
+	}
+	return 20 * math.Log10(peak)
+}
+
+// update shows a new peak, or lets the meter fall towards it once the last
+// peak has been held for long enough.
+func (m *levelMeter) update(peak float64, now time.Time) {
+	elapsed := now.Sub(m.updated).Seconds()
+	m.updated = now
+
+	switch {
+	case peak >= m.peak:
+		m.peak = peak
+		m.held = now.Add(m.meter.Hold)
+	case now.After(m.held):
+		m.peak = math.Max(peak, m.peak-m.meter.decay()*elapsed)
+	}
+	m.show(m.meter.level(m.peak))
+}
+
+// show lights the LEDs of the meter for a level between 0 and 1.
+func (m *levelMeter) show(level float64) {
+	meter := m.meter
+	var err error
+
+	switch {
+	case meter.Strip > 0:
+		// The meters of a Mackie Control surface fall by themselves, so
+		// they are sent every time while there is something to show.
+		segments := int(math.Round(level * mcuMeterSegments))
+		if segments == 0 && m.sent == 0 {
+			return
+		}
+		m.sent = segments
+		err = m.out.ChannelPressure(0, uint8(meter.Strip-1)<<4|uint8(segments))
+
+	case len(meter.Pads) > 0:
+		lit := int(math.Round(level * float64(len(meter.Pads))))
+		if lit == m.sent {
+			return
+		}
+		for i, pad := range meter.Pads {
+			value := meter.OffValue
+			if i < lit {
+				value = meter.OnValue
+			}
+			if err = m.send(pad, value); err != nil {
+				break
+			}
+		}
+		m.sent = lit
+
+	default:
+		value := int(math.Round(level * 127))
+		if value == m.sent {
+			return
+		}
+		m.sent = value
+		err = m.send(meter.Controller, uint8(value))
+	}
+
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not show the meter of %s", meter.TargetName)
+	}
+}
+
+// send sends a value to a note or controller of the meter.
+func (m *levelMeter) send(controller uint8, value uint8) error {
+	if m.meter.ActionType == Note {
+		return m.out.NoteOn(m.meter.Channel, controller, value)
+	}
+	return m.out.ControlChange(m.meter.Channel, controller, value)
+}
@@ -1,6 +1,10 @@
 package pamidicontrol
 
 import (
+	"os"
+	"sync"
+	"time"
+
 	"github.com/rs/zerolog/log"
 	"gitlab.com/gomidi/midi"
 	"gitlab.com/gomidi/midi/midimessage/channel"
@@ -13,6 +17,81 @@ type MidiClient struct {
 	MidiActions    []MidiAction
 	InputMidiName  string
 	OutputMidiName string
+	InputPort      *PortMatch
+	OutputPort     *PortMatch
+
+	// Setup configures the controller when its ports are opened.
+	Setup *ControllerSetup
+
+	// Protocol and Strips set up the channel strips of a control surface.
+	Protocol Protocol
+	Strips   []Strip
+
+	// AutoAssign hands out strips to the applications that are playing.
+	AutoAssign *AutoAssign
+
+	// Matrix routes streams with the pads of a grid controller.
+	Matrix *Matrix
+
+	// Meters show levels on the LEDs of the controller.
+	Meters []Meter
+
+	// Privacy lights the microphone indicator and switches privacy mode.
+	Privacy *Privacy
+
+	// DoseIndicator blinks once the daily listening exposure is exceeded.
+	DoseIndicator *Button
+
+	Layers    []Layer
+	BankLeft  *Button
+	BankRight *Button
+
+	// Preset is the layout of the controller, used to light its LEDs.
+	Preset *ControllerPreset
+
+	// ScenesFile is where the scenes recalled by RecallScene actions are
+	// saved.
+	ScenesFile string
+
+	// StateFile is where the last value of every mapping is saved.
+	StateFile string
+
+	// state, worker and privacy are shared by the clients of every device.
+	// They are created by Run if they haven't been set. safety is shared
+	// too, and nil without Safety settings.
+	state   *controllerState
+	worker  *volumeWorker
+	privacy *privacyMode
+	safety  *safetyLimiter
+
+	// mu guards the automatically assigned actions, which change as
+	// applications come and go, and the active layers.
+	mu         sync.Mutex
+	assigned   []MidiAction
+	assignment []string
+	layer      int
+	shift      int
+
+	// dispatch holds the mappings of each layer by control, after the top
+	// level ones, and assignedDispatch the ones assigned automatically.
+	dispatch         []dispatchTable
+	assignedDispatch dispatchTable
+
+	// pickups holds the soft takeover state of each mapping that uses it.
+	pickups map[MidiAction]*pickupState
+
+	// output sends feedback to the controller.
+	output *midiOutput
+
+	// feedbackMu guards fed, the value last sent to the LED of each
+	// control.
+	feedbackMu sync.Mutex
+	fed        map[bindingKey]uint8
+
+	// surface is the control surface driven by the Protocol, if any.
+	surface *mcuSurface
+	// matrix drives the pads of the Matrix, if any.
+	matrix *routingMatrix
 }
 
 func (c *MidiClient) ListDevices() ([]string, []string, error) {
@@ -48,6 +127,37 @@ func (c *MidiClient) ListDevices() ([]string, []string, error) {
 	return inNames, outNames, nil
 }
 
+// listenToInput opens the named midi input and sends every control input it
+// receives to inputs until the returned function is called to close it.
+func listenToInput(name string, inputs chan<- midiInput) (func(), error) {
+	drv, err := driver.New()
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := midi.OpenIn(drv, -1, name)
+	if err != nil {
+		drv.Close()
+		return nil, err
+	}
+
+	rd := reader.New(
+		reader.NoLogger(),
+		reader.Each(func(pos *reader.Position, msg midi.Message) {
+			if input, ok := toMidiInput(msg); ok {
+				inputs <- input
+			}
+		}),
+	)
+	go rd.ListenTo(in)
+
+	return func() {
+		in.StopListening()
+		in.Close()
+		drv.Close()
+	}, nil
+}
+
 func (c *MidiClient) Run() {
 	drv, err := driver.New()
 	if err != nil {
@@ -67,22 +177,30 @@ func (c *MidiClient) Run() {
 		panic(err)
 	}
 
-	var in midi.In
-	var out midi.Out
-
+	inNames := make([]string, 0, len(ins))
 	for _, port := range ins {
 		log.Info().Msgf("Found input midi device: %s", port.String())
-		if port.String() == c.InputMidiName {
-			in = port
-		}
+		inNames = append(inNames, port.String())
 	}
 
+	outNames := make([]string, 0, len(outs))
 	for _, port := range outs {
 		log.Info().Msgf("Found output midi device: %s", port.String())
-		if port.String() == c.OutputMidiName {
-			out = port
-		}
+		outNames = append(outNames, port.String())
+	}
+
+	inIndex, err := findPort("input", inNames, c.InputMidiName, c.InputPort)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		os.Exit(1)
+	}
+	outIndex, err := findPort("output", outNames, c.OutputMidiName, c.OutputPort)
+	if err != nil {
+		log.Error().Msg(err.Error())
+		os.Exit(1)
 	}
+	in, out := ins[inIndex], outs[outIndex]
+	log.Info().Msgf("Using input %s and output %s", in, out)
 
 	if err := in.Open(); err != nil {
 		panic(err)
@@ -95,33 +213,52 @@ func (c *MidiClient) Run() {
 	defer in.Close()
 	defer out.Close()
 
+	// The controller is asked for its identity and set up over the open
+	// ports, before they are listened to.
+	if c.Preset == nil {
+		c.Preset, _ = FindPreset(in.String())
+	}
+	if c.Preset == nil && c.Protocol == NoProtocol {
+		c.detectController(in, out)
+	}
+	c.setupController(in, out)
+
+	if c.state == nil {
+		c.state = mustLoadControllerState(c.StateFile)
+	}
+
+	if c.worker == nil {
+		c.worker = newVolumeWorker(c.PAClient, 0)
+	}
+	if c.privacy == nil {
+		c.privacy = newPrivacyMode(c.PAClient)
+	}
+
+	c.compileDispatch()
+	c.output = newMidiOutput(out)
+	c.layer = firstLayer(c.Layers)
+	c.shift = noLayer
+
+	if c.Protocol == MackieControl {
+		c.surface = newMCUSurface(c.PAClient, c.worker, c.output, c.privacy, c.Strips)
+		c.surface.Sync()
+	}
+	if c.Matrix != nil {
+		c.matrix = newRoutingMatrix(c.PAClient, c.output, *c.Matrix)
+		c.matrix.Sync()
+	}
+	if c.AutoAssign != nil {
+		c.startAutoAssign(c.output)
+	}
+	c.startFeedback()
+	c.startMeters()
+	c.startDoseIndicator()
+
 	rd := reader.New(
 		reader.NoLogger(),
 		reader.Each(func(pos *reader.Position, msg midi.Message) {
-			switch midiMessage := msg.(type) {
-			case channel.ControlChange:
-				for _, action := range c.MidiActions {
-					if action.ActionType != ControlChange {
-						continue
-					}
-
-					if action.Channel != midiMessage.Channel() {
-						continue
-					}
-
-					if action.Controller != midiMessage.Controller() {
-						continue
-					}
-
-					perc := float32(midiMessage.Value()) / float32(action.MaxInputValue)
-
-					if action.Action.ActionType == VolumeChange {
-						if err := c.PAClient.ProcessVolumeAction(action.Action, perc); err != nil {
-							panic(err)
-						}
-					}
-				}
-				log.Info().Msgf("Saw ControlChange input on Channel %d, Controller %d, with value %d", midiMessage.Channel(), midiMessage.Controller(), midiMessage.Value())
+			if input, ok := toMidiInput(msg); ok {
+				c.handleInput(input)
 			}
 		}),
 	)
@@ -131,3 +268,258 @@ func (c *MidiClient) Run() {
 	}
 	rd.ListenTo(in)
 }
+
+// handleInput runs every action mapped to the control an input came from.
+func (c *MidiClient) handleInput(input midiInput) {
+	if c.surface != nil && c.surface.handleInput(input) {
+		return
+	}
+	if c.matrix != nil && c.matrix.handleInput(input) {
+		return
+	}
+	if c.handleLayerButton(input) {
+		return
+	}
+	if c.handlePrivacyButton(input) {
+		return
+	}
+
+	for _, action := range c.dispatchActions(input) {
+		pressed := input.Value > 0
+
+		if action.Action.ActionType == VolumeChange {
+			perc, err := c.inputVolume(action, input)
+			if err != nil {
+				panic(err)
+			}
+
+			perc, ok, err := c.pickup(action, perc)
+			if err != nil {
+				panic(err)
+			}
+
+			if ok {
+				c.worker.Set(action.Action, perc, input.received)
+				c.state.setVolume(action, perc)
+			}
+		}
+
+		if action.Action.ActionType == Crossfade {
+			position, err := c.inputVolume(action, input)
+			if err != nil {
+				panic(err)
+			}
+
+			a, b := crossfadeVolumes(action.Action, position)
+			c.worker.SetTogether(action.Action.targets(), []float32{a, b}, input.received)
+		}
+
+		// Buttons send their maximum value when pressed and zero
+		// when released, so only act on the press.
+		if action.Action.ActionType == Mute && pressed && c.keepMuted(action.Action.TargetType) {
+			log.Info().Msgf("Leaving %s [%s] muted, as privacy mode is on", targetTypeName(action.Action.TargetType), action.Action.TargetName)
+		} else if action.Action.ActionType == Mute && pressed {
+			if action.Action.Ramp > 0 {
+				// The ramp remembers the mute state once it is set.
+				if err := c.toggleMuteRamp(action.Action, input.received); err != nil {
+					panic(err)
+				}
+			} else {
+				exists := len(c.PAClient.targetPaths(action.Action)) > 0
+				muted, err := c.PAClient.ToggleMuteAction(action.Action)
+				if err != nil {
+					panic(err)
+				}
+				if exists {
+					c.state.setMute(action.Action, muted)
+				}
+			}
+		}
+
+		if action.Action.ActionType == Move && pressed {
+			if err := c.PAClient.ProcessMoveAction(action.Action); err != nil {
+				log.Warn().Err(err).Msg("Could not move stream")
+			}
+		}
+
+		if action.Action.ActionType == RecallScene && pressed {
+			c.recallScene(action.Action)
+		}
+	}
+	log.Info().Msgf("Saw %s input on Channel %d, Controller %d, with value %d", input.ActionType, input.Channel, input.Controller, input.Value)
+}
+
+// actions returns the mappings in use, followed by the ones assigned
+// automatically.
+func (c *MidiClient) actions() []MidiAction {
+	actions := c.configuredActions()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.assigned) == 0 {
+		return actions
+	}
+	return append(append([]MidiAction{}, actions...), c.assigned...)
+}
+
+// configuredActions returns the mappings of the active layer, and the top
+// level ones for the controls the layer doesn't map.
+func (c *MidiClient) configuredActions() []MidiAction {
+	layer := c.activeLayer()
+	if layer == noLayer {
+		return c.MidiActions
+	}
+	return layerActions(c.Layers[layer], c.MidiActions)
+}
+
+// layerActions returns the mappings of a layer, and the top level ones for
+// the controls the layer doesn't map.
+func layerActions(layer Layer, topLevel []MidiAction) []MidiAction {
+	actions := make([]MidiAction, 0, len(layer.MidiActions)+len(topLevel))
+	layered := make(map[bindingKey]bool, 0)
+	for _, action := range layer.MidiActions {
+		layered[action.bindingKey()] = true
+		actions = append(actions, action)
+	}
+	for _, action := range topLevel {
+		if !layered[action.bindingKey()] {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// recallScene recalls the scene of an action in the background, so the
+// controls keep working while it fades in. The volumes fade through the
+// worker, so moving the control of a target takes over its fade.
+func (c *MidiClient) recallScene(action PulseAudioAction) {
+	scenes, err := LoadScenes(c.ScenesFile)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not load the scenes from %s", c.ScenesFile)
+		return
+	}
+
+	scene, ok := scenes[action.Scene]
+	if !ok {
+		log.Warn().Msgf("There is no scene named [%s] in %s", action.Scene, c.ScenesFile)
+		return
+	}
+
+	log.Info().Msgf("Recalling scene %s", action.Scene)
+	received := time.Now()
+	go func() {
+		fades, err := c.PAClient.applyScene(scene, c.keepMuted)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not recall scene %s", action.Scene)
+			return
+		}
+		fadeScene(c.worker, fades, action.Fade, action.Curve, received)
+	}()
+}
+
+// inputVolume converts the value of an input into the volume it sets. Relative
+// encoders step the current volume of the target up or down.
+func (c *MidiClient) inputVolume(action MidiAction, input midiInput) (float32, error) {
+	if action.Relative == Absolute {
+		return float32(input.Value) / float32(action.MaxInputValue), nil
+	}
+
+	current, ok, err := c.PAClient.CurrentVolume(action.Action)
+	if err != nil || !ok {
+		return 0, err
+	}
+	if pending, ok := c.worker.Pending(action.Action); ok {
+		current = pending
+	}
+
+	volume := current + float32(action.Relative.Delta(uint8(input.Value)))/float32(action.MaxInputValue)
+	if volume < 0 {
+		volume = 0
+	}
+	if volume > 1 {
+		volume = 1
+	}
+	return volume, nil
+}
+
+// pickup applies the soft takeover of a mapping to the volume a fader asks
+// for. ok is false if the fader hasn't picked up the volume of its target yet.
+func (c *MidiClient) pickup(action MidiAction, volume float32) (float32, bool, error) {
+	if action.Pickup == NoPickup {
+		return volume, true, nil
+	}
+
+	current, ok, err := c.PAClient.TrackedVolume(action.Action)
+	if err != nil || !ok {
+		return volume, ok, err
+	}
+
+	if c.pickups == nil {
+		c.pickups = make(map[MidiAction]*pickupState, 0)
+	}
+	state, ok := c.pickups[action]
+	if !ok {
+		state = &pickupState{}
+		c.pickups[action] = state
+	}
+
+	volume, ok = state.next(action.Pickup, volume, current)
+	if !ok {
+		log.Debug().Msgf("Ignoring %s until it reaches the current volume of %.0f%%", action, current.Volume*100)
+	}
+	return volume, ok, nil
+}
+
+// midiInput is a message from a midi control, reduced to the fields that
+// actions are matched on.
+type midiInput struct {
+	ActionType MidiActionType
+	Channel    uint8
+	Controller uint8
+	Value      uint16
+
+	// received is when the message arrived.
+	received time.Time
+}
+
+// toMidiInput converts a midi message into an input, if it comes from a
+// control that can be mapped.
+func toMidiInput(msg midi.Message) (midiInput, bool) {
+	now := time.Now()
+
+	switch m := msg.(type) {
+	case channel.ControlChange:
+		return midiInput{ControlChange, m.Channel(), m.Controller(), uint16(m.Value()), now}, true
+	case channel.NoteOn:
+		return midiInput{Note, m.Channel(), m.Key(), uint16(m.Velocity()), now}, true
+	case channel.NoteOff:
+		return midiInput{Note, m.Channel(), m.Key(), 0, now}, true
+	case channel.NoteOffVelocity:
+		return midiInput{Note, m.Channel(), m.Key(), 0, now}, true
+	case channel.Pitchbend:
+		return midiInput{PitchBend, m.Channel(), 0, m.AbsValue(), now}, true
+	case channel.ProgramChange:
+		// A program change has no release, so it is always a press.
+		return midiInput{ProgramChange, m.Channel(), m.Program(), 127, now}, true
+	}
+	return midiInput{}, false
+}
+
+// bindingKey identifies a single physical control.
+type bindingKey struct {
+	actionType MidiActionType
+	channel    uint8
+	controller uint8
+}
+
+func (i midiInput) bindingKey() bindingKey {
+	return bindingKey{i.ActionType, i.Channel, i.Controller}
+}
+
+func (a MidiAction) bindingKey() bindingKey {
+	if a.ActionType == PitchBend {
+		return bindingKey{a.ActionType, a.Channel, 0}
+	}
+	return bindingKey{a.ActionType, a.Channel, a.Controller}
+}
@@ -0,0 +1,17 @@
+package pamidicontrol
+
+import (
+	"gitlab.com/gomidi/midi"
+)
+
+// launchpadProgrammerMode switches a Launchpad X or Launchpad Mini MK3 to
+// programmer mode, where every pad sends a fixed note and is lit by the host.
+// model is the byte that names the Launchpad in its system exclusive
+// messages.
+type launchpadProgrammerMode struct {
+	model byte
+}
+
+func (l launchpadProgrammerMode) setup(in midi.In, out midi.Out, preset *ControllerPreset, options ControllerSetup) error {
+	return sendSysEx(out, []byte{0xF0, 0x00, 0x20, 0x29, 0x02, l.model, 0x0E, 0x01, 0xF7})
+}
@@ -1,6 +1,10 @@
 package pamidicontrol
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+
 	"github.com/godbus/dbus"
 	"github.com/rs/zerolog/log"
 	"github.com/sqp/pulseaudio"
@@ -9,19 +13,56 @@ import (
 type PAClient struct {
 	*pulseaudio.Client
 
+	// mu guards the indexes below, which are read by the midi client while
+	// pulseaudio signals update them.
+	mu sync.RWMutex
+
 	playbackStreamsByName map[string][]dbus.ObjectPath
 	recordStreamsByName   map[string][]dbus.ObjectPath
 	sourcesByName         map[string][]dbus.ObjectPath
 	sinksByName           map[string][]dbus.ObjectPath
+
+	// playbackStreamIndexes holds the index of the oldest stream of each
+	// application. Pulseaudio numbers objects in the order they are made.
+	playbackStreamIndexes map[string]uint32
+
+	// streamDevices holds the sink or source each stream plays to or
+	// records from.
+	streamDevices map[dbus.ObjectPath]dbus.ObjectPath
+	// monitorSources holds the sources that are the monitor of a sink.
+	monitorSources map[dbus.ObjectPath]bool
+	// playbackStreamProperties holds the property list of each playback
+	// stream.
+	playbackStreamProperties map[dbus.ObjectPath]map[string]string
+
+	volumes map[dbus.ObjectPath]*volumeState
+
+	// listeners are told about changes to the volume and mute state of
+	// objects.
+	listeners []func(path dbus.ObjectPath)
+
+	// objectListeners are told about objects that appear after the first
+	// refresh.
+	objectListeners []func(targetType PulseAudioTargetType, name string, path dbus.ObjectPath)
+	refreshed       bool
+
+	// limiter keeps the volumes of sinks within the safety settings, when
+	// there are any.
+	limiter *safetyLimiter
 }
 
 func NewPAClient(c *pulseaudio.Client) *PAClient {
 	client := &PAClient{
-		Client:                c,
-		playbackStreamsByName: make(map[string][]dbus.ObjectPath, 0),
-		recordStreamsByName:   make(map[string][]dbus.ObjectPath, 0),
-		sourcesByName:         make(map[string][]dbus.ObjectPath, 0),
-		sinksByName:           make(map[string][]dbus.ObjectPath, 0),
+		Client:                   c,
+		playbackStreamsByName:    make(map[string][]dbus.ObjectPath, 0),
+		playbackStreamIndexes:    make(map[string]uint32, 0),
+		streamDevices:            make(map[dbus.ObjectPath]dbus.ObjectPath, 0),
+		monitorSources:           make(map[dbus.ObjectPath]bool, 0),
+		playbackStreamProperties: make(map[dbus.ObjectPath]map[string]string, 0),
+		recordStreamsByName:      make(map[string][]dbus.ObjectPath, 0),
+		sourcesByName:            make(map[string][]dbus.ObjectPath, 0),
+		sinksByName:              make(map[string][]dbus.ObjectPath, 0),
+		volumes:                  make(map[dbus.ObjectPath]*volumeState, 0),
 	}
 	return client
 }
@@ -34,11 +75,49 @@ func (c *PAClient) PlaybackStreamRemoved(path dbus.ObjectPath) {
 	c.RefreshStreams()
 }
 
+func (c *PAClient) NewRecordStream(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+func (c *PAClient) RecordStreamRemoved(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+func (c *PAClient) NewSink(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+func (c *PAClient) SinkRemoved(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+func (c *PAClient) NewSource(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+func (c *PAClient) SourceRemoved(path dbus.ObjectPath) {
+	c.RefreshStreams()
+}
+
+// StreamDeviceUpdated is called when a stream is moved to another sink or
+// source.
+func (c *PAClient) StreamDeviceUpdated(path dbus.ObjectPath, device dbus.ObjectPath) {
+	c.mu.Lock()
+	c.streamDevices[path] = device
+	c.mu.Unlock()
+
+	c.notify(path)
+}
+
 func (c *PAClient) RefreshStreams() error {
 	playbackStreamsByName := make(map[string][]dbus.ObjectPath, 0)
+	playbackStreamIndexes := make(map[string]uint32, 0)
 	recordStreamsByName := make(map[string][]dbus.ObjectPath, 0)
 	sinksByName := make(map[string][]dbus.ObjectPath, 0)
 	sourcesByName := make(map[string][]dbus.ObjectPath, 0)
+	streamDevices := make(map[dbus.ObjectPath]dbus.ObjectPath, 0)
+	monitorSources := make(map[dbus.ObjectPath]bool, 0)
+	playbackStreamProperties := make(map[dbus.ObjectPath]map[string]string, 0)
 
 	streams, err := c.Core().ListPath("PlaybackStreams")
 	if err != nil {
@@ -52,12 +131,26 @@ func (c *PAClient) RefreshStreams() error {
 			return err
 		}
 
+		playbackStreamProperties[streamPath] = props
+
 		if applicationName, ok := props["application.name"]; ok {
 			if _, ok := playbackStreamsByName[applicationName]; ok {
 				playbackStreamsByName[applicationName] = append(playbackStreamsByName[applicationName], streamPath)
 			} else {
 				playbackStreamsByName[applicationName] = []dbus.ObjectPath{streamPath}
 			}
+
+			index, err := stream.Uint32("Index")
+			if err != nil {
+				return err
+			}
+			if oldest, ok := playbackStreamIndexes[applicationName]; !ok || index < oldest {
+				playbackStreamIndexes[applicationName] = index
+			}
+		}
+
+		if device, err := stream.ObjectPath("Device"); err == nil {
+			streamDevices[streamPath] = device
 		}
 	}
 
@@ -80,6 +173,10 @@ func (c *PAClient) RefreshStreams() error {
 				recordStreamsByName[applicationName] = []dbus.ObjectPath{streamPath}
 			}
 		}
+
+		if device, err := stream.ObjectPath("Device"); err == nil {
+			streamDevices[streamPath] = device
+		}
 	}
 
 	sinks, err := c.Core().ListPath("Sinks")
@@ -113,6 +210,10 @@ func (c *PAClient) RefreshStreams() error {
 			panic(err)
 		}
 
+		if props["device.class"] == "monitor" {
+			monitorSources[sourcePath] = true
+		}
+
 		if deviceDescription, ok := props["device.description"]; ok {
 			if _, ok := sourcesByName[deviceDescription]; ok {
 				sourcesByName[deviceDescription] = append(sourcesByName[deviceDescription], sourcePath)
@@ -122,72 +223,394 @@ func (c *PAClient) RefreshStreams() error {
 		}
 	}
 
+	c.mu.Lock()
+	appeared := c.appearedObjects(map[PulseAudioTargetType]map[string][]dbus.ObjectPath{
+		PlaybackStream: playbackStreamsByName,
+		RecordStream:   recordStreamsByName,
+		Sink:           sinksByName,
+		Source:         sourcesByName,
+	})
 	c.playbackStreamsByName = playbackStreamsByName
+	c.playbackStreamIndexes = playbackStreamIndexes
 	c.recordStreamsByName = recordStreamsByName
 	c.sinksByName = sinksByName
 	c.sourcesByName = sourcesByName
+	c.streamDevices = streamDevices
+	c.monitorSources = monitorSources
+	c.playbackStreamProperties = playbackStreamProperties
+	c.pruneVolumes()
+	objectListeners := c.objectListeners
+	c.mu.Unlock()
+
+	for _, object := range appeared {
+		for _, listener := range objectListeners {
+			listener(object.TargetType, object.TargetName, object.Path)
+		}
+	}
+
+	c.notify("")
 	return nil
 }
 
-func (c *PAClient) ProcessVolumeAction(action PulseAudioAction, volume float32) error {
-	pa100perc := 65535
-	newVol := uint32(volume * float32(pa100perc))
-
-	objs := make([]*pulseaudio.Object, 0)
+// appearedObjects returns the objects in the new indexes that weren't in the
+// current ones. Nothing has appeared on the first refresh. The caller must
+// hold c.mu.
+func (c *PAClient) appearedObjects(indexes map[PulseAudioTargetType]map[string][]dbus.ObjectPath) []Target {
+	appeared := make([]Target, 0)
+	if !c.refreshed {
+		c.refreshed = true
+		return appeared
+	}
 
-	if action.TargetType == Sink {
-		if sinkPaths, ok := c.sinksByName[action.TargetName]; ok {
-			for _, sinkPath := range sinkPaths {
-				objs = append(objs, c.Device(sinkPath))
+	known := make(map[dbus.ObjectPath]bool, 0)
+	for _, byName := range []map[string][]dbus.ObjectPath{c.sinksByName, c.sourcesByName, c.playbackStreamsByName, c.recordStreamsByName} {
+		for _, paths := range byName {
+			for _, path := range paths {
+				known[path] = true
 			}
 		}
 	}
 
-	if action.TargetType == Source {
-		if sourcePaths, ok := c.sourcesByName[action.TargetName]; ok {
-			for _, sourcePath := range sourcePaths {
-				objs = append(objs, c.Device(sourcePath))
+	for _, targetType := range []PulseAudioTargetType{Sink, Source, PlaybackStream, RecordStream} {
+		for name, paths := range indexes[targetType] {
+			for _, path := range paths {
+				if !known[path] {
+					appeared = append(appeared, Target{TargetType: targetType, TargetName: name, Path: path})
+				}
 			}
 		}
 	}
+	return appeared
+}
+
+// AddObjectListener registers a function that is called with every sink,
+// source or stream that appears.
+func (c *PAClient) AddObjectListener(listener func(targetType PulseAudioTargetType, name string, path dbus.ObjectPath)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.objectListeners = append(c.objectListeners, listener)
+}
+
+// objectsByName returns the index of objects of the given type.
+func (c *PAClient) objectsByName(targetType PulseAudioTargetType) map[string][]dbus.ObjectPath {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch targetType {
+	case Sink:
+		return c.sinksByName
+	case Source:
+		return c.sourcesByName
+	case PlaybackStream:
+		return c.playbackStreamsByName
+	case RecordStream:
+		return c.recordStreamsByName
+	}
+	return nil
+}
+
+// object returns the pulseaudio object at path, using the device interface
+// for sinks and sources and the stream interface for streams.
+func (c *PAClient) object(targetType PulseAudioTargetType, path dbus.ObjectPath) *pulseaudio.Object {
+	if targetType == Sink || targetType == Source {
+		return c.Device(path)
+	}
+	return c.Stream(path)
+}
+
+// targetPaths returns the object paths of the objects an action applies to.
+func (c *PAClient) targetPaths(action PulseAudioAction) []dbus.ObjectPath {
+	return c.objectsByName(action.TargetType)[action.TargetName]
+}
+
+// targetObjects resolves the pulseaudio objects an action applies to.
+func (c *PAClient) targetObjects(action PulseAudioAction) []*pulseaudio.Object {
+	objs := make([]*pulseaudio.Object, 0)
+	for _, path := range c.targetPaths(action) {
+		objs = append(objs, c.object(action.TargetType, path))
+	}
+	return objs
+}
 
-	if action.TargetType == PlaybackStream {
-		if streamPaths, ok := c.playbackStreamsByName[action.TargetName]; ok {
-			for _, streamPath := range streamPaths {
-				objs = append(objs, c.Stream(streamPath))
+func (c *PAClient) ProcessVolumeAction(action PulseAudioAction, volume float32) error {
+	paths := c.targetPaths(action)
+
+	if len(paths) > 0 {
+		for _, path := range paths {
+			balance := c.balanceOf(path)
+			if err := c.setVolume(action.TargetType, path, volume, balance); err != nil {
+				return err
 			}
 		}
+	} else {
+		log.Warn().Msgf("Could not find %s by name [%s] to set its volume", targetTypeName(action.TargetType), action.TargetName)
 	}
+	return nil
+}
 
-	if action.TargetType == RecordStream {
-		if streamPaths, ok := c.recordStreamsByName[action.TargetName]; ok {
-			for _, streamPath := range streamPaths {
-				objs = append(objs, c.Stream(streamPath))
-			}
+// SetBalance moves the objects the action targets between the left and right
+// channels, keeping their volume. -1 is fully left and 1 fully right.
+func (c *PAClient) SetBalance(action PulseAudioAction, balance float32) error {
+	paths := c.targetPaths(action)
+	if len(paths) == 0 {
+		log.Warn().Msgf("Could not find %s by name [%s] to set its balance", targetTypeName(action.TargetType), action.TargetName)
+		return nil
+	}
+
+	for _, path := range paths {
+		tracked, ok, err := c.pathVolume(action.TargetType, path)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		if err := c.setVolume(action.TargetType, path, tracked.Volume, balance); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// CurrentVolume returns the volume of the first object an action targets. ok
+// is false if no object could be found.
+func (c *PAClient) CurrentVolume(action PulseAudioAction) (volume float32, ok bool, err error) {
+	tracked, ok, err := c.TrackedVolume(action)
+	return tracked.Volume, ok, err
+}
+
+// ProcessMuteAction mutes or unmutes every object the action targets.
+func (c *PAClient) ProcessMuteAction(action PulseAudioAction, mute bool) error {
+	objs := c.targetObjects(action)
 
 	if len(objs) > 0 {
 		for _, obj := range objs {
-			err := obj.Set("Volume", []uint32{newVol, newVol})
-			if err != nil {
+			if err := obj.Set("Mute", mute); err != nil {
 				return err
 			}
 		}
 	} else {
-		var paType string
-		switch action.TargetType {
-		case Sink:
-			paType = "sink"
-		case Source:
-			paType = "source"
-		case PlaybackStream:
-			paType = "playback stream"
-		case RecordStream:
-			paType = "record stream"
-		}
+		log.Warn().Msgf("Could not find %s by name [%s] to set its mute state", targetTypeName(action.TargetType), action.TargetName)
+	}
+	return nil
+}
 
-		log.Warn().Msgf("Could not find %s by name [%s] to set its volume", paType, action.TargetName)
+// ToggleMuteAction flips the mute state of the objects the action targets,
+// returning the new state. The first object decides the new state so that
+// they all end up the same.
+func (c *PAClient) ToggleMuteAction(action PulseAudioAction) (bool, error) {
+	objs := c.targetObjects(action)
+	if len(objs) == 0 {
+		log.Warn().Msgf("Could not find %s by name [%s] to toggle its mute state", targetTypeName(action.TargetType), action.TargetName)
+		return false, nil
+	}
+
+	muted, err := objs[0].Bool("Mute")
+	if err != nil {
+		return false, err
+	}
+
+	return !muted, c.ProcessMuteAction(action, !muted)
+}
+
+// ProcessMoveAction moves the streams the action targets to the device named
+// by its DeviceName. Playback streams are moved to sinks and record streams to
+// sources.
+func (c *PAClient) ProcessMoveAction(action PulseAudioAction) error {
+	var devicePaths []dbus.ObjectPath
+
+	switch action.TargetType {
+	case PlaybackStream:
+		devicePaths = c.objectsByName(Sink)[action.DeviceName]
+	case RecordStream:
+		devicePaths = c.objectsByName(Source)[action.DeviceName]
+	default:
+		return fmt.Errorf("only playback and record streams can be moved, not a %s", targetTypeName(action.TargetType))
+	}
+
+	if len(devicePaths) == 0 {
+		return fmt.Errorf("could not find a device by name [%s] to move to", action.DeviceName)
+	}
+
+	objs := c.targetObjects(action)
+	if len(objs) == 0 {
+		log.Warn().Msgf("Could not find %s by name [%s] to move it", targetTypeName(action.TargetType), action.TargetName)
+		return nil
+	}
+
+	for _, obj := range objs {
+		if err := obj.Call("org.PulseAudio.Core1.Stream.Move", 0, devicePaths[0]).Err; err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+// StreamDevices returns the names of the sinks or sources that the streams an
+// action targets are playing to or recording from.
+func (c *PAClient) StreamDevices(action PulseAudioAction) []string {
+	deviceType := Sink
+	if action.TargetType == RecordStream {
+		deviceType = Source
+	}
+	devicesByName := c.objectsByName(deviceType)
+	paths := c.targetPaths(action)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0)
+	for _, path := range paths {
+		device, ok := c.streamDevices[path]
+		if !ok {
+			continue
+		}
+		for name, paths := range devicesByName {
+			if containsPath(paths, device) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// PlaybackStreamProperties returns the property list of every playback
+// stream, by path. It mustn't be changed.
+func (c *PAClient) PlaybackStreamProperties() map[dbus.ObjectPath]map[string]string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.playbackStreamProperties
+}
+
+// Capturing returns the applications that are recording from a source that
+// isn't the monitor of a sink, such as a microphone. The meters aren't
+// counted.
+func (c *PAClient) Capturing() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0)
+	for name, paths := range c.recordStreamsByName {
+		if name == meterClientName {
+			continue
+		}
+		for _, path := range paths {
+			if device, ok := c.streamDevices[path]; ok && !c.monitorSources[device] {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Target describes a pulseaudio object that can be controlled, along with the
+// properties it is indexed by.
+type Target struct {
+	TargetType PulseAudioTargetType
+	TargetName string
+	Path       dbus.ObjectPath
+	Volume     float32
+	Mute       bool
+	Properties map[string]string
+}
+
+// targetProperties are the properties shown for each target, besides the one
+// it is indexed by.
+var targetProperties = []string{
+	"application.name",
+	"application.process.binary",
+	"media.name",
+	"media.role",
+	"device.description",
+	"device.class",
+}
+
+// ListTargets returns every sink, source and stream that is currently known,
+// in the order sinks, sources, playback streams then record streams.
+func (c *PAClient) ListTargets() ([]Target, error) {
+	targets := make([]Target, 0)
+
+	for _, targetType := range []PulseAudioTargetType{Sink, Source, PlaybackStream, RecordStream} {
+		for _, name := range c.TargetNames(targetType) {
+			action := PulseAudioAction{TargetType: targetType, TargetName: name}
+			for _, path := range c.targetPaths(action) {
+				obj := c.object(targetType, path)
+				target := Target{
+					TargetType: targetType,
+					TargetName: name,
+					Path:       path,
+					Properties: make(map[string]string, 0),
+				}
+
+				props, err := obj.MapString("PropertyList")
+				if err != nil {
+					return nil, err
+				}
+				for _, key := range targetProperties {
+					if value, ok := props[key]; ok {
+						target.Properties[key] = value
+					}
+				}
+
+				if volume, err := obj.ListUint32("Volume"); err == nil && len(volume) > 0 {
+					target.Volume = float32(volume[0]) / 65535
+				}
+				if mute, err := obj.Bool("Mute"); err == nil {
+					target.Mute = mute
+				}
+
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	return targets, nil
+}
+
+// TargetNames returns the names of every object of the given type that is
+// currently known to pulseaudio.
+func (c *PAClient) TargetNames(targetType PulseAudioTargetType) []string {
+	byName := c.objectsByName(targetType)
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// PlaybackStreamNames returns the names of the applications that are playing,
+// starting with the one that started first.
+func (c *PAClient) PlaybackStreamNames() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	names := make([]string, 0, len(c.playbackStreamIndexes))
+	for name := range c.playbackStreamIndexes {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return c.playbackStreamIndexes[names[i]] < c.playbackStreamIndexes[names[j]]
+	})
+	return names
+}
+
+func targetTypeName(targetType PulseAudioTargetType) string {
+	switch targetType {
+	case Sink:
+		return "sink"
+	case Source:
+		return "source"
+	case PlaybackStream:
+		return "playback stream"
+	case RecordStream:
+		return "record stream"
+	}
+	return string(targetType)
+}
@@ -1,64 +1,222 @@
 package pamidicontrol
 
 import (
+	"flag"
+	"fmt"
 	"os"
 	"strings"
 	"time"
 
+	"github.com/godbus/dbus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/spf13/viper"
 	"github.com/sqp/pulseaudio"
 )
 
+const usage = `Usage: pamidicontrol [command] [flags]
+
+Commands:
+  run           Control pulseaudio with the configured midi device (default)
+  check         Validate the configuration and check its targets exist
+  list-targets  List the sinks, sources and streams that can be controlled
+  set-volume    Set the volume of a target
+  mute          Mute, unmute or toggle the mute state of a target
+  move          Move a stream to another sink or source
+  learn         Add mappings to the configuration by moving controls
+  init          Write a starter configuration for the connected controller
+  presets       List the built in controller presets and their controls
+  scene         Save, recall, list or delete mixer scenes
+
+Run 'pamidicontrol <command> -h' for the flags of a command.
+`
+
 func Run() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.RFC3339})
 
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath("$HOME/.config/pamidicontrol")
-	err := viper.ReadInConfig()
-	if err != nil {
-		panic(err)
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	var c Config
-	err = viper.Unmarshal(&c)
+	switch command {
+	case "run":
+		runDaemon(args)
+	case "check":
+		runCheck(args)
+	case "list-targets":
+		runListTargets(args)
+	case "set-volume":
+		runSetVolume(args)
+	case "mute":
+		runMute(args)
+	case "move":
+		runMove(args)
+	case "learn":
+		runLearn(args)
+	case "init":
+		runInit(args)
+	case "presets":
+		runPresets(args)
+	case "scene":
+		runScene(args)
+	case "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet(name, flag.ExitOnError)
+}
+
+// configFlag adds the flag used to choose the configuration file to fs.
+func configFlag(fs *flag.FlagSet) *string {
+	return fs.String("config", "", "path to the configuration file (default $HOME/.config/pamidicontrol/config.yaml)")
+}
+
+// mustLoadConfig loads the configuration file, exiting with every problem
+// found if it isn't valid.
+func mustLoadConfig(path string) Config {
+	c, err := LoadConfig(path)
+	if errs, ok := err.(ConfigErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "%s:%d: %s\n", ConfigFileUsed(), e.Line, e.Message)
+		}
+		os.Exit(1)
+	}
 	if err != nil {
 		panic(err)
 	}
+	return c
+}
 
+// connectPulseAudio connects to pulseaudio and indexes its current objects.
+func connectPulseAudio() (*pulseaudio.Client, *PAClient) {
 	pulse, err := pulseaudio.New()
 	if err != nil {
 		panic(err)
 	}
 
 	paclient := NewPAClient(pulse)
+	if err := paclient.RefreshStreams(); err != nil {
+		panic(err)
+	}
+
+	return pulse, paclient
+}
+
+func runDaemon(args []string) {
+	fs := newFlagSet("run")
+	configPath := configFlag(fs)
+	latency := fs.Duration("latency", 0, "log how long volume changes take at this interval, such as 10s")
+	fs.Parse(args)
+
+	c := mustLoadConfig(*configPath)
+
+	pulse, paclient := connectPulseAudio()
 	pulse.Register(paclient)
-	paclient.RefreshStreams()
 
-	midiClient := &MidiClient{
-		PAClient:       paclient,
-		MidiActions:    c.MidiActions,
-		InputMidiName:  c.InputMidiName,
-		OutputMidiName: c.OutputMidiName,
+	// The devices share the remembered volumes, the worker so that two
+	// controls of the same target don't race each other, and privacy mode.
+	state := mustLoadControllerState(c.StatePath())
+	interval := time.Duration(0)
+	if c.MaxVolumeUpdates > 0 {
+		interval = time.Second / time.Duration(c.MaxVolumeUpdates)
+	}
+	worker := newVolumeWorker(paclient, interval)
+	if *latency > 0 {
+		go worker.stats.reportEvery(*latency)
+	}
+	privacy := newPrivacyMode(paclient)
+	if len(c.Ducking) > 0 {
+		newDucker(paclient, c.Ducking)
+	}
+	var safety *safetyLimiter
+	if c.Safety != nil {
+		safety = newSafetyLimiter(paclient, state, *c.Safety)
 	}
 
-	if c.InputMidiName == "" || c.OutputMidiName == "" {
-		ins, outs, err := midiClient.ListDevices()
-		if err != nil {
-			panic(err)
+	// Controllers can be found without naming their ports, if they identify
+	// as one there is a preset for.
+	devices := c.AllDevices()
+	found := make(map[int]foundController)
+	for _, device := range devices {
+		if device.unnamed() {
+			if controllers, err := discoverControllers(); err == nil {
+				found = assignControllers(devices, controllers)
+			}
+			break
 		}
+	}
 
-		log.Error().Msgf(
-			"Input and Output Midi devices must be set.\nPossible input values are: \n\n%s\n\nPossible output values are\n\n%s",
-			strings.Join(ins, "\n"),
-			strings.Join(outs, "\n"),
-		)
-		os.Exit(1)
+	clients := make([]*MidiClient, 0)
+	for i, device := range devices {
+		midiClient := &MidiClient{
+			PAClient:       paclient,
+			MidiActions:    device.MidiActions,
+			InputMidiName:  device.InputMidiName,
+			OutputMidiName: device.OutputMidiName,
+			InputPort:      device.InputPort,
+			OutputPort:     device.OutputPort,
+			Setup:          device.Setup,
+			Protocol:       device.Protocol,
+			Strips:         device.Strips,
+			AutoAssign:     device.AutoAssign,
+			Matrix:         device.Matrix,
+			Meters:         device.Meters,
+			Privacy:        device.Privacy,
+			DoseIndicator:  device.DoseIndicator,
+			Layers:         device.Layers,
+			BankLeft:       device.BankLeft,
+			BankRight:      device.BankRight,
+			ScenesFile:     c.ScenesPath(),
+			StateFile:      c.StatePath(),
+
+			state:   state,
+			worker:  worker,
+			privacy: privacy,
+			safety:  safety,
+		}
+		if preset, ok := device.ControllerPreset(); ok {
+			midiClient.Preset = preset
+		}
+
+		if controller, ok := found[i]; ok {
+			log.Info().Msgf("Found a %s on %s", controller.Preset.Name, controller.In)
+			device.InputMidiName, device.OutputMidiName = controller.In, controller.Out
+			device.InputPort, device.OutputPort = controller.InPort, controller.OutPort
+			midiClient.InputMidiName, midiClient.OutputMidiName = device.InputMidiName, device.OutputMidiName
+			midiClient.InputPort, midiClient.OutputPort = device.InputPort, device.OutputPort
+			if midiClient.Preset == nil {
+				midiClient.Preset = controller.Preset
+			}
+		}
+
+		if (device.InputMidiName == "" && device.InputPort == nil) || (device.OutputMidiName == "" && device.OutputPort == nil) {
+			ins, outs, err := midiClient.ListDevices()
+			if err != nil {
+				panic(err)
+			}
+
+			log.Error().Msgf(
+				"Input and Output Midi devices must be set.\nPossible input values are: \n\n%s\n\nPossible output values are\n\n%s",
+				strings.Join(ins, "\n"),
+				strings.Join(outs, "\n"),
+			)
+			os.Exit(1)
+		}
+		clients = append(clients, midiClient)
 	}
 
-	go midiClient.Run()
+	paclient.AddObjectListener(func(targetType PulseAudioTargetType, name string, path dbus.ObjectPath) {
+		restoreObjects(clients, targetType, name, path)
+	})
+	for _, midiClient := range clients {
+		go midiClient.Run()
+	}
 
 	pulse.Listen()
 }
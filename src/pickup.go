@@ -0,0 +1,93 @@
+package pamidicontrol
+
+// PickupMode decides what happens when a fader doesn't match the volume of its
+// target, because the volume was changed by another application.
+type PickupMode string
+
+const (
+	// NoPickup sets the volume to the fader position straight away.
+	NoPickup PickupMode = ""
+	// Catch ignores the fader until it crosses the current volume.
+	Catch PickupMode = "Catch"
+	// Scale moves the volume towards the end the fader is moving to, so
+	// that the two meet when the fader gets there.
+	Scale PickupMode = "Scale"
+)
+
+// Valid reports whether m is a known pickup mode.
+func (m PickupMode) Valid() bool {
+	switch m {
+	case NoPickup, Catch, Scale:
+		return true
+	}
+	return false
+}
+
+// pickupThreshold is how close a fader has to be to the volume of its target
+// to pick it up.
+const pickupThreshold = 0.02
+
+// pickupState is the soft takeover state of a single mapping.
+type pickupState struct {
+	// engaged is set while the fader is in control of the volume.
+	engaged bool
+
+	// lastInput is the previous position of the fader.
+	lastInput float32
+	hasInput  bool
+
+	// volume is the target volume seen with the previous position. If its
+	// object or external change count differ, the volume was changed by
+	// something else and the fader has to pick it up again.
+	volume TrackedVolume
+}
+
+// next works out the volume to set for a new fader position, given the current
+// volume of the target. ok is false if the fader should be ignored.
+func (p *pickupState) next(mode PickupMode, input float32, current TrackedVolume) (volume float32, ok bool) {
+	if current.Path != p.volume.Path || current.ExternalChanges != p.volume.ExternalChanges {
+		p.engaged = false
+	}
+	p.volume = current
+
+	previous, hadInput := p.lastInput, p.hasInput
+	p.lastInput, p.hasInput = input, true
+
+	if !p.engaged {
+		near := abs32(input-current.Volume) <= pickupThreshold
+		crossed := hadInput && (previous-current.Volume)*(input-current.Volume) <= 0
+		p.engaged = near || crossed
+	}
+
+	if p.engaged {
+		return input, true
+	}
+
+	// The positions are clamped, as a fader at either end leaves nothing to
+	// scale the volume over in that direction.
+	input, previous = clamp01(input), clamp01(previous)
+	if mode == Scale && hadInput && input != previous {
+		switch {
+		case input > previous && previous < 1:
+			volume = current.Volume + (input-previous)*(1-current.Volume)/(1-previous)
+		case input < previous && previous > 0:
+			volume = current.Volume - (previous-input)*current.Volume/previous
+		default:
+			return 0, false
+		}
+		return clamp01(volume), true
+	}
+
+	return 0, false
+}
+
+// clamp01 limits v to between 0 and 1.
+func clamp01(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,102 @@
+package pamidicontrol
+
+import "testing"
+
+func TestPickupStateNext(t *testing.T) {
+	type step struct {
+		input   float32
+		current float32
+		// external is the count of external changes of the target.
+		external uint64
+
+		want   float32
+		wantOK bool
+	}
+
+	tests := []struct {
+		name  string
+		mode  PickupMode
+		steps []step
+	}{
+		{
+			name: "catch near the volume",
+			mode: Catch,
+			steps: []step{
+				{input: 0.21, current: 0.2, want: 0.21, wantOK: true},
+				{input: 0.5, current: 0.21, want: 0.5, wantOK: true},
+			},
+		},
+		{
+			name: "catch when crossing the volume",
+			mode: Catch,
+			steps: []step{
+				{input: 0.8, current: 0.2},
+				{input: 0.5, current: 0.2},
+				{input: 0.1, current: 0.2, want: 0.1, wantOK: true},
+				{input: 0.3, current: 0.1, want: 0.3, wantOK: true},
+			},
+		},
+		{
+			name: "catch again after an external change",
+			mode: Catch,
+			steps: []step{
+				{input: 0.5, current: 0.5, want: 0.5, wantOK: true},
+				{input: 0.6, current: 0.9, external: 1},
+				{input: 0.95, current: 0.9, external: 1, want: 0.95, wantOK: true},
+			},
+		},
+		{
+			name: "scale up",
+			mode: Scale,
+			steps: []step{
+				{input: 0.5, current: 0.25},
+				{input: 0.75, current: 0.25, want: 0.625, wantOK: true},
+			},
+		},
+		{
+			name: "scale down",
+			mode: Scale,
+			steps: []step{
+				{input: 0.5, current: 0.8},
+				{input: 0.25, current: 0.8, want: 0.4, wantOK: true},
+			},
+		},
+		{
+			name: "scale up from the bottom",
+			mode: Scale,
+			steps: []step{
+				{input: 0, current: 0.8},
+				{input: 0.5, current: 0.8, want: 0.9, wantOK: true},
+			},
+		},
+		{
+			name: "scale past the top",
+			mode: Scale,
+			steps: []step{
+				{input: 1, current: 0.2},
+				{input: 1.2, current: 0.2},
+			},
+		},
+		{
+			name: "scale past the bottom",
+			mode: Scale,
+			steps: []step{
+				{input: 0, current: 0.5},
+				{input: -0.2, current: 0.5},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p pickupState
+			for i, s := range tt.steps {
+				current := TrackedVolume{Path: "/sink0", Volume: s.current, ExternalChanges: s.external}
+				got, ok := p.next(tt.mode, s.input, current)
+				if ok != s.wantOK || abs32(got-s.want) > 1e-6 {
+					t.Errorf("step %d: next(%v, %v) = %v, %v, want %v, %v", i, s.input, s.current, got, ok, s.want, s.wantOK)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package pamidicontrol
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// PortMatch picks a midi port by something other than its exact name, which
+// changes when devices are plugged in a different order. Every criterion that
+// is set has to match.
+type PortMatch struct {
+	// Contains matches the ports whose name contains it, ignoring case.
+	Contains string
+	// Pattern matches the port names with a regular expression.
+	Pattern string
+
+	// USBVendor and USBProduct match the ports of a USB device by its ids,
+	// in hexadecimal as lsusb shows them. USBSerial matches its serial
+	// number, to tell two of the same device apart.
+	USBVendor  string
+	USBProduct string
+	USBSerial  string
+
+	// Index picks one of several matching ports, in the order they are
+	// listed, starting at 0.
+	Index uint
+}
+
+// String describes the criteria of the match.
+func (m PortMatch) String() string {
+	parts := make([]string, 0)
+	if m.Contains != "" {
+		parts = append(parts, fmt.Sprintf("contains %q", m.Contains))
+	}
+	if m.Pattern != "" {
+		parts = append(parts, fmt.Sprintf("pattern %q", m.Pattern))
+	}
+	if m.USBVendor != "" || m.USBProduct != "" {
+		parts = append(parts, fmt.Sprintf("USB id %s:%s", m.USBVendor, m.USBProduct))
+	}
+	if m.USBSerial != "" {
+		parts = append(parts, fmt.Sprintf("USB serial %q", m.USBSerial))
+	}
+	if m.Index > 0 {
+		parts = append(parts, fmt.Sprintf("index %d", m.Index))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// usesUSB returns whether the match needs the USB identity of the ports.
+func (m PortMatch) usesUSB() bool {
+	return m.USBVendor != "" || m.USBProduct != "" || m.USBSerial != ""
+}
+
+// matches returns whether a port name meets the criteria, apart from Index.
+// card is the USB sound card the port belongs to, or nil if it isn't on one.
+func (m PortMatch) matches(name string, card *usbCard) bool {
+	if m.Contains != "" && !strings.Contains(strings.ToLower(name), strings.ToLower(m.Contains)) {
+		return false
+	}
+	if m.Pattern != "" {
+		if matched, err := regexp.MatchString(m.Pattern, name); err != nil || !matched {
+			return false
+		}
+	}
+	if !m.usesUSB() {
+		return true
+	}
+
+	if card == nil {
+		return false
+	}
+	if m.USBVendor != "" && !sameHexID(m.USBVendor, card.vendor) {
+		return false
+	}
+	if m.USBProduct != "" && !sameHexID(m.USBProduct, card.product) {
+		return false
+	}
+	if m.USBSerial != "" && m.USBSerial != card.serial {
+		return false
+	}
+	return true
+}
+
+// findPort returns the index of the port in names that is picked by match,
+// or named exactly name if there is no match. kind is "input" or "output",
+// for the error listing the ports that could be used instead.
+func findPort(kind string, names []string, name string, match *PortMatch) (int, error) {
+	if match == nil {
+		for i, port := range names {
+			if port == name {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("there is no midi %s named [%s]. Possible values are:\n\n%s", kind, name, strings.Join(names, "\n"))
+	}
+
+	var cards []*usbCard
+	if match.usesUSB() {
+		cards = portCards(names, seqPortCards(), usbCards())
+	} else {
+		cards = make([]*usbCard, len(names))
+	}
+
+	found := make([]int, 0)
+	for i, port := range names {
+		if match.matches(port, cards[i]) {
+			found = append(found, i)
+		}
+	}
+	if int(match.Index) < len(found) {
+		return found[match.Index], nil
+	}
+
+	return 0, fmt.Errorf("%d midi %s(s) match %s. Possible values are:\n\n%s", len(found), kind, match, strings.Join(names, "\n"))
+}
+
+// portCards returns the USB sound card of each port in names. Identical
+// devices have ports of the same name, so the n-th port of a name belongs to
+// the card of the n-th sequencer port of that name, as both are listed in
+// the order of their ALSA client. seqCards holds the card numbers of the
+// sequencer ports by name, and cards the USB sound cards by number.
+func portCards(names []string, seqCards map[string][]int, cards map[int]usbCard) []*usbCard {
+	found := make([]*usbCard, len(names))
+	seen := make(map[string]int, 0)
+	for i, name := range names {
+		n := seen[name]
+		seen[name]++
+		if n >= len(seqCards[name]) {
+			continue
+		}
+		if card, ok := cards[seqCards[name][n]]; ok {
+			found[i] = &card
+		}
+	}
+	return found
+}
+
+// seqClientLine matches a client in /proc/asound/seq/clients, such as
+// "Client  20 : "nanoKONTROL2" [Kernel]", and seqPortLine one of its ports,
+// such as "  Port   0 : "nanoKONTROL2 MIDI 1" (RWe-)".
+var (
+	seqClientLine = regexp.MustCompile(`^Client\s+(\d+) : ".*" \[(.*)\]`)
+	seqPortLine   = regexp.MustCompile(`^\s+Port\s+\d+ : "(.*)"`)
+)
+
+// The kernel gives the sequencer clients of a sound card numbers starting
+// at seqCardClients, with seqClientsPerCard of them for each card.
+const (
+	seqCardClients    = 16
+	seqClientsPerCard = 4
+)
+
+// seqPortCards reads the ALSA sequencer ports of the sound cards, returning
+// the card number of each port by its name, in the order of their clients.
+func seqPortCards() map[string][]int {
+	f, err := os.Open("/proc/asound/seq/clients")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	ports := make(map[string][]int, 0)
+	card := -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if m := seqClientLine.FindStringSubmatch(scanner.Text()); m != nil {
+			client, _ := strconv.Atoi(m[1])
+			card = -1
+			if strings.HasPrefix(m[2], "Kernel") && client >= seqCardClients {
+				card = (client - seqCardClients) / seqClientsPerCard
+			}
+			continue
+		}
+		if m := seqPortLine.FindStringSubmatch(scanner.Text()); m != nil && card >= 0 {
+			ports[m[1]] = append(ports[m[1]], card)
+		}
+	}
+	return ports
+}
+
+// usbCard is the identity of a USB sound card.
+type usbCard struct {
+	vendor  string
+	product string
+	serial  string
+}
+
+// cardLine matches a card in /proc/asound/cards, such as
+// " 1 [nanoKONTROL2   ]: USB-Audio - nanoKONTROL2".
+var cardLine = regexp.MustCompile(`^\s*(\d+) \[.*\]: `)
+
+// usbCards reads the USB sound cards from /proc/asound and sysfs, by their
+// card number. Cards that can't be read are left out.
+func usbCards() map[int]usbCard {
+	f, err := os.Open("/proc/asound/cards")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	cards := make(map[int]usbCard, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		m := cardLine.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+
+		// The card's device is the USB interface, whose parent is the
+		// USB device holding the ids.
+		device, err := filepath.EvalSymlinks(filepath.Join("/sys/class/sound", "card"+m[1], "device"))
+		if err != nil {
+			continue
+		}
+		usb := filepath.Dir(device)
+		vendor, err := readSysfs(usb, "idVendor")
+		if err != nil {
+			continue
+		}
+		product, _ := readSysfs(usb, "idProduct")
+		serial, _ := readSysfs(usb, "serial")
+
+		number, _ := strconv.Atoi(m[1])
+		cards[number] = usbCard{
+			vendor:  vendor,
+			product: product,
+			serial:  serial,
+		}
+	}
+	return cards
+}
+
+func readSysfs(dir string, name string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// sameHexID compares two USB ids, ignoring case and leading zeros.
+func sameHexID(a, b string) bool {
+	x, ok := parseHexID(a)
+	if !ok {
+		return false
+	}
+	y, ok := parseHexID(b)
+	return ok && x == y
+}
+
+// parseHexID parses a hexadecimal USB id, with or without a 0x prefix.
+func parseHexID(id string) (uint64, bool) {
+	value, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(id), "0x"), 16, 16)
+	return value, err == nil
+}
@@ -0,0 +1,96 @@
+package pamidicontrol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindPort(t *testing.T) {
+	names := []string{
+		"Midi Through Port-0",
+		"nanoKONTROL2 MIDI 1",
+		"X-TOUCH MINI MIDI 1",
+		"nanoKONTROL2 MIDI 1",
+	}
+
+	tests := []struct {
+		name    string
+		port    string
+		match   *PortMatch
+		want    int
+		wantErr string
+	}{
+		{name: "exact name", port: "X-TOUCH MINI MIDI 1", want: 2},
+		{name: "first of the same name", port: "nanoKONTROL2 MIDI 1", want: 1},
+		{name: "unknown name", port: "Launchpad X", wantErr: "there is no midi input named [Launchpad X]"},
+		{name: "contains", match: &PortMatch{Contains: "x-touch"}, want: 2},
+		{name: "contains with index", match: &PortMatch{Contains: "nanokontrol2", Index: 1}, want: 3},
+		{name: "pattern", match: &PortMatch{Pattern: "^Midi Through"}, want: 0},
+		{name: "contains and pattern", match: &PortMatch{Contains: "MIDI 1", Pattern: "^X-"}, want: 2},
+		{name: "index past the matches", match: &PortMatch{Contains: "nanokontrol2", Index: 2}, wantErr: "2 midi input(s) match contains \"nanokontrol2\", index 2"},
+		{name: "invalid pattern", match: &PortMatch{Pattern: "("}, wantErr: "0 midi input(s) match"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findPort("input", names, tt.port, tt.match)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("findPort() returned %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("findPort() returned %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("findPort() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPortCards(t *testing.T) {
+	names := []string{"Midi Through Port-0", "nanoKONTROL2 MIDI 1", "nanoKONTROL2 MIDI 1", "Unknown"}
+	seqCards := map[string][]int{"nanoKONTROL2 MIDI 1": {1, 2}}
+	cards := map[int]usbCard{
+		1: {vendor: "0944", product: "0117", serial: "A"},
+		2: {vendor: "0944", product: "0117", serial: "B"},
+	}
+
+	got := portCards(names, seqCards, cards)
+	want := []string{"", "A", "B", ""}
+	for i := range names {
+		serial := ""
+		if got[i] != nil {
+			serial = got[i].serial
+		}
+		if serial != want[i] {
+			t.Errorf("port %d [%s] is on the card with serial %q, want %q", i, names[i], serial, want[i])
+		}
+	}
+}
+
+func TestPortMatchUSB(t *testing.T) {
+	card := &usbCard{vendor: "0944", product: "0117", serial: "A"}
+
+	tests := []struct {
+		match PortMatch
+		card  *usbCard
+		want  bool
+	}{
+		{PortMatch{USBVendor: "0944", USBProduct: "0117"}, card, true},
+		{PortMatch{USBVendor: "0x944"}, card, true},
+		{PortMatch{USBVendor: "0944", USBSerial: "A"}, card, true},
+		{PortMatch{USBVendor: "0944", USBSerial: "B"}, card, false},
+		{PortMatch{USBProduct: "0118"}, card, false},
+		{PortMatch{USBVendor: "0944"}, nil, false},
+		{PortMatch{Contains: "nano"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.match.matches("nanoKONTROL2 MIDI 1", tt.card); got != tt.want {
+			t.Errorf("%s matches = %v, want %v", tt.match, got, tt.want)
+		}
+	}
+}
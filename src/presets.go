@@ -0,0 +1,370 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PresetFeedback is where a controller accepts messages that light the LED of
+// a control, or move its LED ring.
+type PresetFeedback struct {
+	ActionType MidiActionType
+	Channel    uint8
+	Controller uint8
+
+	// OnValue and OffValue are sent to turn a button LED on and off. LED
+	// rings are sent the value of the control instead.
+	OnValue  uint8
+	OffValue uint8
+}
+
+// PresetControl describes a single control on a midi controller.
+type PresetControl struct {
+	Name string
+
+	ActionType    MidiActionType
+	Channel       uint8
+	Controller    uint8
+	MaxInputValue uint
+	Relative      RelativeEncoding
+
+	// Feedback is nil for controls without an LED.
+	Feedback *PresetFeedback
+}
+
+// ControllerPreset describes the layout of a midi controller in its factory
+// default configuration.
+type ControllerPreset struct {
+	Name string
+
+	// PortNames are matched against midi port names, ignoring case, to
+	// recognise the controller.
+	PortNames []string
+	// Identity recognises the controller by its answer to the Universal
+	// Device Inquiry, when the port name doesn't.
+	Identity *DeviceIdentity
+	// setup configures the controller, if it can be.
+	setup controllerSetup
+
+	// VolumeControls and MuteControls are the name prefixes of the controls
+	// that make up each channel strip, such as fader1 and mute1.
+	VolumeControls string
+	MuteControls   string
+
+	Controls []PresetControl
+
+	// Grid is the pad grid of a grid controller, used by a Matrix.
+	Grid *GridLayout
+}
+
+// Control returns the control with the given name.
+func (p *ControllerPreset) Control(name string) (PresetControl, bool) {
+	for _, control := range p.Controls {
+		if strings.EqualFold(control.Name, name) {
+			return control, true
+		}
+	}
+	return PresetControl{}, false
+}
+
+// ControlAt returns the control that sends the messages an action is mapped
+// to.
+func (p *ControllerPreset) ControlAt(action MidiAction) (PresetControl, bool) {
+	for _, control := range p.Controls {
+		if control.MidiAction(PulseAudioAction{}).bindingKey() == action.bindingKey() {
+			return control, true
+		}
+	}
+	return PresetControl{}, false
+}
+
+// ControlNames returns the names of every control.
+func (p *ControllerPreset) ControlNames() []string {
+	names := make([]string, 0, len(p.Controls))
+	for _, control := range p.Controls {
+		names = append(names, control.Name)
+	}
+	return names
+}
+
+// Strips returns the volume controls and the mute buttons of each channel
+// strip, in order.
+func (p *ControllerPreset) Strips() (volumes []PresetControl, mutes []PresetControl) {
+	for i := 1; ; i++ {
+		volume, ok := p.Control(fmt.Sprintf("%s%d", p.VolumeControls, i))
+		if !ok {
+			return volumes, mutes
+		}
+		volumes = append(volumes, volume)
+
+		if mute, ok := p.Control(fmt.Sprintf("%s%d", p.MuteControls, i)); ok {
+			mutes = append(mutes, mute)
+		}
+	}
+}
+
+// MidiAction returns a mapping for the control that runs action.
+func (c PresetControl) MidiAction(action PulseAudioAction) MidiAction {
+	return MidiAction{
+		ActionType:    c.ActionType,
+		Channel:       c.Channel,
+		Controller:    c.Controller,
+		MaxInputValue: c.MaxInputValue,
+		Relative:      c.Relative,
+		Action:        action,
+	}
+}
+
+// FindPreset returns the preset for the controller with the given midi port
+// name, if there is one.
+func FindPreset(portName string) (*ControllerPreset, bool) {
+	lower := strings.ToLower(portName)
+	for _, preset := range Presets {
+		for _, name := range preset.PortNames {
+			if strings.Contains(lower, strings.ToLower(name)) {
+				return preset, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// PresetByName returns the preset with the given name, ignoring case.
+func PresetByName(name string) (*ControllerPreset, bool) {
+	for _, preset := range Presets {
+		if strings.EqualFold(preset.Name, name) {
+			return preset, true
+		}
+	}
+	return nil, false
+}
+
+// PresetNames returns the names of every built in preset.
+func PresetNames() []string {
+	names := make([]string, 0, len(Presets))
+	for _, preset := range Presets {
+		names = append(names, preset.Name)
+	}
+	return names
+}
+
+// controlGroup returns one control per controller number, named prefix1 to
+// prefixN.
+func controlGroup(prefix string, actionType MidiActionType, channel uint8, controllers ...uint8) []PresetControl {
+	controls := make([]PresetControl, 0, len(controllers))
+	for i, controller := range controllers {
+		controls = append(controls, PresetControl{
+			Name:          fmt.Sprintf("%s%d", prefix, i+1),
+			ActionType:    actionType,
+			Channel:       channel,
+			Controller:    controller,
+			MaxInputValue: actionType.MaxValue(),
+		})
+	}
+	return controls
+}
+
+// controlRange returns count controls on consecutive controller numbers
+// starting at first.
+func controlRange(prefix string, actionType MidiActionType, channel uint8, first uint8, count int) []PresetControl {
+	controllers := make([]uint8, 0, count)
+	for i := 0; i < count; i++ {
+		controllers = append(controllers, first+uint8(i))
+	}
+	return controlGroup(prefix, actionType, channel, controllers...)
+}
+
+// withLEDs gives each control an LED lit by sending its own message back with
+// the on or off value.
+func withLEDs(controls []PresetControl, on, off uint8) []PresetControl {
+	for i := range controls {
+		controls[i].Feedback = &PresetFeedback{
+			ActionType: controls[i].ActionType,
+			Channel:    controls[i].Channel,
+			Controller: controls[i].Controller,
+			OnValue:    on,
+			OffValue:   off,
+		}
+	}
+	return controls
+}
+
+// withRings gives each control an LED ring set by sending its own message
+// back on the given channel.
+func withRings(controls []PresetControl, channel uint8) []PresetControl {
+	for i := range controls {
+		controls[i].Feedback = &PresetFeedback{
+			ActionType: controls[i].ActionType,
+			Channel:    channel,
+			Controller: controls[i].Controller,
+		}
+	}
+	return controls
+}
+
+func named(name string, actionType MidiActionType, channel uint8, controller uint8) []PresetControl {
+	return []PresetControl{{
+		Name:          name,
+		ActionType:    actionType,
+		Channel:       channel,
+		Controller:    controller,
+		MaxInputValue: actionType.MaxValue(),
+	}}
+}
+
+func concatControls(groups ...[]PresetControl) []PresetControl {
+	controls := make([]PresetControl, 0)
+	for _, group := range groups {
+		controls = append(controls, group...)
+	}
+	return controls
+}
+
+// Presets are the controllers that are recognised out of the box, in their
+// factory default configuration.
+var Presets = []*ControllerPreset{
+	{
+		// The button LEDs only follow the host once the LED mode has been
+		// switched to external, which Setup does.
+		Name:           "KORG nanoKONTROL2",
+		PortNames:      []string{"nanoKONTROL2"},
+		Identity:       &DeviceIdentity{Manufacturer: []byte{0x42}, Family: 0x0113},
+		setup:          nanoKontrol2{},
+		VolumeControls: "fader",
+		MuteControls:   "mute",
+		Controls: concatControls(
+			controlRange("fader", ControlChange, 0, 0, 8),
+			controlRange("knob", ControlChange, 0, 16, 8),
+			withLEDs(controlRange("solo", ControlChange, 0, 32, 8), 127, 0),
+			withLEDs(controlRange("mute", ControlChange, 0, 48, 8), 127, 0),
+			withLEDs(controlRange("rec", ControlChange, 0, 64, 8), 127, 0),
+			withLEDs(named("play", ControlChange, 0, 41), 127, 0),
+			withLEDs(named("stop", ControlChange, 0, 42), 127, 0),
+			withLEDs(named("rewind", ControlChange, 0, 43), 127, 0),
+			withLEDs(named("forward", ControlChange, 0, 44), 127, 0),
+			withLEDs(named("record", ControlChange, 0, 45), 127, 0),
+			withLEDs(named("cycle", ControlChange, 0, 46), 127, 0),
+			named("trackPrevious", ControlChange, 0, 58),
+			named("trackNext", ControlChange, 0, 59),
+			named("markerSet", ControlChange, 0, 60),
+			named("markerPrevious", ControlChange, 0, 61),
+			named("markerNext", ControlChange, 0, 62),
+		),
+	},
+	{
+		// Standard mode, layer A. Knob pushes and buttons send notes, and
+		// everything is on the global channel 11.
+		Name:           "Behringer X-Touch Mini",
+		PortNames:      []string{"X-TOUCH MINI"},
+		VolumeControls: "knob",
+		MuteControls:   "button",
+		Controls: concatControls(
+			withRings(controlRange("knob", ControlChange, 10, 1, 8), 10),
+			controlRange("push", Note, 10, 0, 8),
+			withLEDs(controlRange("button", Note, 10, 8, 16), 127, 0),
+			named("fader1", ControlChange, 10, 9),
+		),
+	},
+	{
+		// Factory template 1. Button LEDs take a colour as the velocity, 60
+		// is full green.
+		Name:           "Novation Launch Control XL",
+		PortNames:      []string{"Launch Control XL"},
+		Identity:       &DeviceIdentity{Manufacturer: []byte{0x00, 0x20, 0x29}, Family: 0x0061},
+		VolumeControls: "fader",
+		MuteControls:   "control",
+		Controls: concatControls(
+			controlRange("sendA", ControlChange, 8, 13, 8),
+			controlRange("sendB", ControlChange, 8, 29, 8),
+			controlRange("pan", ControlChange, 8, 49, 8),
+			controlRange("fader", ControlChange, 8, 77, 8),
+			withLEDs(controlGroup("focus", Note, 8, 41, 42, 43, 44, 57, 58, 59, 60), 60, 12),
+			withLEDs(controlGroup("control", Note, 8, 73, 74, 75, 76, 89, 90, 91, 92), 15, 12),
+			withLEDs(named("device", Note, 8, 105), 60, 12),
+			withLEDs(named("mute", Note, 8, 106), 60, 12),
+			withLEDs(named("solo", Note, 8, 107), 60, 12),
+			withLEDs(named("recordArm", Note, 8, 108), 60, 12),
+			withLEDs(named("up", ControlChange, 8, 104), 127, 0),
+			withLEDs(named("down", ControlChange, 8, 105), 127, 0),
+			withLEDs(named("left", ControlChange, 8, 106), 127, 0),
+			withLEDs(named("right", ControlChange, 8, 107), 127, 0),
+		),
+	},
+	{
+		// Bank 1. The encoders send absolute values and their rings follow
+		// values sent back on the same controller. The switches send on
+		// channel 2.
+		Name:           "DJ TechTools Midi Fighter Twister",
+		PortNames:      []string{"Midi Fighter Twister"},
+		VolumeControls: "knob",
+		MuteControls:   "push",
+		Controls: concatControls(
+			withRings(controlRange("knob", ControlChange, 0, 0, 16), 0),
+			controlRange("push", ControlChange, 1, 0, 16),
+		),
+	},
+	{
+		// Programmer mode, which Setup switches to. The pads send notes 11
+		// to 88 from the bottom left, and light in the colour of the palette
+		// numbered by the velocity: 21 is green and 1 dark grey.
+		Name:      "Novation Launchpad X",
+		PortNames: []string{"LPX MIDI", "Launchpad X"},
+		setup:     launchpadProgrammerMode{model: 0x0C},
+		Grid: &GridLayout{
+			ActionType:      Note,
+			Pads:            gridPads(81, -10, 8, 8),
+			RoutedColour:    21,
+			AvailableColour: 1,
+			EmptyColour:     0,
+		},
+	},
+	{
+		// Programmer mode, laid out like the Launchpad X.
+		Name:      "Novation Launchpad Mini MK3",
+		PortNames: []string{"LPMiniMK3 MIDI", "Launchpad Mini MK3"},
+		setup:     launchpadProgrammerMode{model: 0x0D},
+		Grid: &GridLayout{
+			ActionType:      Note,
+			Pads:            gridPads(81, -10, 8, 8),
+			RoutedColour:    21,
+			AvailableColour: 1,
+			EmptyColour:     0,
+		},
+	},
+	{
+		// The original Launchpad, Launchpad S and Launchpad Mini. Each row of
+		// pads starts 16 notes after the one above it, and the velocity sets
+		// the brightness of the red and green LEDs: 60 is full green, 29 dim
+		// amber and 12 off.
+		Name:      "Novation Launchpad Mini",
+		PortNames: []string{"Launchpad Mini", "Launchpad S", "Launchpad"},
+		Grid: &GridLayout{
+			ActionType:      Note,
+			Pads:            gridPads(0, 16, 8, 8),
+			RoutedColour:    60,
+			AvailableColour: 29,
+			EmptyColour:     12,
+		},
+	},
+	{
+		// The mute and record arm LEDs follow notes sent back to them. The
+		// solo buttons share their LEDs with the mute buttons.
+		Name:           "Akai MIDImix",
+		PortNames:      []string{"MIDI Mix", "MIDImix"},
+		VolumeControls: "fader",
+		MuteControls:   "mute",
+		Controls: concatControls(
+			controlGroup("fader", ControlChange, 0, 19, 23, 27, 31, 49, 53, 57, 61),
+			named("master", ControlChange, 0, 62),
+			controlGroup("knobA", ControlChange, 0, 16, 20, 24, 28, 46, 50, 54, 58),
+			controlGroup("knobB", ControlChange, 0, 17, 21, 25, 29, 47, 51, 55, 59),
+			controlGroup("knobC", ControlChange, 0, 18, 22, 26, 30, 48, 52, 56, 60),
+			withLEDs(controlGroup("mute", Note, 0, 1, 4, 7, 10, 13, 16, 19, 22), 127, 0),
+			controlGroup("solo", Note, 0, 2, 5, 8, 11, 14, 17, 20, 23),
+			withLEDs(controlGroup("rec", Note, 0, 3, 6, 9, 12, 15, 18, 21, 24), 127, 0),
+			withLEDs(named("bankLeft", Note, 0, 25), 127, 0),
+			withLEDs(named("bankRight", Note, 0, 26), 127, 0),
+			named("soloButton", Note, 0, 27),
+		),
+	},
+}
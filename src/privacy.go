@@ -0,0 +1,164 @@
+package pamidicontrol
+
+import (
+	"sync"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// Privacy shows when applications use the microphone, and switches a privacy
+// mode that keeps every source muted.
+type Privacy struct {
+	// Indicator is lit while an application records from a source that
+	// isn't the monitor of a sink, such as a microphone.
+	Indicator *Button
+
+	// Button turns privacy mode on and off, and is lit while it is on.
+	Button *Button
+
+	// KillStreams ends the record streams that start while privacy mode is
+	// on, rather than muting them.
+	KillStreams bool
+}
+
+// savedMute is the mute state of an object before privacy mode muted it.
+type savedMute struct {
+	targetType PulseAudioTargetType
+	muted      bool
+}
+
+// privacyMode mutes every source, and every source and record stream that
+// appears while it is on. Turning it off puts back the mute state they had.
+// It is shared by the clients of every device.
+type privacyMode struct {
+	client *PAClient
+
+	// mu guards the fields below, and is held while objects are muted so
+	// that one appearing at the same time isn't missed.
+	mu    sync.Mutex
+	on    bool
+	kill  bool
+	saved map[dbus.ObjectPath]savedMute
+}
+
+func newPrivacyMode(client *PAClient) *privacyMode {
+	p := &privacyMode{client: client}
+	client.AddObjectListener(p.objectAppeared)
+	return p
+}
+
+// On returns whether privacy mode is on.
+func (p *privacyMode) On() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.on
+}
+
+// Set turns privacy mode on or off. kill ends the record streams that start
+// while it is on, rather than muting them.
+func (p *privacyMode) Set(on bool, kill bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.kill = kill
+	if on == p.on {
+		return
+	}
+	p.on = on
+
+	if on {
+		p.saved = make(map[dbus.ObjectPath]savedMute, 0)
+		for _, name := range p.client.TargetNames(Source) {
+			for _, path := range p.client.targetPaths(PulseAudioAction{TargetType: Source, TargetName: name}) {
+				p.mute(Source, path)
+			}
+		}
+		log.Info().Msg("Privacy mode is on, every source is muted")
+		return
+	}
+
+	for path, saved := range p.saved {
+		if err := p.client.object(saved.targetType, path).Set("Mute", saved.muted); err != nil {
+			log.Debug().Err(err).Msgf("Could not put back the mute state of %s", path)
+		}
+	}
+	p.saved = nil
+	log.Info().Msg("Privacy mode is off, the sources are back as they were")
+}
+
+// mute saves the mute state of an object and mutes it. The caller must hold
+// p.mu.
+func (p *privacyMode) mute(targetType PulseAudioTargetType, path dbus.ObjectPath) {
+	obj := p.client.object(targetType, path)
+	muted, err := obj.Bool("Mute")
+	if err != nil {
+		log.Warn().Err(err).Msgf("Could not read the mute state of %s", path)
+		return
+	}
+	if _, ok := p.saved[path]; !ok {
+		p.saved[path] = savedMute{targetType: targetType, muted: muted}
+	}
+	if err := obj.Set("Mute", true); err != nil {
+		log.Warn().Err(err).Msgf("Could not mute %s", path)
+	}
+}
+
+// objectAppeared mutes the sources that are plugged in while privacy mode is
+// on, and mutes or ends the record streams that start.
+func (p *privacyMode) objectAppeared(targetType PulseAudioTargetType, name string, path dbus.ObjectPath) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.on {
+		return
+	}
+
+	switch targetType {
+	case Source:
+		p.mute(Source, path)
+
+	case RecordStream:
+		// The meters record sources too, and would only start again.
+		if name == meterClientName {
+			return
+		}
+		if !p.kill {
+			log.Info().Msgf("Muting %s, which started recording in privacy mode", name)
+			p.mute(RecordStream, path)
+			return
+		}
+
+		log.Info().Msgf("Ending the record stream of %s, which started in privacy mode", name)
+		if err := p.client.Stream(path).Call("org.PulseAudio.Core1.Stream.Kill", 0).Err; err != nil {
+			log.Warn().Err(err).Msgf("Could not end the record stream of %s", name)
+		}
+	}
+}
+
+// guards returns whether privacy mode is keeping objects of the given type
+// muted, so their remembered mute state mustn't be put back.
+func (p *privacyMode) guards(targetType PulseAudioTargetType) bool {
+	return (targetType == Source || targetType == RecordStream) && p.On()
+}
+
+// keepMuted returns whether privacy mode keeps objects of the given type
+// muted, so the controls of the client mustn't unmute them.
+func (c *MidiClient) keepMuted(targetType PulseAudioTargetType) bool {
+	return c.privacy != nil && c.privacy.guards(targetType)
+}
+
+// handlePrivacyButton turns privacy mode on or off if an input comes from the
+// privacy button. It returns false for any other input.
+func (c *MidiClient) handlePrivacyButton(input midiInput) bool {
+	if c.Privacy == nil || c.Privacy.Button == nil || c.Privacy.Button.bindingKey() != input.bindingKey() {
+		return false
+	}
+
+	if input.Value > 0 {
+		c.privacy.Set(!c.privacy.On(), c.Privacy.KillStreams)
+		c.syncFeedback()
+	}
+	return true
+}
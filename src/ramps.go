@@ -0,0 +1,164 @@
+package pamidicontrol
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RampCurve is the shape of a volume ramp over its time.
+type RampCurve string
+
+const (
+	// LinearCurve changes the volume at the same pace all the way.
+	LinearCurve RampCurve = "Linear"
+	// SmoothCurve starts and ends slowly, and is quickest halfway through.
+	SmoothCurve RampCurve = "Smooth"
+)
+
+// Valid reports whether c is a known ramp curve. An empty curve is linear.
+func (c RampCurve) Valid() bool {
+	switch c {
+	case "", LinearCurve, SmoothCurve:
+		return true
+	}
+	return false
+}
+
+// shape returns how far along its volume change a ramp is, for progress
+// through its time between 0 and 1.
+func (c RampCurve) shape(progress float32) float32 {
+	if c == SmoothCurve {
+		return progress * progress * (3 - 2*progress)
+	}
+	return progress
+}
+
+// rampStep is how often the volume of a ramping target is changed.
+const rampStep = 20 * time.Millisecond
+
+// volumeRamp moves the volume of a target to a new volume gradually, from the
+// volume it has when the ramp starts.
+type volumeRamp struct {
+	duration time.Duration
+	curve    RampCurve
+	// slew is the fastest the volume may change, as a fraction of full
+	// volume a second. It makes larger changes take longer than duration.
+	slew float32
+
+	// fromZero starts the ramp from silence rather than the volume the
+	// target has.
+	fromZero bool
+
+	// begin runs once the first volume of the ramp is set, and end once
+	// the ramp gets to its volume. Neither runs if a new volume replaces
+	// the ramp first.
+	begin func()
+	end   func()
+
+	// restore is the volume put back by a ramp that fades a target out and
+	// mutes it.
+	restore *float32
+
+	// These are set when the ramp starts.
+	from    float32
+	to      float32
+	started time.Time
+	length  time.Duration
+}
+
+// volumeRamp returns the ramp of a volume change by an action, or nil if it
+// sets volumes straight away.
+func (a PulseAudioAction) volumeRamp() *volumeRamp {
+	if a.Ramp <= 0 && a.SlewRate <= 0 {
+		return nil
+	}
+	return &volumeRamp{duration: a.Ramp, curve: a.Curve, slew: a.SlewRate}
+}
+
+// start begins the ramp at from, heading to to.
+func (r *volumeRamp) start(from float32, to float32, now time.Time) {
+	if r.fromZero {
+		from = 0
+	}
+	r.from, r.to, r.started = from, to, now
+
+	r.length = r.duration
+	if r.slew > 0 {
+		change := to - from
+		if change < 0 {
+			change = -change
+		}
+		if slewed := time.Duration(float64(change) / float64(r.slew) * float64(time.Second)); slewed > r.length {
+			r.length = slewed
+		}
+	}
+}
+
+// at returns the volume of the ramp at a time, and whether the ramp has got
+// to its volume by then.
+func (r *volumeRamp) at(now time.Time) (float32, bool) {
+	if r.length <= 0 {
+		return r.to, true
+	}
+	progress := float32(now.Sub(r.started)) / float32(r.length)
+	if progress >= 1 {
+		return r.to, true
+	}
+	return r.from + (r.to-r.from)*r.curve.shape(progress), false
+}
+
+// toggleMuteRamp fades the target of a Mute action out and then mutes it,
+// putting its volume back once it is muted. A muted target is unmuted at
+// silence and faded back in. Pressing the button again while the target fades
+// out fades it back in instead. The new mute state is remembered once the
+// target is muted or unmuted, as a fader moved in the meantime replaces the
+// ramp before it gets there.
+func (c *MidiClient) toggleMuteRamp(action PulseAudioAction, received time.Time) error {
+	ramp := volumeRamp{duration: action.Ramp, curve: action.Curve}
+
+	if restore, ok := c.worker.fadingOut(action); ok {
+		c.worker.Ramp(action, restore, ramp, received)
+		return nil
+	}
+
+	tracked, ok, err := c.PAClient.TrackedVolume(action)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		log.Warn().Msgf("Could not find %s by name [%s] to toggle its mute state", targetTypeName(action.TargetType), action.TargetName)
+		return nil
+	}
+	volume := tracked.Volume
+	if pending, ok := c.worker.Pending(action); ok {
+		volume = pending
+	}
+
+	if tracked.Muted {
+		ramp.fromZero = true
+		ramp.begin = func() {
+			if err := c.PAClient.ProcessMuteAction(action, false); err != nil {
+				log.Warn().Err(err).Msgf("Could not unmute %s", targetKey(action))
+				return
+			}
+			c.state.setMute(action, false)
+		}
+		c.worker.Ramp(action, volume, ramp, received)
+		return nil
+	}
+
+	ramp.restore = &volume
+	ramp.end = func() {
+		if err := c.PAClient.ProcessMuteAction(action, true); err != nil {
+			log.Warn().Err(err).Msgf("Could not mute %s", targetKey(action))
+			return
+		}
+		c.state.setMute(action, true)
+		if err := c.PAClient.ProcessVolumeAction(workKey(action).action, volume); err != nil {
+			log.Warn().Err(err).Msgf("Could not put back the volume of %s", targetKey(action))
+		}
+	}
+	c.worker.Ramp(action, 0, ramp, received)
+	return nil
+}
@@ -0,0 +1,493 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"math"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// Safety protects the hearing of whoever listens, by limiting how loud and
+// how quickly sinks are turned up, and by keeping track of how much they have
+// listened to today.
+type Safety struct {
+	Sinks []SinkSafety
+
+	// DailyDose is the listening exposure allowed a day, as a fraction of
+	// the recommended limit of 85 dB for 8 hours. It defaults to 1.
+	DailyDose float64
+
+	// Notify shows a desktop notification when the daily dose is exceeded,
+	// as well as the warning in the log.
+	Notify bool
+
+	// ReduceTo lowers the sinks that count towards the exposure to this
+	// volume once the daily dose is exceeded, gradually over ReduceOver,
+	// which is 10 minutes by default.
+	ReduceTo   *float32
+	ReduceOver time.Duration
+}
+
+// SinkSafety limits the volume of a sink.
+type SinkSafety struct {
+	Sink string
+
+	// MaxVolume is the loudest the sink can be turned up to, by
+	// pamidicontrol or any other application.
+	MaxVolume *float32
+
+	// MaxRise is the fastest the volume of the sink can go up, as a fraction
+	// of full volume a second.
+	MaxRise float32
+
+	// FullScaleLevel is how loud typical music is at full volume on the
+	// sink, in dB SPL, such as 100 for a pair of headphones. Only sinks with
+	// it set count towards the listening exposure.
+	FullScaleLevel float64
+}
+
+// The defaults of the safety settings.
+const (
+	defaultDailyDose  = 1
+	defaultReduceOver = 10 * time.Minute
+)
+
+// The recommended exposure limit, and how much louder halves the time it
+// allows.
+const (
+	exposureLevel        = 85
+	exposureHours        = 8
+	exposureExchangeRate = 3
+)
+
+// exposureStep is how often the listening exposure is added up, and
+// exposureSaveEvery how often it is saved.
+const (
+	exposureStep      = time.Second
+	exposureSaveEvery = time.Minute
+)
+
+// doseBlink is how long the dose indicator stays on and off while it blinks.
+const doseBlink = 500 * time.Millisecond
+
+// deviceRunning is the state of a pulseaudio device that is playing.
+const deviceRunning = 0
+
+// tracksExposure returns whether any sink counts towards the listening
+// exposure.
+func (s Safety) tracksExposure() bool {
+	for _, sink := range s.Sinks {
+		if sink.FullScaleLevel > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Safety) dailyDose() float64 {
+	if s.DailyDose > 0 {
+		return s.DailyDose
+	}
+	return defaultDailyDose
+}
+
+func (s Safety) reduceOver() time.Duration {
+	if s.ReduceOver > 0 {
+		return s.ReduceOver
+	}
+	return defaultReduceOver
+}
+
+// exposureRate returns the fraction of the recommended daily exposure a
+// second of listening at a level uses up.
+func exposureRate(level float64) float64 {
+	allowed := exposureHours * 3600 / math.Pow(2, (level-exposureLevel)/exposureExchangeRate)
+	return 1 / allowed
+}
+
+// volumeLevel returns how loud a sink plays at a volume, given how loud it is
+// at full volume. Pulseaudio volumes are cubic, so the level falls by 60 dB
+// for every factor of ten.
+func volumeLevel(fullScale float64, volume float32) float64 {
+	return fullScale + 60*math.Log10(float64(volume))
+}
+
+// sinkGuard is the state of a limited sink.
+type sinkGuard struct {
+	SinkSafety
+
+	// level is the volume the sink was last allowed, at the given time, and
+	// wanted the volume it is rising towards.
+	level  float32
+	at     time.Time
+	wanted float32
+
+	// external is the number of changes made by other applications that
+	// have been looked at.
+	external uint64
+
+	// cap lowers the maximum volume once the daily dose is exceeded, by
+	// capStep every second.
+	cap     *float32
+	capStep float32
+}
+
+// allowed returns the loudest the sink may be at a time, given how fast it
+// may rise.
+func (g *sinkGuard) allowed(now time.Time) float32 {
+	if g.MaxRise <= 0 || g.at.IsZero() {
+		return math.MaxFloat32
+	}
+	return g.level + g.MaxRise*float32(now.Sub(g.at).Seconds())
+}
+
+// maxVolume returns the loudest the sink may be turned up to.
+func (g *sinkGuard) maxVolume() float32 {
+	max := float32(math.MaxFloat32)
+	if g.MaxVolume != nil {
+		max = *g.MaxVolume
+	}
+	if g.cap != nil && *g.cap < max {
+		max = *g.cap
+	}
+	return max
+}
+
+// safetyLimiter enforces the limits of the sinks, whoever changes their
+// volume, and adds up the listening exposure.
+type safetyLimiter struct {
+	client *PAClient
+	state  *controllerState
+	safety Safety
+
+	// mu guards the fields below.
+	mu     sync.Mutex
+	sinks  map[string]*sinkGuard
+	rising bool
+
+	// day is the date the exposure is added up for, and dose how much of
+	// the recommended daily exposure has been used up on it.
+	day      string
+	dose     float64
+	exceeded bool
+}
+
+func newSafetyLimiter(client *PAClient, state *controllerState, safety Safety) *safetyLimiter {
+	l := &safetyLimiter{
+		client: client,
+		state:  state,
+		safety: safety,
+		sinks:  make(map[string]*sinkGuard, 0),
+	}
+	for _, sink := range safety.Sinks {
+		l.sinks[sink.Sink] = &sinkGuard{SinkSafety: sink}
+	}
+
+	l.day, l.dose = state.exposure()
+	if l.day == time.Now().Format("2006-01-02") && l.dose >= safety.dailyDose() {
+		l.exceeded = true
+		log.Warn().Msgf("Today's listening exposure is already at %.0f%% of the daily dose", 100*l.dose/safety.dailyDose())
+	}
+
+	client.mu.Lock()
+	client.limiter = l
+	client.mu.Unlock()
+
+	client.AddListener(l.volumeChanged)
+	go l.track()
+	return l
+}
+
+// guard returns the limits of the sink at path, if it has any.
+func (l *safetyLimiter) guard(path dbus.ObjectPath) (*sinkGuard, bool) {
+	name, ok := l.client.nameOf(Sink, path)
+	if !ok {
+		return nil, false
+	}
+	g, ok := l.sinks[name]
+	return g, ok
+}
+
+// limit returns the volume a sink is set to when pamidicontrol asks for a
+// volume. A volume that rises too fast is reached gradually.
+func (l *safetyLimiter) limit(path dbus.ObjectPath, volume float32) float32 {
+	g, ok := l.guard(path)
+	if !ok {
+		return volume
+	}
+	tracked, _, _ := l.client.pathVolume(Sink, path)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if g.at.IsZero() {
+		g.level, g.at = tracked.Volume, now
+	}
+
+	if max := g.maxVolume(); volume > max {
+		volume = max
+	}
+	g.wanted = volume
+	if allowed := g.allowed(now); volume > allowed {
+		volume = allowed
+		l.startRising()
+	}
+	g.level, g.at = volume, now
+	return volume
+}
+
+// volumeChanged enforces the limits on a sink whose volume another
+// application changed.
+func (l *safetyLimiter) volumeChanged(path dbus.ObjectPath) {
+	if path == "" {
+		return
+	}
+	g, ok := l.guard(path)
+	if !ok {
+		return
+	}
+	tracked, ok := l.client.trackedVolume(path)
+	if !ok {
+		return
+	}
+
+	l.mu.Lock()
+	if tracked.ExternalChanges == g.external {
+		l.mu.Unlock()
+		return
+	}
+	g.external = tracked.ExternalChanges
+
+	now := time.Now()
+	if g.at.IsZero() {
+		// Without an earlier volume to rise from, only the maximum applies.
+		g.level, g.at = tracked.Volume, now
+	} else if tracked.Volume <= g.level {
+		// Turning it down is always fine, and stops it rising.
+		g.level, g.at, g.wanted = tracked.Volume, now, tracked.Volume
+		l.mu.Unlock()
+		return
+	}
+
+	g.wanted = tracked.Volume
+	if max := g.maxVolume(); g.wanted > max {
+		g.wanted = max
+	}
+	volume := g.wanted
+	if allowed := g.allowed(now); volume > allowed {
+		volume = allowed
+		l.startRising()
+	}
+	g.level, g.at = volume, now
+	l.mu.Unlock()
+
+	if volume < tracked.Volume {
+		log.Info().Msgf("Limiting the volume of %s to %.0f%%", g.Sink, volume*100)
+		if err := l.client.applyVolume(Sink, path, volume, tracked.Balance); err != nil {
+			log.Warn().Err(err).Msgf("Could not limit the volume of %s", g.Sink)
+		}
+	}
+}
+
+// startRising starts raising the sinks that are below the volume they were
+// asked for. The caller must hold l.mu.
+func (l *safetyLimiter) startRising() {
+	if !l.rising {
+		l.rising = true
+		go l.rise()
+	}
+}
+
+// rise raises the sinks towards the volumes they were asked for as fast as
+// they may, until they have all got there.
+func (l *safetyLimiter) rise() {
+	for {
+		time.Sleep(rampStep)
+		now := time.Now()
+
+		l.mu.Lock()
+		raised := make(map[string]float32, 0)
+		for name, g := range l.sinks {
+			if g.level >= g.wanted {
+				continue
+			}
+			g.level = min32(g.wanted, g.allowed(now))
+			g.at = now
+			raised[name] = g.level
+		}
+		if len(raised) == 0 {
+			l.rising = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+
+		for name, volume := range raised {
+			l.setSink(name, volume)
+		}
+	}
+}
+
+// setSink sets the volume of a limited sink, bypassing its limits.
+func (l *safetyLimiter) setSink(name string, volume float32) {
+	for _, path := range l.client.targetPaths(PulseAudioAction{TargetType: Sink, TargetName: name}) {
+		if err := l.client.applyVolume(Sink, path, volume, l.client.balanceOf(path)); err != nil {
+			log.Warn().Err(err).Msgf("Could not set the volume of %s", name)
+		}
+	}
+}
+
+// track adds up the listening exposure every step, from the loudest sink that
+// is playing.
+func (l *safetyLimiter) track() {
+	last := time.Now()
+	saved := last
+	for range time.Tick(exposureStep) {
+		now := time.Now()
+		elapsed := now.Sub(last)
+		last = now
+
+		loudest := math.Inf(-1)
+		for name, g := range l.sinks {
+			if g.FullScaleLevel <= 0 {
+				continue
+			}
+			for _, path := range l.client.targetPaths(PulseAudioAction{TargetType: Sink, TargetName: name}) {
+				if state, err := l.client.Device(path).Uint32("State"); err != nil || state != deviceRunning {
+					continue
+				}
+				tracked, ok, err := l.client.pathVolume(Sink, path)
+				if err != nil || !ok || tracked.Muted || tracked.Volume <= 0 {
+					continue
+				}
+				loudest = math.Max(loudest, volumeLevel(g.FullScaleLevel, tracked.Volume))
+			}
+		}
+
+		l.addExposure(loudest, elapsed, now)
+		if now.Sub(saved) >= exposureSaveEvery {
+			saved = now
+			l.mu.Lock()
+			l.state.setExposure(l.day, l.dose)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// addExposure adds listening at a level for a while to the dose of the day,
+// warning once it goes over the daily dose and lowering the sinks after that.
+func (l *safetyLimiter) addExposure(level float64, elapsed time.Duration, now time.Time) {
+	l.mu.Lock()
+
+	if day := now.Format("2006-01-02"); day != l.day {
+		l.day, l.dose, l.exceeded = day, 0, false
+		for _, g := range l.sinks {
+			g.cap = nil
+		}
+	}
+	if !math.IsInf(level, -1) {
+		l.dose += elapsed.Seconds() * exposureRate(level)
+	}
+
+	warn := false
+	if !l.exceeded && l.dose >= l.safety.dailyDose() {
+		l.exceeded = true
+		warn = true
+	}
+
+	lowered := make(map[string]float32, 0)
+	if l.exceeded && l.safety.ReduceTo != nil {
+		lowered = l.lowerCaps(elapsed)
+	}
+	l.mu.Unlock()
+
+	if warn {
+		msg := fmt.Sprintf("Today's listening exposure has gone over the daily dose, at %.0f dB just now", level)
+		log.Warn().Msg(msg)
+		if l.safety.Notify {
+			go notify(msg)
+		}
+	}
+	for name, volume := range lowered {
+		l.setSink(name, volume)
+	}
+}
+
+// lowerCaps lowers the maximum volume of the sinks that count towards the
+// exposure, returning the volumes of those that have to come down. The
+// caller must hold l.mu.
+func (l *safetyLimiter) lowerCaps(elapsed time.Duration) map[string]float32 {
+	floor := *l.safety.ReduceTo
+	lowered := make(map[string]float32, 0)
+
+	for name, g := range l.sinks {
+		if g.FullScaleLevel <= 0 || g.at.IsZero() {
+			continue
+		}
+		if g.cap == nil {
+			start := g.level
+			if start < floor {
+				start = floor
+			}
+			g.cap = &start
+			g.capStep = (start - floor) / float32(l.safety.reduceOver().Seconds())
+		}
+
+		*g.cap = max32(floor, *g.cap-g.capStep*float32(elapsed.Seconds()))
+		if g.wanted > *g.cap {
+			g.wanted = *g.cap
+		}
+		if g.level > *g.cap {
+			g.level = *g.cap
+			lowered[name] = g.level
+		}
+	}
+	return lowered
+}
+
+// Exceeded returns whether the daily dose has been exceeded today.
+func (l *safetyLimiter) Exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.exceeded
+}
+
+// notify shows a desktop notification.
+func notify(msg string) {
+	if err := exec.Command("notify-send", "--urgency=critical", "pamidicontrol", msg).Run(); err != nil {
+		log.Warn().Err(err).Msg("Could not show a notification, which needs notify-send")
+	}
+}
+
+// doseIndicatorOn returns whether the dose indicator is lit, which it is every
+// other blink while the daily dose is exceeded.
+func (c *MidiClient) doseIndicatorOn() bool {
+	if c.safety == nil || !c.safety.Exceeded() {
+		return false
+	}
+	return time.Now().UnixNano()/int64(doseBlink)%2 == 0
+}
+
+// startDoseIndicator blinks the dose indicator while the daily dose is
+// exceeded.
+func (c *MidiClient) startDoseIndicator() {
+	if c.DoseIndicator == nil || c.safety == nil {
+		return
+	}
+
+	go func() {
+		lit := false
+		for range time.Tick(doseBlink) {
+			if on := c.doseIndicatorOn(); on || lit {
+				lit = on
+				c.syncFeedback()
+			}
+		}
+	}()
+}
@@ -0,0 +1,46 @@
+package pamidicontrol
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestExposureRate(t *testing.T) {
+	tests := []struct {
+		level float64
+		// allowed is how long the level can be listened to a day.
+		allowed time.Duration
+	}{
+		{85, 8 * time.Hour},
+		{88, 4 * time.Hour},
+		{82, 16 * time.Hour},
+		{100, 15 * time.Minute},
+		{70, 256 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		want := 1 / tt.allowed.Seconds()
+		if got := exposureRate(tt.level); math.Abs(got-want) > want*1e-9 {
+			t.Errorf("exposureRate(%v) = %v, want %v", tt.level, got, want)
+		}
+	}
+}
+
+func TestVolumeLevel(t *testing.T) {
+	tests := []struct {
+		fullScale float64
+		volume    float32
+		want      float64
+	}{
+		{100, 1, 100},
+		{100, 0.1, 40},
+		{94, 0.5, 94 + 60*math.Log10(0.5)},
+	}
+
+	for _, tt := range tests {
+		if got := volumeLevel(tt.fullScale, tt.volume); math.Abs(got-tt.want) > 1e-4 {
+			t.Errorf("volumeLevel(%v, %v) = %v, want %v", tt.fullScale, tt.volume, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package pamidicontrol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Scene is a snapshot of the mixer: the volume and mute state of every object,
+// the sink and source each stream is on, and the default devices. Objects are
+// stored by name so a scene can be recalled after they have been recreated.
+type Scene struct {
+	DefaultSink   string `yaml:"DefaultSink,omitempty"`
+	DefaultSource string `yaml:"DefaultSource,omitempty"`
+
+	Targets []SceneTarget `yaml:"Targets"`
+}
+
+// SceneTarget is the state of a single object in a scene.
+type SceneTarget struct {
+	TargetType PulseAudioTargetType `yaml:"TargetType"`
+	TargetName string               `yaml:"TargetName"`
+
+	Volume  float32 `yaml:"Volume"`
+	Balance float32 `yaml:"Balance,omitempty"`
+	Mute    bool    `yaml:"Mute"`
+
+	// DeviceName is the sink or source a stream is on.
+	DeviceName string `yaml:"DeviceName,omitempty"`
+}
+
+// LoadScenes reads the scenes stored at path, by name. A missing file has no
+// scenes.
+func LoadScenes(path string) (map[string]Scene, error) {
+	scenes := make(map[string]Scene, 0)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scenes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &scenes); err != nil {
+		return nil, err
+	}
+	return scenes, nil
+}
+
+// SaveScenes writes scenes to path, replacing what was there.
+func SaveScenes(path string, scenes map[string]Scene) error {
+	data, err := yaml.Marshal(scenes)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// SceneNames returns the names of scenes in order.
+func SceneNames(scenes map[string]Scene) []string {
+	names := make([]string, 0, len(scenes))
+	for name := range scenes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CaptureScene takes a snapshot of every object that is currently known.
+// Objects that share a name are stored once, with the state of the first.
+func (c *PAClient) CaptureScene() (Scene, error) {
+	var scene Scene
+
+	for _, targetType := range []PulseAudioTargetType{Sink, Source, PlaybackStream, RecordStream} {
+		for _, name := range c.TargetNames(targetType) {
+			action := PulseAudioAction{TargetType: targetType, TargetName: name}
+			tracked, ok, err := c.TrackedVolume(action)
+			if err != nil {
+				return scene, err
+			}
+			if !ok {
+				continue
+			}
+
+			target := SceneTarget{
+				TargetType: targetType,
+				TargetName: name,
+				Volume:     tracked.Volume,
+				Balance:    tracked.Balance,
+				Mute:       tracked.Muted,
+			}
+
+			if targetType == PlaybackStream || targetType == RecordStream {
+				device, err := c.Stream(tracked.Path).ObjectPath("Device")
+				if err != nil {
+					return scene, err
+				}
+				target.DeviceName, _ = c.nameOf(deviceType(targetType), device)
+			}
+
+			scene.Targets = append(scene.Targets, target)
+		}
+	}
+
+	if sink, err := c.Core().ObjectPath("FallbackSink"); err == nil {
+		scene.DefaultSink, _ = c.nameOf(Sink, sink)
+	}
+	if source, err := c.Core().ObjectPath("FallbackSource"); err == nil {
+		scene.DefaultSource, _ = c.nameOf(Source, source)
+	}
+
+	return scene, nil
+}
+
+// RecallScene puts the mixer back into the state of a scene, for the scene
+// command. Mute states, routing and default devices change straight away,
+// while the volumes fade to the scene over fade in the shape of curve, the
+// same way as a RecallScene action. It returns once the fade is done. Objects
+// in the scene that don't exist right now are skipped. The privacy mode of a
+// running pamidicontrol isn't known here, so sources and record streams are
+// unmuted if the scene has them unmuted.
+func (c *PAClient) RecallScene(scene Scene, fade time.Duration, curve RampCurve) error {
+	fades, err := c.applyScene(scene, nil)
+	if err != nil {
+		return err
+	}
+
+	worker := newVolumeWorker(c, 0)
+	fadeScene(worker, fades, fade, curve, time.Now())
+	worker.wait()
+	return nil
+}
+
+// fadeScene queues the volumes of a recalled scene on worker, fading them over
+// fade in the shape of curve. Setting the volume of a target in the meantime,
+// such as by recalling another scene, takes over from its fade.
+func fadeScene(worker *volumeWorker, fades []sceneFade, fade time.Duration, curve RampCurve, received time.Time) {
+	for _, f := range fades {
+		target := f.action
+		target.Ramp, target.Curve = fade, curve
+		worker.Set(target, f.to, received)
+	}
+}
+
+// sceneFade is the volume a target of a scene fades from and to.
+type sceneFade struct {
+	action PulseAudioAction
+	from   float32
+	to     float32
+}
+
+// applyScene changes the mute states, routing, balance and default devices to
+// those of a scene, and returns the volumes left to fade. Objects of the types
+// keepMuted returns true for aren't unmuted; it may be nil.
+func (c *PAClient) applyScene(scene Scene, keepMuted func(PulseAudioTargetType) bool) ([]sceneFade, error) {
+	if err := c.setDefaultDevice(Sink, "FallbackSink", scene.DefaultSink); err != nil {
+		return nil, err
+	}
+	if err := c.setDefaultDevice(Source, "FallbackSource", scene.DefaultSource); err != nil {
+		return nil, err
+	}
+
+	fades := make([]sceneFade, 0, len(scene.Targets))
+
+	for _, target := range scene.Targets {
+		action := PulseAudioAction{TargetType: target.TargetType, TargetName: target.TargetName}
+		tracked, ok, err := c.TrackedVolume(action)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Debug().Msgf("Skipping %s [%s], it doesn't exist right now", targetTypeName(target.TargetType), target.TargetName)
+			continue
+		}
+
+		if target.DeviceName != "" {
+			action.DeviceName = target.DeviceName
+			if err := c.ProcessMoveAction(action); err != nil {
+				log.Warn().Err(err).Msgf("Could not move %s [%s]", targetTypeName(target.TargetType), target.TargetName)
+			}
+		}
+
+		if tracked.Muted && !target.Mute && keepMuted != nil && keepMuted(target.TargetType) {
+			log.Info().Msgf("Leaving %s [%s] muted, as privacy mode is on", targetTypeName(target.TargetType), target.TargetName)
+		} else if tracked.Muted != target.Mute {
+			if err := c.ProcessMuteAction(action, target.Mute); err != nil {
+				return nil, err
+			}
+		}
+
+		if err := c.SetBalance(action, target.Balance); err != nil {
+			return nil, err
+		}
+		fades = append(fades, sceneFade{action, tracked.Volume, target.Volume})
+	}
+	return fades, nil
+}
+
+// setDefaultDevice makes the named sink or source the default, through the
+// given core property.
+func (c *PAClient) setDefaultDevice(targetType PulseAudioTargetType, property string, name string) error {
+	if name == "" {
+		return nil
+	}
+
+	paths := c.targetPaths(PulseAudioAction{TargetType: targetType, TargetName: name})
+	if len(paths) == 0 {
+		log.Warn().Msgf("Could not find %s by name [%s] to make it the default", targetTypeName(targetType), name)
+		return nil
+	}
+	return c.Core().Set(property, paths[0])
+}
+
+// nameOf returns the name an object is indexed by.
+func (c *PAClient) nameOf(targetType PulseAudioTargetType, path dbus.ObjectPath) (string, bool) {
+	for name, paths := range c.objectsByName(targetType) {
+		if containsPath(paths, path) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// deviceType returns the type of device streams of the given type play to or
+// record from.
+func deviceType(streamType PulseAudioTargetType) PulseAudioTargetType {
+	if streamType == RecordStream {
+		return Source
+	}
+	return Sink
+}
@@ -0,0 +1,58 @@
+package pamidicontrol
+
+import (
+	"github.com/rs/zerolog/log"
+	"gitlab.com/gomidi/midi"
+)
+
+// ControllerSetup configures the controller itself when its ports are opened,
+// for controllers whose preset knows how to.
+type ControllerSetup struct {
+	// Toggle lists the buttons that switch on and off with each press,
+	// rather than only while they are held down.
+	Toggle []string
+
+	// Save writes the settings to the memory of the controller, so they
+	// are kept when it is unplugged.
+	Save bool
+}
+
+// toggles returns whether the named button is set to toggle.
+func (s ControllerSetup) toggles(name string) bool {
+	for _, toggle := range s.Toggle {
+		if toggle == name {
+			return true
+		}
+	}
+	return false
+}
+
+// controllerSetup configures a controller over system exclusive messages, so
+// that it sends the messages of its preset and lets the host light its LEDs.
+type controllerSetup interface {
+	setup(in midi.In, out midi.Out, preset *ControllerPreset, options ControllerSetup) error
+}
+
+// setupController configures the controller on the open ports, before its
+// input is listened to.
+func (c *MidiClient) setupController(in midi.In, out midi.Out) {
+	options := c.Setup
+	if options == nil && c.Matrix != nil && c.Preset != nil && c.Preset.setup != nil {
+		// Grid controllers only send the notes of their preset once they
+		// have been set up.
+		options = &ControllerSetup{}
+	}
+	if options == nil || c.Preset == nil {
+		return
+	}
+	if c.Preset.setup == nil {
+		log.Warn().Msgf("The %s preset can't set up the controller", c.Preset.Name)
+		return
+	}
+
+	if err := c.Preset.setup.setup(in, out, c.Preset, *options); err != nil {
+		log.Warn().Err(err).Msgf("Could not set up the %s", c.Preset.Name)
+		return
+	}
+	log.Info().Msgf("Set up the %s", c.Preset.Name)
+}
@@ -0,0 +1,63 @@
+package pamidicontrol
+
+import (
+	"reflect"
+
+	"github.com/godbus/dbus"
+	"github.com/sqp/pulseaudio"
+)
+
+// OnStreamDeviceUpdated is an interface to the StreamDeviceUpdated method.
+type OnStreamDeviceUpdated interface {
+	StreamDeviceUpdated(dbus.ObjectPath, dbus.ObjectPath)
+}
+
+// OnNewRecordStream is an interface to the NewRecordStream method.
+type OnNewRecordStream interface {
+	NewRecordStream(dbus.ObjectPath)
+}
+
+// OnRecordStreamRemoved is an interface to the RecordStreamRemoved method.
+type OnRecordStreamRemoved interface {
+	RecordStreamRemoved(dbus.ObjectPath)
+}
+
+// OnNewSource is an interface to the NewSource method.
+type OnNewSource interface {
+	NewSource(dbus.ObjectPath)
+}
+
+// OnSourceRemoved is an interface to the SourceRemoved method.
+type OnSourceRemoved interface {
+	SourceRemoved(dbus.ObjectPath)
+}
+
+// The pulseaudio library only knows some of the signals of the pulseaudio
+// D-Bus interface. The others are added to its tables before any client is made, so
+// PAClient is registered for them like the rest.
+func init() {
+	pulseaudio.PulseCalls["Stream.DeviceUpdated"] = func(m pulseaudio.Msg) {
+		m.O.(OnStreamDeviceUpdated).StreamDeviceUpdated(m.P, m.D[0].(dbus.ObjectPath))
+	}
+	pulseaudio.PulseTypes["Stream.DeviceUpdated"] = reflect.TypeOf((*OnStreamDeviceUpdated)(nil)).Elem()
+
+	pulseaudio.PulseCalls["NewRecordStream"] = func(m pulseaudio.Msg) {
+		m.O.(OnNewRecordStream).NewRecordStream(m.D[0].(dbus.ObjectPath))
+	}
+	pulseaudio.PulseTypes["NewRecordStream"] = reflect.TypeOf((*OnNewRecordStream)(nil)).Elem()
+
+	pulseaudio.PulseCalls["RecordStreamRemoved"] = func(m pulseaudio.Msg) {
+		m.O.(OnRecordStreamRemoved).RecordStreamRemoved(m.D[0].(dbus.ObjectPath))
+	}
+	pulseaudio.PulseTypes["RecordStreamRemoved"] = reflect.TypeOf((*OnRecordStreamRemoved)(nil)).Elem()
+
+	pulseaudio.PulseCalls["NewSource"] = func(m pulseaudio.Msg) {
+		m.O.(OnNewSource).NewSource(m.D[0].(dbus.ObjectPath))
+	}
+	pulseaudio.PulseTypes["NewSource"] = reflect.TypeOf((*OnNewSource)(nil)).Elem()
+
+	pulseaudio.PulseCalls["SourceRemoved"] = func(m pulseaudio.Msg) {
+		m.O.(OnSourceRemoved).SourceRemoved(m.D[0].(dbus.ObjectPath))
+	}
+	pulseaudio.PulseTypes["SourceRemoved"] = reflect.TypeOf((*OnSourceRemoved)(nil)).Elem()
+}
@@ -0,0 +1,213 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// stateSaveDelay is how long changes are collected before the state file is
+// written, so moving a fader doesn't write it for every step.
+const stateSaveDelay = 2 * time.Second
+
+// controllerState remembers the volume last set by every mapping and the mute
+// state last set on every target, and keeps them in a file so they survive
+// restarts.
+type controllerState struct {
+	path string
+
+	mu sync.Mutex
+	// Volumes holds the volume of each mapping, by mappingKey.
+	Volumes map[string]float32 `yaml:"Volumes"`
+	// Mutes holds the mute state of each target, by targetKey.
+	Mutes map[string]bool `yaml:"Mutes"`
+	// ExposureDose is the listening exposure added up on ExposureDay, as a
+	// fraction of the recommended daily exposure.
+	ExposureDay  string  `yaml:"ExposureDay,omitempty"`
+	ExposureDose float64 `yaml:"ExposureDose,omitempty"`
+
+	saving bool
+}
+
+func newControllerState(path string) *controllerState {
+	return &controllerState{
+		path:    path,
+		Volumes: make(map[string]float32, 0),
+		Mutes:   make(map[string]bool, 0),
+	}
+}
+
+// loadControllerState reads the state saved at path. A missing file is an
+// empty state.
+func loadControllerState(path string) (*controllerState, error) {
+	state := newControllerState(path)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if state.Volumes == nil {
+		state.Volumes = make(map[string]float32, 0)
+	}
+	if state.Mutes == nil {
+		state.Mutes = make(map[string]bool, 0)
+	}
+	return state, nil
+}
+
+// mustLoadControllerState reads the state saved at path, starting afresh if it
+// can't be read.
+func mustLoadControllerState(path string) *controllerState {
+	state, err := loadControllerState(path)
+	if err != nil {
+		log.Warn().Err(err).Msg("Could not load the controller state, starting afresh")
+		return newControllerState(path)
+	}
+	return state
+}
+
+// mappingKey identifies a mapping in the state file.
+func mappingKey(action MidiAction) string {
+	return fmt.Sprintf("%s: %s", action, targetKey(action.Action))
+}
+
+// targetKey identifies a target in the state file.
+func targetKey(action PulseAudioAction) string {
+	return fmt.Sprintf("%s [%s]", targetTypeName(action.TargetType), action.TargetName)
+}
+
+func (s *controllerState) setVolume(action MidiAction, volume float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Volumes[mappingKey(action)] = volume
+	s.scheduleSave()
+}
+
+func (s *controllerState) volume(action MidiAction) (float32, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volume, ok := s.Volumes[mappingKey(action)]
+	return volume, ok
+}
+
+func (s *controllerState) setMute(action PulseAudioAction, muted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Mutes[targetKey(action)] = muted
+	s.scheduleSave()
+}
+
+func (s *controllerState) mute(action PulseAudioAction) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	muted, ok := s.Mutes[targetKey(action)]
+	return muted, ok
+}
+
+func (s *controllerState) setExposure(day string, dose float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ExposureDay, s.ExposureDose = day, dose
+	s.scheduleSave()
+}
+
+func (s *controllerState) exposure() (string, float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.ExposureDay, s.ExposureDose
+}
+
+// scheduleSave writes the state once the changes have settled. The caller
+// must hold s.mu.
+func (s *controllerState) scheduleSave() {
+	if s.saving {
+		return
+	}
+	s.saving = true
+
+	time.AfterFunc(stateSaveDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.saving = false
+		if err := s.save(); err != nil {
+			log.Warn().Err(err).Msgf("Could not save the controller state to %s", s.path)
+		}
+	})
+}
+
+// save writes the state file. The caller must hold s.mu.
+func (s *controllerState) save() error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, data, 0644)
+}
+
+// restoreObjects applies the remembered volume and mute state to an object
+// that has just appeared, so that it starts out where its controls are. It is
+// registered once for every client, as they share the state, the worker and
+// privacy mode, and only changes the new object, not the others of the same
+// name.
+func restoreObjects(clients []*MidiClient, targetType PulseAudioTargetType, name string, path dbus.ObjectPath) {
+	if len(clients) == 0 {
+		return
+	}
+	c := clients[0]
+	target := PulseAudioAction{TargetType: targetType, TargetName: name}
+
+	if volume, action, ok := rememberedVolume(clients, target); ok {
+		log.Info().Msgf("Setting the volume of %s to %.0f%% from %s", targetKey(target), volume*100, action)
+		c.worker.SetObject(target, path, volume, time.Now())
+	}
+
+	if c.privacy != nil && c.privacy.guards(targetType) {
+		return
+	}
+	if muted, ok := c.state.mute(target); ok {
+		if err := c.PAClient.object(targetType, path).Set("Mute", muted); err != nil {
+			log.Warn().Err(err).Msgf("Could not restore the mute state of %s", targetKey(target))
+		}
+	}
+}
+
+// rememberedVolume returns the volume last set on a target by the first of
+// the mappings of the clients that has one.
+func rememberedVolume(clients []*MidiClient, target PulseAudioAction) (float32, MidiAction, bool) {
+	for _, c := range clients {
+		for _, action := range c.actions() {
+			if action.Action.TargetType != target.TargetType || action.Action.TargetName != target.TargetName || action.Action.ActionType != VolumeChange {
+				continue
+			}
+			if volume, ok := c.state.volume(action); ok {
+				return volume, action, true
+			}
+		}
+	}
+	return 0, MidiAction{}, false
+}
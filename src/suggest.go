@@ -0,0 +1,82 @@
+package pamidicontrol
+
+import (
+	"sort"
+	"strings"
+)
+
+// closestNames returns up to max of the candidates that are closest to name,
+// ignoring candidates that are too different to be a plausible typo.
+func closestNames(name string, candidates []string, max int) []string {
+	type scored struct {
+		name     string
+		distance int
+	}
+
+	lowerName := strings.ToLower(name)
+	matches := make([]scored, 0)
+
+	for _, candidate := range candidates {
+		lowerCandidate := strings.ToLower(candidate)
+		distance := levenshtein(lowerName, lowerCandidate)
+
+		if strings.Contains(lowerCandidate, lowerName) || strings.Contains(lowerName, lowerCandidate) {
+			distance = distance / 2
+		}
+
+		limit := len(name) / 2
+		if limit < 3 {
+			limit = 3
+		}
+		if distance > limit {
+			continue
+		}
+
+		matches = append(matches, scored{candidate, distance})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+
+	names := make([]string, 0, max)
+	for i := 0; i < len(matches) && i < max; i++ {
+		names = append(names, matches[i].name)
+	}
+	return names
+}
+
+// levenshtein computes the edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
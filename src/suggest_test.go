@@ -0,0 +1,50 @@
+package pamidicontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"", "abc", 3},
+		{"abc", "", 3},
+		{"Sink", "Sink", 0},
+		{"Sink", "Sinks", 1},
+		{"Mute", "Mtue", 2},
+		{"kitten", "sitting", 3},
+		{"héllo", "hello", 1},
+	}
+
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestClosestNames(t *testing.T) {
+	candidates := []string{"VolumeChange", "Mute", "Move", "RecallScene"}
+
+	tests := []struct {
+		name string
+		max  int
+		want []string
+	}{
+		{"VolumeChang", 3, []string{"VolumeChange"}},
+		{"mute", 3, []string{"Mute", "Move"}},
+		{"mute", 1, []string{"Mute"}},
+		{"Volume", 3, []string{"VolumeChange"}},
+		{"Balance", 3, []string{}},
+	}
+
+	for _, tt := range tests {
+		if got := closestNames(tt.name, candidates, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("closestNames(%q, %d) = %q, want %q", tt.name, tt.max, got, tt.want)
+		}
+	}
+}
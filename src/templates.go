@@ -0,0 +1,181 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// templateIndex is replaced by the position of a control, starting at 1, in
+// the TargetName of a template.
+const templateIndex = "{n}"
+
+// MidiTemplate maps a block of controls with a single rule, such as faders 1
+// to 8 to eight sinks. It is expanded into one mapping per control when the
+// configuration is loaded.
+type MidiTemplate struct {
+	// Controls names controls of the preset. Otherwise the template covers
+	// the controllers or notes from FirstController to LastController.
+	Controls []string
+
+	ActionType      MidiActionType
+	Channel         uint8
+	FirstController uint8
+	LastController  uint8
+
+	// Omni maps the controls on every channel rather than just Channel.
+	Omni bool
+
+	MaxInputValue uint
+	Relative      RelativeEncoding
+	Pickup        PickupMode
+
+	// TargetNames gives the target of each control in order. Otherwise
+	// the TargetName of the Action is used, with {n} replaced by the
+	// position of the control.
+	TargetNames []string
+
+	Action PulseAudioAction
+
+	// count is the number of mappings the template was expanded into.
+	count int
+}
+
+// targetName returns the target of the control at position i.
+func (t MidiTemplate) targetName(i int) string {
+	if len(t.TargetNames) > 0 {
+		return t.TargetNames[i]
+	}
+	return strings.Replace(t.Action.TargetName, templateIndex, strconv.Itoa(i+1), -1)
+}
+
+// expandTemplates turns each template of a list into its mappings, in order.
+func expandTemplates(templatesNode *yaml.Node, fallback *yaml.Node, templates []MidiTemplate, preset *ControllerPreset, noPreset string) ([]MidiAction, ConfigErrors) {
+	errs := make(ConfigErrors, 0)
+	expanded := make([]MidiAction, 0)
+
+	for i := range templates {
+		t := &templates[i]
+		node := listItemNode(templatesNode, i, fallback)
+
+		actions, templateErrs := t.controls(node, preset, noPreset)
+		errs = append(errs, templateErrs...)
+		if len(templateErrs) > 0 {
+			continue
+		}
+
+		if len(t.TargetNames) > 0 && len(t.TargetNames) != len(actions) {
+			errs = append(errs, ConfigError{lineOf(node, "TargetNames"), fmt.Sprintf(
+				"there are %d TargetNames for %d controls", len(t.TargetNames), len(actions),
+			)})
+			continue
+		}
+		if len(t.TargetNames) > 0 && t.Action.TargetName != "" {
+			errs = append(errs, ConfigError{lineOf(node, "TargetNames"), "TargetNames can't be set along with the TargetName of the Action"})
+			continue
+		}
+
+		for j := range actions {
+			actions[j].Action.TargetName = t.targetName(j)
+		}
+
+		if t.Omni {
+			actions = omniActions(actions)
+		}
+		t.count = len(actions)
+		expanded = append(expanded, actions...)
+	}
+
+	return expanded, errs
+}
+
+// controls returns a mapping for every control the template covers, without
+// its target.
+func (t MidiTemplate) controls(node *yaml.Node, preset *ControllerPreset, noPreset string) ([]MidiAction, ConfigErrors) {
+	actions := make([]MidiAction, 0)
+
+	if len(t.Controls) > 0 {
+		for _, key := range []string{"FirstController", "LastController"} {
+			if mappingValue(node, key) != nil {
+				return nil, ConfigErrors{{lineOf(node, key), fmt.Sprintf("%s can't be set along with Controls", key)}}
+			}
+		}
+
+		for _, name := range t.Controls {
+			actions = append(actions, MidiAction{
+				Control:       name,
+				MaxInputValue: t.MaxInputValue,
+				Pickup:        t.Pickup,
+				Action:        t.Action,
+			})
+		}
+		return actions, resolveMidiActions(nil, node, actions, preset, noPreset)
+	}
+
+	if t.LastController > 127 {
+		return nil, ConfigErrors{{lineOf(node, "LastController"), fmt.Sprintf("LastController %d is out of range, must be between 0 and 127", t.LastController)}}
+	}
+	if t.LastController < t.FirstController {
+		return nil, ConfigErrors{{lineOf(node, "LastController"), "LastController can't be before FirstController"}}
+	}
+	if t.ActionType == PitchBend && t.LastController != t.FirstController {
+		return nil, ConfigErrors{{lineOf(node, "LastController"), "a PitchBend template can't cover a range of controllers, use Omni to cover every channel"}}
+	}
+
+	for controller := int(t.FirstController); controller <= int(t.LastController); controller++ {
+		actions = append(actions, MidiAction{
+			ActionType:    t.ActionType,
+			Channel:       t.Channel,
+			Controller:    uint8(controller),
+			MaxInputValue: t.MaxInputValue,
+			Relative:      t.Relative,
+			Pickup:        t.Pickup,
+			Action:        t.Action,
+		})
+	}
+	return actions, nil
+}
+
+// omniActions repeats every mapping on each of the 16 channels.
+func omniActions(actions []MidiAction) []MidiAction {
+	omni := make([]MidiAction, 0, len(actions)*16)
+	for _, action := range actions {
+		for channel := uint8(0); channel < 16; channel++ {
+			copied := action
+			if copied.Channel != channel {
+				// The preset control is on a single channel.
+				copied.Control = ""
+				copied.Channel = channel
+			}
+			omni = append(omni, copied)
+		}
+	}
+	return omni
+}
+
+// mappingNodes returns the node each mapping of a list was read from. The
+// mappings expanded from templates follow the ones listed in MidiActions,
+// and are reported on the line of their template.
+func mappingNodes(parent *yaml.Node, actions []MidiAction, templates []MidiTemplate) []*yaml.Node {
+	listed := len(actions)
+	for _, t := range templates {
+		listed -= t.count
+	}
+
+	nodes := make([]*yaml.Node, 0, len(actions))
+	actionsNode := mappingValue(parent, "MidiActions")
+	for i := 0; i < listed; i++ {
+		nodes = append(nodes, listItemNode(actionsNode, i, parent))
+	}
+
+	templatesNode := mappingValue(parent, "Templates")
+	for i, t := range templates {
+		node := listItemNode(templatesNode, i, parent)
+		for j := 0; j < t.count; j++ {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,143 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandTemplates(t *testing.T) {
+	nanoKontrol, _ := PresetByName("KORG nanoKONTROL2")
+	sink := PulseAudioAction{TargetType: Sink, ActionType: VolumeChange}
+	deck := PulseAudioAction{TargetType: Sink, TargetName: "Deck {n}", ActionType: VolumeChange}
+
+	tests := []struct {
+		name     string
+		template MidiTemplate
+		preset   *ControllerPreset
+		// want describes each mapping as its midi message and target.
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "controller range",
+			template: MidiTemplate{
+				ActionType: ControlChange, Channel: 1, FirstController: 7, LastController: 9,
+				MaxInputValue: 127, Action: deck,
+			},
+			want: []string{"ControlChange 1/7 Deck 1", "ControlChange 1/8 Deck 2", "ControlChange 1/9 Deck 3"},
+		},
+		{
+			name: "target names",
+			template: MidiTemplate{
+				ActionType: Note, FirstController: 32, LastController: 33,
+				MaxInputValue: 127, TargetNames: []string{"Speakers", "Headphones"}, Action: sink,
+			},
+			want: []string{"Note 0/32 Speakers", "Note 0/33 Headphones"},
+		},
+		{
+			name: "preset controls",
+			template: MidiTemplate{
+				Controls: []string{"fader1", "fader2"}, Action: deck,
+			},
+			preset: nanoKontrol,
+			want:   []string{"ControlChange 0/0 Deck 1", "ControlChange 0/1 Deck 2"},
+		},
+		{
+			name: "preset controls without a preset",
+			template: MidiTemplate{
+				Controls: []string{"fader1"}, Action: deck,
+			},
+			wantErr: `Control "fader1" can only be used with a Preset`,
+		},
+		{
+			name: "too few target names",
+			template: MidiTemplate{
+				ActionType: ControlChange, FirstController: 0, LastController: 2,
+				MaxInputValue: 127, TargetNames: []string{"Speakers"}, Action: sink,
+			},
+			wantErr: "there are 1 TargetNames for 3 controls",
+		},
+		{
+			name: "target names and target name",
+			template: MidiTemplate{
+				ActionType: ControlChange, FirstController: 0, LastController: 1,
+				MaxInputValue: 127, TargetNames: []string{"Speakers", "Headphones"}, Action: deck,
+			},
+			wantErr: "TargetNames can't be set along with the TargetName of the Action",
+		},
+		{
+			name: "range backwards",
+			template: MidiTemplate{
+				ActionType: ControlChange, FirstController: 5, LastController: 4,
+				MaxInputValue: 127, Action: deck,
+			},
+			wantErr: "LastController can't be before FirstController",
+		},
+		{
+			name: "range out of bounds",
+			template: MidiTemplate{
+				ActionType: ControlChange, FirstController: 120, LastController: 130,
+				MaxInputValue: 127, Action: deck,
+			},
+			wantErr: "LastController 130 is out of range",
+		},
+		{
+			name: "pitch bend range",
+			template: MidiTemplate{
+				ActionType: PitchBend, FirstController: 0, LastController: 1,
+				MaxInputValue: 16383, Action: deck,
+			},
+			wantErr: "a PitchBend template can't cover a range of controllers",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &yaml.Node{Kind: yaml.MappingNode, Line: 1}
+			actions, errs := expandTemplates(nil, node, []MidiTemplate{tt.template}, tt.preset, "no preset matches the input [test]")
+
+			if tt.wantErr != "" {
+				if len(errs) == 0 || !strings.Contains(errs.Error(), tt.wantErr) {
+					t.Fatalf("expandTemplates() returned errors %v, want %q", errs, tt.wantErr)
+				}
+				return
+			}
+			if len(errs) > 0 {
+				t.Fatalf("expandTemplates() returned errors %v", errs)
+			}
+
+			got := make([]string, 0, len(actions))
+			for _, action := range actions {
+				got = append(got, fmt.Sprintf("%s %d/%d %s", action.ActionType, action.Channel, action.Controller, action.Action.TargetName))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandTemplates() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTemplatesOmni(t *testing.T) {
+	node := &yaml.Node{Kind: yaml.MappingNode, Line: 1}
+	template := MidiTemplate{
+		ActionType: ControlChange, FirstController: 7, LastController: 8, Omni: true, MaxInputValue: 127,
+		Action: PulseAudioAction{TargetType: Sink, TargetName: "Deck {n}", ActionType: VolumeChange},
+	}
+
+	actions, errs := expandTemplates(nil, node, []MidiTemplate{template}, nil, "")
+	if len(errs) > 0 {
+		t.Fatalf("expandTemplates() returned errors %v", errs)
+	}
+	if len(actions) != 32 {
+		t.Fatalf("expandTemplates() returned %d mappings, want 32", len(actions))
+	}
+	for i, action := range actions {
+		if want := uint8(i % 16); action.Channel != want {
+			t.Errorf("mapping %d is on channel %d, want %d", i, action.Channel, want)
+		}
+	}
+}
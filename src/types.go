@@ -1,47 +1,373 @@
 package pamidicontrol
 
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
 type MidiActionType string
 
 const (
 	ControlChange MidiActionType = "ControlChange"
+	Note          MidiActionType = "Note"
+	PitchBend     MidiActionType = "PitchBend"
+	// ProgramChange messages act like a button press, with the program
+	// number as the Controller.
+	ProgramChange MidiActionType = "ProgramChange"
+)
+
+// Valid reports whether t is a known midi action type.
+func (t MidiActionType) Valid() bool {
+	switch t {
+	case ControlChange, Note, PitchBend, ProgramChange:
+		return true
+	}
+	return false
+}
+
+// MaxValue returns the largest value a message of this type can carry.
+func (t MidiActionType) MaxValue() uint {
+	if t == PitchBend {
+		return 16383
+	}
+	return 127
+}
+
+// RelativeEncoding describes how an endless encoder sends the amount it was
+// turned by in a ControlChange value.
+type RelativeEncoding string
+
+const (
+	// Absolute controls send their position rather than a change.
+	Absolute RelativeEncoding = ""
+	// TwosComplement encoders send 1 to 63 clockwise and 127 down to 65
+	// anti-clockwise.
+	TwosComplement RelativeEncoding = "TwosComplement"
+	// SignMagnitude encoders send 1 to 63 clockwise and 65 up to 127
+	// anti-clockwise, as used by Mackie Control V-Pots.
+	SignMagnitude RelativeEncoding = "SignMagnitude"
+	// BinaryOffset encoders send 65 and up clockwise and 63 and down
+	// anti-clockwise.
+	BinaryOffset RelativeEncoding = "BinaryOffset"
 )
 
+// Valid reports whether e is a known relative encoding.
+func (e RelativeEncoding) Valid() bool {
+	switch e {
+	case Absolute, TwosComplement, SignMagnitude, BinaryOffset:
+		return true
+	}
+	return false
+}
+
+// Delta decodes the number of steps an encoder was turned by.
+func (e RelativeEncoding) Delta(value uint8) int {
+	switch e {
+	case TwosComplement:
+		if value >= 64 {
+			return int(value) - 128
+		}
+		return int(value)
+	case SignMagnitude:
+		if value >= 64 {
+			return -int(value - 64)
+		}
+		return int(value)
+	case BinaryOffset:
+		return int(value) - 64
+	}
+	return 0
+}
+
 type PulseAudioActionType string
 
 const (
 	VolumeChange PulseAudioActionType = "VolumeChange"
-	Mute                              = "Mute"
+	Mute         PulseAudioActionType = "Mute"
+	Move         PulseAudioActionType = "Move"
+	// RecallScene recalls the scene named by Scene.
+	RecallScene PulseAudioActionType = "RecallScene"
+	// Crossfade blends between the targets A and B.
+	Crossfade PulseAudioActionType = "Crossfade"
 )
 
+// Valid reports whether t is a known pulseaudio action type.
+func (t PulseAudioActionType) Valid() bool {
+	switch t {
+	case VolumeChange, Mute, Move, RecallScene, Crossfade:
+		return true
+	}
+	return false
+}
+
 type PulseAudioTargetType string
 
 const (
 	PlaybackStream PulseAudioTargetType = "PlaybackStream"
-	RecordStream                        = "RecordStream"
-	Sink                                = "Sink"
-	Source                              = "Source"
+	RecordStream   PulseAudioTargetType = "RecordStream"
+	Sink           PulseAudioTargetType = "Sink"
+	Source         PulseAudioTargetType = "Source"
 )
 
+// Valid reports whether t is a known pulseaudio target type.
+func (t PulseAudioTargetType) Valid() bool {
+	switch t {
+	case PlaybackStream, RecordStream, Sink, Source:
+		return true
+	}
+	return false
+}
+
 type PulseAudioAction struct {
 	TargetType PulseAudioTargetType
 	TargetName string
 
 	ActionType PulseAudioActionType
+
+	// DeviceName is the sink or source streams are moved to by a Move action.
+	DeviceName string
+
+	// Scene is the scene recalled by a RecallScene action, and Fade how
+	// long its volumes take to fade in.
+	Scene string
+	Fade  time.Duration
+
+	// Ramp is how long a VolumeChange takes to get to a new volume, or a
+	// Mute takes to fade out before muting and to fade back in. Curve is
+	// the shape of the ramp, and of the fade of a RecallScene action.
+	Ramp  time.Duration
+	Curve RampCurve
+	// SlewRate limits how fast a VolumeChange moves the volume, as a
+	// fraction of full volume a second, so a bumped fader turns it up
+	// gradually.
+	SlewRate float32
+
+	// A and B are the targets a Crossfade action blends between, from only
+	// A at the bottom of the control to only B at the top, following Law.
+	A   CrossfadeSide
+	B   CrossfadeSide
+	Law CrossfadeLaw
 }
 
 type MidiAction struct {
+	// Control is the name of a control of the controller preset, such as
+	// fader1. It fills in the ActionType, Channel, Controller, MaxInputValue
+	// and Relative settings.
+	Control string
+
 	ActionType MidiActionType
 
-	Channel    uint8
+	Channel uint8
+	// Controller is the controller number of a ControlChange, the note
+	// number of a Note or the program of a ProgramChange. It is unused for
+	// PitchBend.
 	Controller uint8
 
+	// MaxInputValue is the value sent at 100%. For relative encoders it is
+	// the number of steps between 0% and 100%.
 	MaxInputValue uint
 
+	// Relative is set for endless encoders that send changes rather than
+	// positions.
+	Relative RelativeEncoding
+
+	// Pickup enables soft takeover for faders and knobs that can end up out
+	// of step with the volume of their target.
+	Pickup PickupMode
+
 	Action PulseAudioAction
 }
 
-type Config struct {
-	MidiActions    []MidiAction
+// String describes the control an action is mapped to.
+func (a MidiAction) String() string {
+	if a.Control != "" {
+		return a.Control
+	}
+	if a.ActionType == PitchBend {
+		return fmt.Sprintf("%s on Channel %d", a.ActionType, a.Channel)
+	}
+	return fmt.Sprintf("%s on Channel %d, Controller %d", a.ActionType, a.Channel, a.Controller)
+}
+
+// Device is a midi controller and the mappings of its controls.
+type Device struct {
 	InputMidiName  string
 	OutputMidiName string
+
+	// InputPort and OutputPort pick the midi ports by a pattern or the USB
+	// device they belong to, instead of InputMidiName and OutputMidiName.
+	InputPort  *PortMatch
+	OutputPort *PortMatch
+
+	// Preset is the name of the built in controller preset to use. By
+	// default it is chosen by matching the input name.
+	Preset string
+
+	// Setup configures the controller when its ports are opened, for
+	// presets that know how to.
+	Setup *ControllerSetup
+
+	// Protocol is set for control surfaces that have channel strips driven
+	// by pamidicontrol, rather than through MidiActions.
+	Protocol Protocol
+	// Strips are the objects on the channel strips of the surface, from
+	// left to right.
+	Strips []Strip
+
+	// AutoAssign hands out strips to the applications that are playing.
+	AutoAssign *AutoAssign
+
+	// Matrix routes streams to sinks, or from sources, with the pads of a
+	// grid controller.
+	Matrix *Matrix
+
+	// Meters show the levels of sinks, sources and streams on the LEDs of
+	// the controller.
+	Meters []Meter
+
+	// Privacy lights an LED while the microphone is in use, and has a
+	// button that keeps every source muted.
+	Privacy *Privacy
+
+	// DoseIndicator names a control whose LED blinks once the daily
+	// listening exposure of the Safety settings is exceeded.
+	DoseIndicator *Button
+
+	MidiActions []MidiAction
+	// Templates map blocks of controls, and are expanded into MidiActions
+	// when the configuration is loaded.
+	Templates []MidiTemplate
+
+	// Layers hold more mappings than there are controls, switched with the
+	// layer buttons or paged through with BankLeft and BankRight.
+	Layers    []Layer
+	BankLeft  *Button
+	BankRight *Button
+}
+
+// configured returns whether anything is set for the device.
+func (d Device) configured() bool {
+	return !isZeroValue(reflect.ValueOf(d))
+}
+
+// unnamed returns whether neither midi port of the device is configured, so
+// it is found by asking the controllers to identify themselves.
+func (d Device) unnamed() bool {
+	return d.InputMidiName == "" && d.InputPort == nil && d.OutputMidiName == "" && d.OutputPort == nil
+}
+
+// AllMidiActions returns the top level mappings of the device followed by
+// those of every layer.
+func (d Device) AllMidiActions() []MidiAction {
+	actions := append([]MidiAction{}, d.MidiActions...)
+	for _, layer := range d.Layers {
+		actions = append(actions, layer.MidiActions...)
+	}
+	return actions
+}
+
+// ControllerPreset returns the preset for the controller. A device whose
+// input is picked by InputPort only has a preset if it names it, as the name
+// of the port isn't known until it is found.
+func (d Device) ControllerPreset() (*ControllerPreset, bool) {
+	if d.Preset != "" {
+		return PresetByName(d.Preset)
+	}
+	if d.InputPort != nil && d.InputMidiName == "" {
+		return nil, false
+	}
+	return FindPreset(d.InputMidiName)
+}
+
+// noPresetReason explains why the device has no preset, for the errors about
+// the settings that need one.
+func (d Device) noPresetReason() string {
+	if d.InputPort != nil && d.InputMidiName == "" {
+		return "a device whose input is picked by InputPort has to name its Preset"
+	}
+	return fmt.Sprintf("no preset matches the input [%s]", d.InputMidiName)
+}
+
+type Config struct {
+	// The top level device settings configure the first device, which is
+	// all that is needed for a single controller.
+	Device `mapstructure:",squash"`
+
+	// Devices are further controllers used at the same time, each with
+	// its own mappings.
+	Devices []Device
+
+	// ScenesFile is where scenes are saved. It defaults to scenes.yaml next
+	// to the configuration file.
+	ScenesFile string
+
+	// StateFile is where the last value of every mapping is saved, so
+	// objects that appear later start at the volume of their controls. It
+	// defaults to state.yaml next to the configuration file.
+	StateFile string
+
+	// MaxVolumeUpdates limits how many times a second the volume of each
+	// target is changed, skipping to the newest position of a fader in
+	// between. By default volumes are changed as fast as pulseaudio takes
+	// them.
+	MaxVolumeUpdates uint
+
+	// Ducking turns some playback streams down while others are playing.
+	Ducking []DuckingRule
+
+	// Safety limits the volume of sinks and keeps track of how much has
+	// been listened to.
+	Safety *Safety
+}
+
+// AllDevices returns the top level device, unless only Devices are set,
+// followed by the Devices.
+func (c Config) AllDevices() []Device {
+	devices := make([]Device, 0, len(c.Devices)+1)
+	if c.Device.configured() || len(c.Devices) == 0 {
+		devices = append(devices, c.Device)
+	}
+	return append(devices, c.Devices...)
+}
+
+// devicesIndex returns the index in Devices of the i'th device returned by
+// AllDevices, or -1 for the top level device.
+func (c Config) devicesIndex(i int) int {
+	if c.Device.configured() || len(c.Devices) == 0 {
+		return i - 1
+	}
+	return i
+}
+
+// AllMidiActions returns the mappings of every device.
+func (c Config) AllMidiActions() []MidiAction {
+	actions := make([]MidiAction, 0)
+	for _, device := range c.AllDevices() {
+		actions = append(actions, device.AllMidiActions()...)
+	}
+	return actions
+}
+
+// ScenesPath returns where scenes are saved.
+func (c Config) ScenesPath() string {
+	return nextToConfig(c.ScenesFile, "scenes.yaml")
+}
+
+// StatePath returns where the state of the controls is saved.
+func (c Config) StatePath() string {
+	return nextToConfig(c.StateFile, "state.yaml")
+}
+
+// nextToConfig resolves a file name from the configuration, which is relative
+// to the configuration file, falling back to a default name.
+func nextToConfig(name string, defaultName string) string {
+	if name == "" {
+		name = defaultName
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(ConfigFileUsed()), name)
 }
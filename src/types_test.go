@@ -0,0 +1,37 @@
+package pamidicontrol
+
+import "testing"
+
+func TestRelativeEncodingDelta(t *testing.T) {
+	tests := []struct {
+		encoding RelativeEncoding
+		value    uint8
+		want     int
+	}{
+		{Absolute, 1, 0},
+		{Absolute, 127, 0},
+
+		{TwosComplement, 1, 1},
+		{TwosComplement, 63, 63},
+		{TwosComplement, 127, -1},
+		{TwosComplement, 65, -63},
+		{TwosComplement, 64, -64},
+
+		{SignMagnitude, 1, 1},
+		{SignMagnitude, 63, 63},
+		{SignMagnitude, 65, -1},
+		{SignMagnitude, 127, -63},
+
+		{BinaryOffset, 65, 1},
+		{BinaryOffset, 127, 63},
+		{BinaryOffset, 63, -1},
+		{BinaryOffset, 0, -64},
+		{BinaryOffset, 64, 0},
+	}
+
+	for _, tt := range tests {
+		if got := tt.encoding.Delta(tt.value); got != tt.want {
+			t.Errorf("%q.Delta(%d) = %d, want %d", tt.encoding, tt.value, got, tt.want)
+		}
+	}
+}
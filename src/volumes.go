@@ -0,0 +1,324 @@
+package pamidicontrol
+
+import (
+	"github.com/godbus/dbus"
+)
+
+// volumeTolerance is how far apart two volumes can be while still being
+// considered the same, to allow for rounding by pulseaudio.
+const volumeTolerance = 0.005
+
+// recentVolumes is how many of the volumes last set on an object are
+// remembered, so that the signals for them can be told apart from changes
+// made by other applications.
+const recentVolumes = 16
+
+// volumeState tracks the volume of a pulseaudio object.
+type volumeState struct {
+	volume  float32
+	balance float32
+	muted   bool
+
+	// sent holds the volumes pamidicontrol set most recently.
+	sent []float32
+
+	// externalChanges counts the volume changes made by other
+	// applications, such as pavucontrol.
+	externalChanges uint64
+
+	// duck is how far a ducking rule turns the object down, as a fraction
+	// of its volume. volume is the volume before it is turned down, and
+	// sent holds the volumes after.
+	duck float32
+}
+
+// applied returns the volume pulseaudio is given for a volume, once it has
+// been turned down by ducking.
+func (s *volumeState) applied(volume float32) float32 {
+	return volume * (1 - s.duck)
+}
+
+// TrackedVolume is the volume of an object as seen through the volume update
+// signals.
+type TrackedVolume struct {
+	Path dbus.ObjectPath
+
+	// Volume is the volume of the loudest channel.
+	Volume float32
+	// Balance is -1 when only the left channel is audible, 1 when only the
+	// right channel is and 0 when they are equally loud.
+	Balance float32
+	Muted   bool
+
+	// ExternalChanges increases every time another application changes
+	// the volume.
+	ExternalChanges uint64
+}
+
+// TrackedVolume returns the volume of the first object an action targets.
+// The volume is read from pulseaudio the first time it is asked for, and kept
+// up to date by the volume update signals after that.
+func (c *PAClient) TrackedVolume(action PulseAudioAction) (TrackedVolume, bool, error) {
+	paths := c.targetPaths(action)
+	if len(paths) == 0 {
+		return TrackedVolume{}, false, nil
+	}
+	return c.pathVolume(action.TargetType, paths[0])
+}
+
+// pathVolume returns the volume of the object at path, reading it from
+// pulseaudio if it isn't tracked yet.
+func (c *PAClient) pathVolume(targetType PulseAudioTargetType, path dbus.ObjectPath) (TrackedVolume, bool, error) {
+	if tracked, ok := c.trackedVolume(path); ok {
+		return tracked, true, nil
+	}
+
+	obj := c.object(targetType, path)
+	volumes, err := obj.ListUint32("Volume")
+	if err != nil || len(volumes) == 0 {
+		return TrackedVolume{}, false, err
+	}
+
+	// Record streams have no mute state, so a failure to read it is fine.
+	muted, _ := obj.Bool("Mute")
+
+	c.mu.Lock()
+	if _, ok := c.volumes[path]; !ok {
+		volume, balance := splitVolumes(volumes)
+		c.volumes[path] = &volumeState{volume: volume, balance: balance, muted: muted}
+	}
+	c.mu.Unlock()
+
+	tracked, _ := c.trackedVolume(path)
+	return tracked, true, nil
+}
+
+func (c *PAClient) trackedVolume(path dbus.ObjectPath) (TrackedVolume, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state, ok := c.volumes[path]
+	if !ok {
+		return TrackedVolume{}, false
+	}
+	return TrackedVolume{path, state.volume, state.balance, state.muted, state.externalChanges}, true
+}
+
+// AddListener registers a function that is called whenever the volume or mute
+// state of an object changes, with the path of the object. It is called with
+// an empty path when objects appear or go away.
+func (c *PAClient) AddListener(listener func(path dbus.ObjectPath)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.listeners = append(c.listeners, listener)
+}
+
+func (c *PAClient) notify(path dbus.ObjectPath) {
+	c.mu.RLock()
+	listeners := c.listeners
+	c.mu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(path)
+	}
+}
+
+func (c *PAClient) DeviceVolumeUpdated(path dbus.ObjectPath, values []uint32) {
+	c.volumeUpdated(path, values)
+}
+
+func (c *PAClient) StreamVolumeUpdated(path dbus.ObjectPath, values []uint32) {
+	c.volumeUpdated(path, values)
+}
+
+func (c *PAClient) DeviceMuteUpdated(path dbus.ObjectPath, muted bool) {
+	c.muteUpdated(path, muted)
+}
+
+func (c *PAClient) StreamMuteUpdated(path dbus.ObjectPath, muted bool) {
+	c.muteUpdated(path, muted)
+}
+
+// volumeUpdated records the new volume of an object, working out whether it
+// was changed by pamidicontrol or by another application.
+func (c *PAClient) volumeUpdated(path dbus.ObjectPath, values []uint32) {
+	if len(values) == 0 {
+		return
+	}
+	volume, balance := splitVolumes(values)
+
+	c.mu.Lock()
+	state, ok := c.volumes[path]
+	if !ok {
+		c.volumes[path] = &volumeState{volume: volume, balance: balance}
+	} else {
+		// A ducked object keeps the volume it would have otherwise, unless
+		// it is turned all the way down.
+		if state.duck < 1 {
+			state.volume = volume / (1 - state.duck)
+		}
+		state.balance = balance
+
+		external := true
+		for _, sent := range state.sent {
+			if abs32(sent-volume) <= volumeTolerance {
+				external = false
+			}
+		}
+		if external {
+			state.externalChanges++
+		}
+	}
+	c.mu.Unlock()
+
+	c.notify(path)
+}
+
+func (c *PAClient) muteUpdated(path dbus.ObjectPath, muted bool) {
+	c.mu.Lock()
+	if state, ok := c.volumes[path]; ok {
+		state.muted = muted
+	}
+	c.mu.Unlock()
+
+	c.notify(path)
+}
+
+// setVolume sets the volume and balance of the object at path, within the
+// limits of the safety settings, and records them as sent.
+func (c *PAClient) setVolume(targetType PulseAudioTargetType, path dbus.ObjectPath, volume float32, balance float32) error {
+	c.mu.RLock()
+	limiter := c.limiter
+	c.mu.RUnlock()
+
+	if limiter != nil && targetType == Sink {
+		volume = limiter.limit(path, volume)
+	}
+	return c.applyVolume(targetType, path, volume, balance)
+}
+
+// applyVolume sets the volume and balance of the object at path, turned down
+// by its ducking, and records them as sent.
+func (c *PAClient) applyVolume(targetType PulseAudioTargetType, path dbus.ObjectPath, volume float32, balance float32) error {
+	c.mu.RLock()
+	applied := volume
+	if state, ok := c.volumes[path]; ok {
+		applied = state.applied(volume)
+	}
+	c.mu.RUnlock()
+
+	if err := c.object(targetType, path).Set("Volume", channelVolumes(applied, balance)); err != nil {
+		return err
+	}
+	c.volumeSent(path, volume, balance)
+	return nil
+}
+
+// SetDuck turns the object at path down by a fraction of its volume, or back
+// up with a duck of zero. Its tracked volume stays the same, so controls keep
+// showing the volume it has when it isn't ducked.
+func (c *PAClient) SetDuck(targetType PulseAudioTargetType, path dbus.ObjectPath, duck float32) error {
+	tracked, ok, err := c.pathVolume(targetType, path)
+	if err != nil || !ok {
+		return err
+	}
+
+	c.mu.Lock()
+	if state, ok := c.volumes[path]; ok {
+		state.duck = duck
+	}
+	c.mu.Unlock()
+
+	return c.setVolume(targetType, path, tracked.Volume, tracked.Balance)
+}
+
+// volumeSent records a volume pamidicontrol set on an object.
+func (c *PAClient) volumeSent(path dbus.ObjectPath, volume float32, balance float32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	state, ok := c.volumes[path]
+	if !ok {
+		state = &volumeState{}
+		c.volumes[path] = state
+	}
+
+	state.volume = volume
+	state.balance = balance
+	state.sent = append(state.sent, state.applied(volume))
+	if len(state.sent) > recentVolumes {
+		state.sent = state.sent[len(state.sent)-recentVolumes:]
+	}
+}
+
+// balanceOf returns the last known balance of an object.
+func (c *PAClient) balanceOf(path dbus.ObjectPath) float32 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if state, ok := c.volumes[path]; ok {
+		return state.balance
+	}
+	return 0
+}
+
+// pruneVolumes forgets the volumes of objects that no longer exist. The
+// caller must hold c.mu.
+func (c *PAClient) pruneVolumes() {
+	exists := make(map[dbus.ObjectPath]bool, len(c.volumes))
+	for _, byName := range []map[string][]dbus.ObjectPath{c.sinksByName, c.sourcesByName, c.playbackStreamsByName, c.recordStreamsByName} {
+		for _, paths := range byName {
+			for _, path := range paths {
+				exists[path] = true
+			}
+		}
+	}
+
+	for path := range c.volumes {
+		if !exists[path] {
+			delete(c.volumes, path)
+		}
+	}
+}
+
+// splitVolumes turns the channel volumes of an object into its overall volume
+// and its balance between the first two channels.
+func splitVolumes(values []uint32) (volume float32, balance float32) {
+	max := uint32(0)
+	for _, value := range values {
+		if value > max {
+			max = value
+		}
+	}
+	volume = float32(max) / 65535
+
+	if len(values) == 2 && max > 0 {
+		left, right := float32(values[0]), float32(values[1])
+		if left > right {
+			balance = right/left - 1
+		} else {
+			balance = 1 - left/right
+		}
+	}
+	return volume, balance
+}
+
+// channelVolumes is the reverse of splitVolumes, giving the values to set for
+// a volume and balance.
+func channelVolumes(volume float32, balance float32) []uint32 {
+	left, right := volume, volume
+	if balance > 0 {
+		left *= 1 - balance
+	} else {
+		right *= 1 + balance
+	}
+	return []uint32{uint32(left * 65535), uint32(right * 65535)}
+}
+
+func abs32(f float32) float32 {
+	if f < 0 {
+		return -f
+	}
+	return f
+}
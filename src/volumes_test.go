@@ -0,0 +1,62 @@
+package pamidicontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitVolumes(t *testing.T) {
+	tests := []struct {
+		values      []uint32
+		wantVolume  float32
+		wantBalance float32
+	}{
+		{[]uint32{}, 0, 0},
+		{[]uint32{0, 0}, 0, 0},
+		{[]uint32{65535, 65535}, 1, 0},
+		{[]uint32{65535, 0}, 1, -1},
+		{[]uint32{0, 65535}, 1, 1},
+		{[]uint32{32768, 65536 / 4}, 0.5, -0.5},
+		{[]uint32{65535 / 5, 65535 / 5 * 4}, 0.8, 0.75},
+		{[]uint32{65535, 32768, 0}, 1, 0},
+	}
+
+	for _, tt := range tests {
+		volume, balance := splitVolumes(tt.values)
+		if abs32(volume-tt.wantVolume) > 1e-4 || abs32(balance-tt.wantBalance) > 1e-4 {
+			t.Errorf("splitVolumes(%v) = %v, %v, want %v, %v", tt.values, volume, balance, tt.wantVolume, tt.wantBalance)
+		}
+	}
+}
+
+func TestChannelVolumes(t *testing.T) {
+	tests := []struct {
+		volume  float32
+		balance float32
+		want    []uint32
+	}{
+		{0, 0, []uint32{0, 0}},
+		{1, 0, []uint32{65535, 65535}},
+		{1, -1, []uint32{65535, 0}},
+		{1, 1, []uint32{0, 65535}},
+		{0.5, 0.5, []uint32{16383, 32767}},
+		{0.5, -0.5, []uint32{32767, 16383}},
+	}
+
+	for _, tt := range tests {
+		if got := channelVolumes(tt.volume, tt.balance); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("channelVolumes(%v, %v) = %v, want %v", tt.volume, tt.balance, got, tt.want)
+		}
+	}
+}
+
+func TestChannelVolumesRoundTrip(t *testing.T) {
+	for _, volume := range []float32{0.1, 0.5, 1} {
+		for _, balance := range []float32{-1, -0.5, 0, 0.25, 1} {
+			gotVolume, gotBalance := splitVolumes(channelVolumes(volume, balance))
+			if abs32(gotVolume-volume) > 1e-3 || abs32(gotBalance-balance) > 1e-3 {
+				t.Errorf("splitVolumes(channelVolumes(%v, %v)) = %v, %v", volume, balance, gotVolume, gotBalance)
+			}
+		}
+	}
+}
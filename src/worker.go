@@ -0,0 +1,375 @@
+package pamidicontrol
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/rs/zerolog/log"
+)
+
+// volumeWorker sets volumes in the background, so that the midi reader
+// doesn't wait on pulseaudio. Each target has its own queue that only keeps
+// the newest volume, so a fast fader sweep skips the positions pulseaudio
+// can't keep up with and always ends at the last one.
+type volumeWorker struct {
+	client *PAClient
+
+	// interval is the shortest time between two volume changes of a
+	// target. Zero sets them as fast as pulseaudio takes them.
+	interval time.Duration
+
+	mu      sync.Mutex
+	targets map[workTarget]*pendingVolume
+
+	stats *latencyStats
+}
+
+// pendingVolume is the queue of a single target. Its goroutine stops once
+// nothing is waiting, and the next volume queued starts a new one.
+type pendingVolume struct {
+	waiting  bool
+	volume   float32
+	received time.Time
+	queued   time.Time
+
+	// ramp moves the target to volume gradually. It is nil when the volume
+	// is set straight away.
+	ramp *volumeRamp
+}
+
+func newVolumeWorker(client *PAClient, interval time.Duration) *volumeWorker {
+	return &volumeWorker{
+		client:   client,
+		interval: interval,
+		targets:  make(map[workTarget]*pendingVolume, 0),
+		stats:    newLatencyStats(),
+	}
+}
+
+// workTarget is a queue of the worker, which sets the volume of every object
+// of a target, or only of the one at path if it is set.
+type workTarget struct {
+	action PulseAudioAction
+	path   dbus.ObjectPath
+}
+
+// workKey is the queue a volume action goes to.
+func workKey(action PulseAudioAction) workTarget {
+	return workTarget{action: PulseAudioAction{TargetType: action.TargetType, TargetName: action.TargetName}}
+}
+
+// String names the target of the queue, for the log.
+func (t workTarget) String() string {
+	if t.path != "" {
+		return fmt.Sprintf("%s at %s", targetKey(t.action), t.path)
+	}
+	return targetKey(t.action)
+}
+
+// Set queues a volume for the target of action, replacing any volume still
+// waiting for it. received is when the midi message asking for it arrived.
+// Actions with a Ramp or SlewRate move to the volume gradually.
+func (w *volumeWorker) Set(action PulseAudioAction, volume float32, received time.Time) {
+	w.queue(action, volume, action.volumeRamp(), received)
+}
+
+// Ramp queues a volume for the target of action that it moves to gradually,
+// replacing any volume or ramp still waiting for it.
+func (w *volumeWorker) Ramp(action PulseAudioAction, volume float32, ramp volumeRamp, received time.Time) {
+	w.queue(action, volume, &ramp, received)
+}
+
+// SetObject queues a volume for the single object at path, which is one of
+// the objects of the target of action, replacing any volume still waiting for
+// it. The other objects of the target are left as they are.
+func (w *volumeWorker) SetObject(action PulseAudioAction, path dbus.ObjectPath, volume float32, received time.Time) {
+	key := workKey(action)
+	key.path = path
+
+	w.mu.Lock()
+	queued := time.Now()
+	w.queueLocked(key, volume, nil, received, queued)
+	w.mu.Unlock()
+
+	w.stats.record(stageHandle, queued.Sub(received))
+}
+
+// SetTogether queues the volumes of several targets at once, so that none of
+// them is picked up without the others. Pulseaudio has no way to set the
+// volumes of several objects in one call, so they may still be applied a
+// moment apart by their own queues.
+func (w *volumeWorker) SetTogether(actions []PulseAudioAction, volumes []float32, received time.Time) {
+	w.mu.Lock()
+	queued := time.Now()
+	for i, action := range actions {
+		w.queueLocked(workKey(action), volumes[i], action.volumeRamp(), received, queued)
+	}
+	w.mu.Unlock()
+
+	w.stats.record(stageHandle, queued.Sub(received))
+}
+
+func (w *volumeWorker) queue(action PulseAudioAction, volume float32, ramp *volumeRamp, received time.Time) {
+	w.mu.Lock()
+	queued := time.Now()
+	w.queueLocked(workKey(action), volume, ramp, received, queued)
+	w.mu.Unlock()
+
+	w.stats.record(stageHandle, queued.Sub(received))
+}
+
+// queueLocked replaces the volume waiting in the queue of key, starting the
+// queue if it isn't running. The caller must hold w.mu.
+func (w *volumeWorker) queueLocked(key workTarget, volume float32, ramp *volumeRamp, received time.Time, queued time.Time) {
+	pending, ok := w.targets[key]
+	if !ok {
+		pending = &pendingVolume{}
+		w.targets[key] = pending
+		go w.run(key, pending)
+	}
+
+	if pending.waiting && pending.ramp == nil {
+		w.stats.addCoalesced()
+	}
+	pending.waiting = true
+	pending.volume = volume
+	pending.received = received
+	pending.queued = queued
+	pending.ramp = ramp
+}
+
+// Pending returns the volume waiting to be set on the target of action, if
+// there is one. Relative encoders step from it rather than the volume
+// pulseaudio has, which may not have caught up yet.
+func (w *volumeWorker) Pending(action PulseAudioAction) (float32, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending, ok := w.targets[workKey(action)]
+	if !ok || !pending.waiting {
+		return 0, false
+	}
+	return pending.volume, true
+}
+
+// fadingOut returns the volume a ramp that is fading out the target of action
+// puts back once it has muted it, if there is one.
+func (w *volumeWorker) fadingOut(action PulseAudioAction) (float32, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending, ok := w.targets[workKey(action)]
+	if !ok || !pending.waiting || pending.ramp == nil || pending.ramp.restore == nil {
+		return 0, false
+	}
+	return *pending.ramp.restore, true
+}
+
+// wait returns once every queued volume has been set, including the ends of
+// ramps.
+func (w *volumeWorker) wait() {
+	for {
+		w.mu.Lock()
+		idle := len(w.targets) == 0
+		w.mu.Unlock()
+		if idle {
+			return
+		}
+		time.Sleep(rampStep)
+	}
+}
+
+// run sets the volumes queued for a single target, until there are none left.
+func (w *volumeWorker) run(key workTarget, pending *pendingVolume) {
+	for {
+		for w.step(key, pending) {
+		}
+
+		w.mu.Lock()
+		if !pending.waiting {
+			delete(w.targets, key)
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+	}
+}
+
+// step sets the next volume of a target. It returns true while a ramp has
+// further to go, so a new volume queued in the meantime replaces the rest of
+// the ramp.
+func (w *volumeWorker) step(key workTarget, pending *pendingVolume) bool {
+	w.mu.Lock()
+	if !pending.waiting {
+		w.mu.Unlock()
+		return false
+	}
+
+	ramp := pending.ramp
+	first := ramp != nil && ramp.started.IsZero()
+	if first {
+		// Reading the volume may wait on pulseaudio, so the queue is left
+		// open meanwhile.
+		w.mu.Unlock()
+		from, err := w.current(key)
+		if err != nil {
+			log.Warn().Err(err).Msgf("Could not read the volume of %s", key)
+		}
+		w.mu.Lock()
+		if pending.ramp != ramp {
+			w.mu.Unlock()
+			return true
+		}
+		ramp.start(from, pending.volume, time.Now())
+	}
+
+	volume, received, queued := pending.volume, pending.received, pending.queued
+	done := true
+	if ramp != nil {
+		volume, done = ramp.at(time.Now())
+	}
+	if done {
+		pending.waiting = false
+		pending.ramp = nil
+	}
+	// Only the first volume set for a midi message counts towards the
+	// latency, rather than every step of its ramp.
+	pending.queued = time.Time{}
+	w.mu.Unlock()
+
+	started := time.Now()
+	if !queued.IsZero() {
+		w.stats.record(stageQueue, started.Sub(queued))
+	}
+
+	if err := w.apply(key, volume); err != nil {
+		log.Warn().Err(err).Msgf("Could not set the volume of %s", key)
+	}
+
+	finished := time.Now()
+	if !queued.IsZero() {
+		w.stats.record(stageApply, finished.Sub(started))
+		w.stats.record(stageTotal, finished.Sub(received))
+	}
+
+	if first && ramp.begin != nil {
+		ramp.begin()
+	}
+	if done && ramp != nil && ramp.end != nil {
+		ramp.end()
+	}
+
+	wait := w.interval
+	if !done && wait < rampStep {
+		wait = rampStep
+	}
+	if wait > 0 {
+		time.Sleep(wait - time.Since(started))
+	}
+	return !done
+}
+
+// current returns the volume the queue of key starts a ramp from.
+func (w *volumeWorker) current(key workTarget) (float32, error) {
+	if key.path == "" {
+		volume, _, err := w.client.CurrentVolume(key.action)
+		return volume, err
+	}
+	tracked, _, err := w.client.pathVolume(key.action.TargetType, key.path)
+	return tracked.Volume, err
+}
+
+// apply sets a volume on the objects of the queue of key.
+func (w *volumeWorker) apply(key workTarget, volume float32) error {
+	if key.path == "" {
+		return w.client.ProcessVolumeAction(key.action, volume)
+	}
+	return w.client.setVolume(key.action.TargetType, key.path, volume, w.client.balanceOf(key.path))
+}
+
+// The stages a volume change goes through, from the midi message arriving to
+// pulseaudio having the new volume.
+const (
+	// stageHandle is the time from the midi message arriving to its volume
+	// being queued, which covers decoding and mapping it.
+	stageHandle = "handle"
+	stageQueue  = "queue"
+	stageApply  = "apply"
+	stageTotal  = "total"
+)
+
+var latencyStages = []string{stageHandle, stageQueue, stageApply, stageTotal}
+
+// latencyStats collects how long each stage of a volume change takes.
+type latencyStats struct {
+	mu             sync.Mutex
+	stages         map[string]*latencyStage
+	coalescedCount int
+}
+
+type latencyStage struct {
+	count int
+	total time.Duration
+	max   time.Duration
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{stages: make(map[string]*latencyStage, 0)}
+}
+
+func (s *latencyStats) record(stage string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.stages[stage]
+	if !ok {
+		st = &latencyStage{}
+		s.stages[stage] = st
+	}
+	st.count++
+	st.total += d
+	if d > st.max {
+		st.max = d
+	}
+}
+
+func (s *latencyStats) addCoalesced() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.coalescedCount++
+}
+
+// report logs the latency of each stage since the last report, and starts
+// collecting afresh.
+func (s *latencyStats) report() {
+	s.mu.Lock()
+	stages, coalesced := s.stages, s.coalescedCount
+	s.stages = make(map[string]*latencyStage, 0)
+	s.coalescedCount = 0
+	s.mu.Unlock()
+
+	total, ok := stages[stageTotal]
+	if !ok {
+		return
+	}
+
+	event := log.Info().Int("applied", total.count).Int("coalesced", coalesced)
+	for _, stage := range latencyStages {
+		if st, ok := stages[stage]; ok {
+			event = event.
+				Dur(stage+"Avg", st.total/time.Duration(st.count)).
+				Dur(stage+"Max", st.max)
+		}
+	}
+	event.Msg("Volume change latency")
+}
+
+// reportEvery logs the latency stats at every interval.
+func (s *latencyStats) reportEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.report()
+	}
+}